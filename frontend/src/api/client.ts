@@ -1,5 +1,8 @@
 import axios from "axios";
 
+// Where the token of the guest cart is kept until it is merged on login
+export const CART_TOKEN_KEY = "cartToken";
+
 // Create an axios instance
 const apiClient = axios.create({
   // The base URL will be prefixed to all requests.
@@ -15,6 +18,11 @@ apiClient.interceptors.request.use(
     if (token) {
       config.headers.Authorization = `Bearer ${token}`;
     }
+    // Guests keep their cart through the cart token the cart-service issued.
+    const cartToken = localStorage.getItem(CART_TOKEN_KEY);
+    if (cartToken) {
+      config.headers["X-Cart-Token"] = cartToken;
+    }
     return config;
   },
   (error) => {
@@ -22,4 +30,13 @@ apiClient.interceptors.request.use(
   }
 );
 
+// The cart-service hands a guest without a cart token a new one.
+apiClient.interceptors.response.use((response) => {
+  const cartToken = response.headers["x-cart-token"];
+  if (cartToken) {
+    localStorage.setItem(CART_TOKEN_KEY, cartToken);
+  }
+  return response;
+});
+
 export default apiClient;
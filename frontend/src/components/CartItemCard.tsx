@@ -1,6 +1,7 @@
 import { FiMinus, FiPlus, FiTrash2 } from "react-icons/fi";
 import type { CartItemDetail } from "../types/cart";
 import { useCart } from "../hooks/useCart";
+import { formatMoney } from "../utils/money";
 
 type CartItemCardProps = {
   item: CartItemDetail;
@@ -18,6 +19,9 @@ const CartItemCard = ({ item }: CartItemCardProps) => {
         <div className="cart-item__info">
           <p className="cart-item__brand">{item.sku}</p>
           <h3 className="cart-item__name">{item.name}</h3>
+          {!item.available && (
+            <p className="cart-item__unavailable">No longer available</p>
+          )}
         </div>
         <div className="cart-item__quantity-controls">
           <button
@@ -40,7 +44,9 @@ const CartItemCard = ({ item }: CartItemCardProps) => {
         </div>
       </div>
       <div className="cart-item__actions">
-        <p className="cart-item__price">${item.lineTotal.toFixed(2)}</p>
+        <p className="cart-item__price">
+          {formatMoney(item.lineTotal, item.currency)}
+        </p>
         <button
           className="cart-item__remove-button"
           onClick={() => removeItem(item.sku)}
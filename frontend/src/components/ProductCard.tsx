@@ -1,8 +1,7 @@
 import type { Product } from "../types/product";
 import { useCart } from "../hooks/useCart";
 import { FiPlus } from "react-icons/fi";
-import { useNavigate } from "react-router-dom";
-import { useAuthContext } from "../context/AuthContext";
+import { formatMoney } from "../utils/money";
 
 type ProductCardProps = {
   product: Product;
@@ -10,23 +9,19 @@ type ProductCardProps = {
 
 const ProductCard = ({ product }: ProductCardProps) => {
   const { addItem, isAddingItem } = useCart();
-  const { user } = useAuthContext();
-  const navigate = useNavigate();
 
   const handleAddToCart = () => {
-    if (user) {
-      addItem(product.sku);
-    } else {
-      navigate("/login");
-    }
+    addItem(product.sku);
   };
 
+  const primaryImage = product.images?.[0];
+
   return (
     <div className="product-card">
       <div className="product-card__image-container">
         <img
-          src="/images/placeholder.webp"
-          alt={product.name}
+          src={primaryImage?.thumbnails.medium ?? "/images/placeholder.webp"}
+          alt={primaryImage?.altText ?? product.name}
           className="product-card__image"
         />
       </div>
@@ -38,7 +33,14 @@ const ProductCard = ({ product }: ProductCardProps) => {
           <p className="product-card__description">{product.description}</p>
         </div>
         <div className="product-card__actions">
-          <p className="product-card__price">${product.price.toFixed(2)}</p>
+          <p className="product-card__price">
+            {product.onSale && (
+              <s className="product-card__price--regular">
+                {formatMoney(product.price, product.currency)}
+              </s>
+            )}
+            {formatMoney(product.effectivePrice, product.currency)}
+          </p>
           <button
             className="product-card__add-button"
             onClick={handleAddToCart}
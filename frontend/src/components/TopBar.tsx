@@ -17,8 +17,7 @@ const TopBar = () => {
 
   const profileRef = useRef<HTMLDivElement>(null);
 
-  const cartItemCount =
-    cart?.reduce((sum, item) => sum + item.quantity, 0) || 0;
+  const cartItemCount = cart?.itemCount || 0;
 
   const handleLogout = () => {
     logout();
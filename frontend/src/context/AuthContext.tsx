@@ -5,7 +5,8 @@ import {
   type ReactNode,
   useEffect,
 } from "react";
-import apiClient from "../api/client";
+import { useQueryClient } from "@tanstack/react-query";
+import apiClient, { CART_TOKEN_KEY } from "../api/client";
 import { jwtDecode } from "jwt-decode"; // Import the new library
 import type { User } from "../types/user";
 import type { AuthContextType } from "../types/auth";
@@ -16,6 +17,7 @@ export const AuthProvider = ({ children }: { children: ReactNode }) => {
   // The state now holds a User object or null
   const [user, setUser] = useState<User | null>(null);
   const [loading, setLoading] = useState<boolean>(true);
+  const queryClient = useQueryClient();
 
   // This effect runs only once on initial component mount
   useEffect(() => {
@@ -50,6 +52,7 @@ export const AuthProvider = ({ children }: { children: ReactNode }) => {
       setUser(decodedUser);
       // Set the default Authorization header for all future axios requests
       apiClient.defaults.headers.common["Authorization"] = `Bearer ${token}`;
+      mergeGuestCart();
     } catch (error) {
       console.error("Failed to decode token on login", error);
       // Ensure state is clean if decoding fails
@@ -57,6 +60,20 @@ export const AuthProvider = ({ children }: { children: ReactNode }) => {
     }
   };
 
+  // Move what the user put in the cart as a guest into their own cart
+  const mergeGuestCart = async () => {
+    const cartToken = localStorage.getItem(CART_TOKEN_KEY);
+    if (!cartToken) return;
+    try {
+      await apiClient.post("/cart/merge", { cartToken });
+      localStorage.removeItem(CART_TOKEN_KEY);
+    } catch (error) {
+      console.error("Failed to merge the guest cart", error);
+    } finally {
+      queryClient.invalidateQueries({ queryKey: ["cart"] });
+    }
+  };
+
   const logout = () => {
     // Clear user state
     setUser(null);
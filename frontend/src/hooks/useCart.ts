@@ -3,7 +3,7 @@ import { useNavigate } from "react-router-dom";
 import toast from "react-hot-toast"; // Import toast
 import apiClient from "../api/client";
 import { useAuthContext } from "../context/AuthContext";
-import type { CartItemDetail, CartItemRequest } from "../types/cart";
+import type { Cart, CartItemRequest } from "../types/cart";
 
 export const useCart = () => {
   const { user } = useAuthContext();
@@ -14,13 +14,13 @@ export const useCart = () => {
     data: cart,
     isLoading,
     error,
-  } = useQuery<CartItemDetail[]>({
+  } = useQuery<Cart>({
     queryKey: ["cart", user?.email],
-    queryFn: async (): Promise<CartItemDetail[]> => {
+    queryFn: async (): Promise<Cart> => {
       const response = await apiClient.get("/cart");
       return response.data;
     },
-    enabled: !!user,
+    // Guests have a cart too, kept by their cart token.
   });
 
   const addItemMutation = useMutation({
@@ -76,6 +76,7 @@ export const useCart = () => {
     mutationFn: () => {
       return apiClient.post("/checkout");
     },
+
     onSuccess: () => {
       queryClient.invalidateQueries({ queryKey: ["cart"] });
       toast.success("Checkout successful!");
@@ -94,7 +95,8 @@ export const useCart = () => {
     removeItem: removeItemMutation.mutate,
     updateItem: updateItemMutation.mutate,
     clearCart: clearCartMutation.mutate,
-    checkout: checkoutMutation.mutate,
+    // Guests sign in first; their cart is merged on login.
+    checkout: () => (user ? checkoutMutation.mutate() : navigate("/login")),
     isAddingItem: addItemMutation.isPending,
     isRemovingItem: removeItemMutation.isPending,
     isUpdatingItem: updateItemMutation.isPending,
@@ -1,12 +1,13 @@
 import { useCart } from "../hooks/useCart";
 import CartItemCard from "../components/CartItemCard";
+import { formatMoney } from "../utils/money";
 
 const CartPage = () => {
   const { cart, isLoading, clearCart, checkout, isCheckingOut } = useCart();
 
   if (isLoading) return <div>Loading Cart...</div>;
 
-  if (!cart || cart.length === 0) {
+  if (!cart || cart.items.length === 0) {
     return (
       <div className="cart-page-empty">
         <h2>Your Cart is Empty</h2>
@@ -15,13 +16,13 @@ const CartPage = () => {
     );
   }
 
-  const grandTotal = cart.reduce((total, item) => total + item.lineTotal, 0);
+  const { currency } = cart;
 
   return (
     <div className="cart-page">
       <div className="cart-items-column">
         <h1>Shopping Cart</h1>
-        {cart.map((item) => (
+        {cart.items.map((item) => (
           <CartItemCard key={item.sku} item={item} />
         ))}
         <div className="cart-footer-actions">
@@ -36,16 +37,24 @@ const CartPage = () => {
           <h2>Order Summary</h2>
           <div className="summary-row">
             <span>Subtotal</span>
-            <span>${grandTotal.toFixed(2)}</span>
+            <span>{formatMoney(cart.subtotal, currency)}</span>
+          </div>
+          <div className="summary-row">
+            <span>Estimated tax</span>
+            <span>{formatMoney(cart.estimatedTax, currency)}</span>
           </div>
           <div className="summary-row">
             <span>Shipping</span>
-            <span>Free</span>
+            <span>
+              {Number(cart.estimatedShipping) === 0
+                ? "Free"
+                : formatMoney(cart.estimatedShipping, currency)}
+            </span>
           </div>
           <div className="summary-divider"></div>
           <div className="summary-row total-row">
             <span>Total</span>
-            <span>${grandTotal.toFixed(2)}</span>
+            <span>{formatMoney(cart.total, currency)}</span>
           </div>
           <button
             onClick={() => checkout()}
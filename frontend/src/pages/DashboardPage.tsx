@@ -1,18 +1,12 @@
 import { useAuthContext } from "../context/AuthContext";
 import { useOrders } from "../hooks/useOrders";
+import { formatMoney, sumMoney } from "../utils/money";
 
 const DashboardPage = () => {
   const { user } = useAuthContext();
   const { orders, isLoading } = useOrders();
 
-  const lifetimeSpent =
-    orders?.reduce((total, order) => {
-      const orderTotal = order.items.reduce(
-        (orderSum, item) => orderSum + item.price * item.quantity,
-        0
-      );
-      return total + orderTotal;
-    }, 0) || 0;
+  const lifetimeSpent = sumMoney(orders?.map((order) => order.total) ?? []);
 
   if (isLoading) {
     return <div>Loading Dashboard...</div>;
@@ -33,7 +27,7 @@ const DashboardPage = () => {
           <span className="stat-label">Total Orders</span>
         </div>
         <div className="stat-card">
-          <span className="stat-value">${lifetimeSpent.toFixed(2)}</span>
+          <span className="stat-value">{formatMoney(lifetimeSpent)}</span>
           <span className="stat-label">Lifetime Spent</span>
         </div>
       </section>
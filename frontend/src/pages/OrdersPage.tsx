@@ -1,4 +1,5 @@
 import { useOrders } from "../hooks/useOrders";
+import { formatMoney } from "../utils/money";
 
 const OrdersPage = () => {
   const { orders, isLoading } = useOrders();
@@ -39,13 +40,7 @@ const OrdersPage = () => {
                         </span>
                       </td>
                       <td className="order-total">
-                        $
-                        {order.items
-                          .reduce(
-                            (sum, item) => sum + item.price * item.quantity,
-                            0
-                          )
-                          .toFixed(2)}
+                        {formatMoney(order.total, order.currency)}
                       </td>
                     </tr>
                   ))}
@@ -6,8 +6,25 @@ export interface CartItemDetail {
   quantity: number;
   name: string;
   sku: string;
-  price: number;
-  lineTotal: number;
+  // Amounts are exact decimal strings in the item's currency
+  price: string;
+  lineTotal: string;
+  currency: string;
+  // False once the product is back in draft, archived or deleted
+  available: boolean;
+}
+
+// The cart as returned by the cart-service API, with its totals. The totals
+// cover available items only; tax and shipping are estimates for the region.
+export interface Cart {
+  items: CartItemDetail[];
+  itemCount: number;
+  subtotal: string;
+  estimatedTax: string;
+  estimatedShipping: string;
+  total: string;
+  currency: string;
+  region: string;
 }
 
 // This type is still useful for *sending* data to the backend
@@ -15,3 +32,18 @@ export interface CartItemRequest {
   productSku: string;
   quantity: number;
 }
+
+// The body of a 422 response when an item can't be added or updated
+export interface CartItemError {
+  error:
+    | "unknown_sku"
+    | "unavailable"
+    | "insufficient_stock"
+    | "item_limit_exceeded"
+    | "cart_limit_exceeded";
+  message: string;
+  sku: string;
+  requested: number;
+  // How many can be in the cart, when known
+  available?: number;
+}
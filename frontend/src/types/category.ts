@@ -0,0 +1,6 @@
+// One step of the path from the root category to a product
+export interface Breadcrumb {
+  id: string;
+  name: string;
+  slug: string;
+}
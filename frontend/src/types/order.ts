@@ -1,10 +1,35 @@
 import type { CartItemDetail } from "./cart";
+import type { BundleComponent } from "./product";
 
 // Defines the final order object saved to the database
 export interface Order {
   id: string;
   userEmail: string;
   items: CartItemDetail[];
+  // Zero on orders placed before tax and shipping were charged
+  subtotal: string;
+  tax: string;
+  shipping: string;
+  total: string;
+  currency: string;
   status: string;
   createdAt: string;
+  // Where each line ships from; absent on orders placed before warehouses existed
+  allocation?: AllocationLine[];
+  // The components each bundle line ships as
+  bundles?: BundleExpansion[];
+}
+
+export interface BundleExpansion {
+  sku: string;
+  quantity: number;
+  components: BundleComponent[];
+}
+
+// The part of an order line shipped from one warehouse
+export interface AllocationLine {
+  sku: string;
+  warehouse: string;
+  quantity: number;
+  tracked: boolean;
 }
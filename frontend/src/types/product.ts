@@ -1,10 +1,79 @@
+import type { Breadcrumb } from "./category";
+
+// An uploaded product image with its generated thumbnails
+export interface ProductImage {
+  id: string;
+  url: string;
+  altText: string;
+  position: number;
+  thumbnails: Record<string, string>;
+}
+
 // Defines a single product from the catalog
 export interface Product {
   id: string;
   name: string;
   description: string;
-  price: number;
+  // Amounts are exact decimal strings in the product's currency
+  price: string;
+  currency: string;
+  salePrice?: string;
+  saleStartsAt?: string;
+  saleEndsAt?: string;
+  // Explicit prices in other currencies, keyed by currency code
+  prices?: Record<string, string>;
+  // The price to pay right now: the sale price while a sale is running
+  effectivePrice: string;
+  onSale: boolean;
   sku: string;
+  // Readable URL name, unique across products
+  slug: string;
   brand: string;
   category: string;
+  categoryId?: string;
+  // Only present on product detail
+  breadcrumbs?: Breadcrumb[];
+  // Typed specifications, keyed by attribute key
+  attributes?: Record<string, string | number | boolean>;
+  images?: ProductImage[] | null;
+  // Summary of the approved reviews
+  averageRating: number;
+  reviewCount: number;
+  // Present on bundles: the products they contain, sold at the bundle's price
+  components?: BundleComponent[];
+  // Stock across all warehouses (for a bundle, how many can be put together);
+  // absent when the product's stock isn't tracked
+  stockQuantity?: number;
+  inStock: boolean;
+  version: number;
+  status: "draft" | "active" | "archived" | "deleted";
+  // An active product is only public between these (either may be open-ended)
+  publishAt?: string;
+  unpublishAt?: string;
+}
+
+export interface BundleComponent {
+  sku: string;
+  quantity: number;
+}
+
+// A recommendation, with how many orders contained both products
+export interface RelatedProduct extends Product {
+  coPurchaseCount: number;
+}
+
+// One autocomplete entry; count is the number of products of a brand or category
+export interface Suggestion {
+  text: string;
+  sku?: string;
+  slug?: string;
+  count?: number;
+}
+
+// Autocomplete results for the search box, grouped by kind
+export interface SuggestResponse {
+  query: string;
+  products: Suggestion[];
+  brands: Suggestion[];
+  categories: Suggestion[];
 }
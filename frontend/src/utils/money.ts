@@ -0,0 +1,15 @@
+// Amounts come from the API as exact decimal strings (e.g. "2499.99").
+// Sum them in minor units so the UI never accumulates float rounding errors.
+
+const toMinorUnits = (amount: string): number =>
+  Math.round(Number(amount) * 100);
+
+export const sumMoney = (amounts: string[]): string => {
+  const total = amounts.reduce((sum, amount) => sum + toMinorUnits(amount), 0);
+  return (total / 100).toFixed(2);
+};
+
+export const formatMoney = (amount: string, currency = "USD"): string =>
+  new Intl.NumberFormat(undefined, { style: "currency", currency }).format(
+    Number(amount)
+  );
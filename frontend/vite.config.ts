@@ -12,6 +12,57 @@ export default defineConfig({
         changeOrigin: true,
       },
 
+      "/api/admin/products": {
+        target: "http://catalog-service:8082",
+        changeOrigin: true,
+      },
+
+      "/api/reviews": {
+        target: "http://catalog-service:8082",
+        changeOrigin: true,
+      },
+
+      "/api/admin/reviews": {
+        target: "http://catalog-service:8082",
+        changeOrigin: true,
+      },
+
+      "/api/admin/co-purchases": {
+        target: "http://catalog-service:8082",
+        changeOrigin: true,
+      },
+
+      "/api/admin/inventory": {
+        target: "http://catalog-service:8082",
+        changeOrigin: true,
+      },
+
+      "/api/admin/catalog-health": {
+        target: "http://catalog-service:8082",
+        changeOrigin: true,
+      },
+
+      "/api/inventory": {
+        target: "http://catalog-service:8082",
+        changeOrigin: true,
+      },
+
+      "/api/categories": {
+        target: "http://catalog-service:8082",
+        changeOrigin: true,
+      },
+
+      "/api/exchange-rates": {
+        target: "http://catalog-service:8082",
+        changeOrigin: true,
+      },
+
+      // Product images uploaded in development are served by the catalog-service.
+      "/media": {
+        target: "http://catalog-service:8082",
+        changeOrigin: true,
+      },
+
       "/api/cart": {
         target: "http://cart-service:8083",
         changeOrigin: true,
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// cartTokenHeader carries the token of a guest cart, both ways: a guest
+// without one is given a new token in the response to its first write.
+const cartTokenHeader = "X-Cart-Token"
+
+// guestCartPrefix starts the Redis key of every guest cart. Guest carts
+// expire guestCartTTL after their last change (GUEST_CART_TTL).
+const (
+	guestCartPrefix     = "cart:guest:"
+	defaultGuestCartTTL = 30 * 24 * time.Hour
+)
+
+// Conflict rules for a SKU in both carts when a guest cart is merged into a
+// user's cart.
+const (
+	MergeSum      = "sum"       // add the quantities up
+	MergeMax      = "max"       // keep the larger quantity
+	MergeKeepUser = "keep-user" // keep the user's quantity
+)
+
+// errInvalidCartToken is returned for a cart token that wasn't issued here.
+var errInvalidCartToken = errors.New("invalid cart token")
+
+// CartKeyKey holds the Redis key of the request's cart, a user's or a guest's.
+const CartKeyKey ContextKey = "cartKey"
+
+// cartTokens issues and verifies guest cart tokens. A token is a random cart
+// ID and an HMAC of it, so guests can't pick another cart's ID.
+type cartTokens struct {
+	secret []byte
+}
+
+func (t cartTokens) issue() (id, token string, err error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	id = hex.EncodeToString(raw)
+	return id, id + "." + t.sign(id), nil
+}
+
+func (t cartTokens) verify(token string) (string, error) {
+	id, signature, ok := strings.Cut(token, ".")
+	if !ok || id == "" || !hmac.Equal([]byte(signature), []byte(t.sign(id))) {
+		return "", errInvalidCartToken
+	}
+	return id, nil
+}
+
+func (t cartTokens) sign(id string) string {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte("guest-cart:" + id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// loadGuestCarts reads the secret guest cart tokens are signed with and how
+// long guest carts are kept. CART_TOKEN_SECRET is required and must not be
+// the JWT secret, so a leaked cart key can't sign logins.
+func loadGuestCarts() (cartTokens, time.Duration, string, error) {
+	secret := os.Getenv("CART_TOKEN_SECRET")
+	if secret == "" {
+		return cartTokens{}, 0, "", errors.New("CART_TOKEN_SECRET must be set")
+	}
+	if secret == os.Getenv("JWT_SECRET") {
+		return cartTokens{}, 0, "", errors.New("CART_TOKEN_SECRET must differ from JWT_SECRET")
+	}
+	ttl := defaultGuestCartTTL
+	if value := os.Getenv("GUEST_CART_TTL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return cartTokens{}, 0, "", fmt.Errorf("invalid GUEST_CART_TTL %q", value)
+		}
+		ttl = parsed
+	}
+	strategy := os.Getenv("CART_MERGE_STRATEGY")
+	if strategy == "" {
+		strategy = MergeSum
+	}
+	if !validMergeStrategy(strategy) {
+		return cartTokens{}, 0, "", fmt.Errorf("invalid CART_MERGE_STRATEGY %q", strategy)
+	}
+	return cartTokens{secret: []byte(secret)}, ttl, strategy, nil
+}
+
+func validMergeStrategy(strategy string) bool {
+	return strategy == MergeSum || strategy == MergeMax || strategy == MergeKeepUser
+}
+
+func userCartKey(email string) string { return "cart:" + email }
+
+func guestCartKey(id string) string { return guestCartPrefix + id }
+
+// cartOwnerMiddleware finds the cart a request works on. A request with an
+// Authorization header uses the user's cart and must carry a valid JWT. Any
+// other request uses the guest cart of its cart token. A guest without a
+// token reads and clears an empty cart, and is only given a new token, in the
+// X-Cart-Token response header, when it adds to its cart; so loading a page
+// doesn't start a cart.
+func (env *Env) cartOwnerMiddleware(next http.Handler) http.Handler {
+	userCart := jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email := r.Context().Value(UserEmailKey).(string)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), CartKeyKey, userCartKey(email))))
+	}))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			userCart.ServeHTTP(w, r)
+			return
+		}
+
+		var id string
+		if token := r.Header.Get(cartTokenHeader); token != "" {
+			var err error
+			if id, err = env.cartTokens.verify(token); err != nil {
+				http.Error(w, "Invalid cart token", http.StatusUnauthorized)
+				return
+			}
+		} else if r.Method == http.MethodGet || r.Method == http.MethodDelete {
+			// Nothing is ever written to the cart without an ID.
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), CartKeyKey, guestCartKey(""))))
+			return
+		} else {
+			var token string
+			var err error
+			if id, token, err = env.cartTokens.issue(); err != nil {
+				log.Printf("Failed to issue a cart token: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set(cartTokenHeader, token)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), CartKeyKey, guestCartKey(id))))
+	})
+}
+
+// expireGuestCart keeps a guest cart for guestCartTTL after this change.
+// User carts don't expire.
+func (env *Env) expireGuestCart(ctx context.Context, pipe redis.Pipeliner, cartKey string) {
+	if strings.HasPrefix(cartKey, guestCartPrefix) {
+		pipe.Expire(ctx, cartKey, env.guestCartTTL)
+	}
+}
+
+// MergeRequest is the body of POST /api/cart/merge. Strategy defaults to
+// CART_MERGE_STRATEGY.
+type MergeRequest struct {
+	CartToken string `json:"cartToken"`
+	Strategy  string `json:"strategy"`
+}
+
+// MergeResult reports a merge. Limited lists the SKUs whose merged quantity
+// was cut to fit the item or cart limit.
+type MergeResult struct {
+	Strategy string   `json:"strategy"`
+	Merged   int      `json:"merged"`
+	Limited  []string `json:"limited"`
+}
+
+// mergeCartHandler moves a guest cart into the signed-in user's cart and
+// deletes it (POST /api/cart/merge). The frontend calls it after login.
+func (env *Env) mergeCartHandler(w http.ResponseWriter, r *http.Request) {
+	userEmail := r.Context().Value(UserEmailKey).(string)
+
+	var req MergeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Strategy == "" {
+		req.Strategy = env.mergeStrategy
+	}
+	if !validMergeStrategy(req.Strategy) {
+		http.Error(w, fmt.Sprintf("strategy must be %s, %s or %s", MergeSum, MergeMax, MergeKeepUser), http.StatusBadRequest)
+		return
+	}
+	id, err := env.cartTokens.verify(req.CartToken)
+	if err != nil {
+		http.Error(w, "Invalid cart token", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := env.mergeCarts(ctx, guestCartKey(id), userCartKey(userEmail), req.Strategy)
+	if err != nil {
+		log.Printf("Failed to merge guest cart into the cart of %s: %v", userEmail, err)
+		writeCartUpdateError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// mergeCarts adds the guest cart to the user cart, resolving SKUs in both
+// with strategy, and deletes the guest cart. Merged quantities are cut to the
+// item and cart limits; stock is checked again at checkout.
+func (env *Env) mergeCarts(ctx context.Context, guestKey, userKey, strategy string) (*MergeResult, error) {
+	var result *MergeResult
+	merge := func(tx *redis.Tx) error {
+		guest, err := tx.HGetAll(ctx, guestKey).Result()
+		if err != nil {
+			return err
+		}
+		user, err := tx.HGetAll(ctx, userKey).Result()
+		if err != nil {
+			return err
+		}
+
+		merged, limited := mergeQuantities(guest, user, strategy, env.maxItemQuantity, env.maxCartQuantity)
+		result = &MergeResult{Strategy: strategy, Merged: len(merged), Limited: limited}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for sku, quantity := range merged {
+				pipe.HSet(ctx, userKey, sku, quantity)
+			}
+			pipe.Del(ctx, guestKey)
+			return nil
+		})
+		return err
+	}
+
+	for attempt := 0; attempt < cartUpdateAttempts; attempt++ {
+		err := env.rdb.Watch(ctx, merge, guestKey, userKey)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return result, err
+		}
+	}
+	return nil, errCartBusy
+}
+
+// mergeQuantities returns the new quantity of every guest SKU in the user
+// cart, and the SKUs that were cut to fit perItem or perCart. Guest SKUs are
+// merged in order, so which ones are cut doesn't depend on map order.
+func mergeQuantities(guest, user map[string]string, strategy string, perItem, perCart int) (map[string]int, []string) {
+	total := 0
+	for _, value := range user {
+		n, _ := strconv.Atoi(value)
+		total += n
+	}
+	skus := make([]string, 0, len(guest))
+	for sku := range guest {
+		skus = append(skus, sku)
+	}
+	sort.Strings(skus)
+
+	merged := make(map[string]int, len(skus))
+	limited := []string{}
+	for _, sku := range skus {
+		guestQuantity, _ := strconv.Atoi(guest[sku])
+		userQuantity, _ := strconv.Atoi(user[sku])
+		quantity := guestQuantity
+		if _, inUser := user[sku]; inUser {
+			switch strategy {
+			case MergeSum:
+				quantity = userQuantity + guestQuantity
+			case MergeMax:
+				quantity = max(userQuantity, guestQuantity)
+			case MergeKeepUser:
+				quantity = userQuantity
+			}
+		}
+		wanted := quantity
+		quantity = min(quantity, perItem, userQuantity+perCart-total)
+		if quantity < wanted && wanted > userQuantity {
+			limited = append(limited, sku)
+		}
+		if quantity <= userQuantity {
+			continue
+		}
+		merged[sku] = quantity
+		total += quantity - userQuantity
+	}
+	return merged, limited
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeQuantities(t *testing.T) {
+	tests := []struct {
+		name        string
+		guest, user map[string]string
+		strategy    string
+		perItem     int
+		perCart     int
+		want        map[string]int
+		wantLimited []string
+	}{
+		{
+			name:     "new SKUs are copied",
+			guest:    map[string]string{"A": "2", "B": "1"},
+			user:     map[string]string{"C": "1"},
+			strategy: MergeSum,
+			perItem:  10,
+			perCart:  50,
+			want:     map[string]int{"A": 2, "B": 1},
+		},
+		{
+			name:     "sum",
+			guest:    map[string]string{"A": "2"},
+			user:     map[string]string{"A": "3"},
+			strategy: MergeSum,
+			perItem:  10,
+			perCart:  50,
+			want:     map[string]int{"A": 5},
+		},
+		{
+			name:     "max keeps the larger guest quantity",
+			guest:    map[string]string{"A": "4"},
+			user:     map[string]string{"A": "3"},
+			strategy: MergeMax,
+			perItem:  10,
+			perCart:  50,
+			want:     map[string]int{"A": 4},
+		},
+		{
+			name:     "max leaves a larger user quantity alone",
+			guest:    map[string]string{"A": "2"},
+			user:     map[string]string{"A": "3"},
+			strategy: MergeMax,
+			perItem:  10,
+			perCart:  50,
+			want:     map[string]int{},
+		},
+		{
+			name:     "keep-user only adds new SKUs",
+			guest:    map[string]string{"A": "5", "B": "1"},
+			user:     map[string]string{"A": "3"},
+			strategy: MergeKeepUser,
+			perItem:  10,
+			perCart:  50,
+			want:     map[string]int{"B": 1},
+		},
+		{
+			name:        "sum capped per item",
+			guest:       map[string]string{"A": "8"},
+			user:        map[string]string{"A": "5"},
+			strategy:    MergeSum,
+			perItem:     10,
+			perCart:     50,
+			want:        map[string]int{"A": 10},
+			wantLimited: []string{"A"},
+		},
+		{
+			name:        "cart limit cuts SKUs in order",
+			guest:       map[string]string{"C": "3", "A": "3", "B": "3"},
+			user:        map[string]string{"X": "4"},
+			strategy:    MergeSum,
+			perItem:     10,
+			perCart:     9,
+			want:        map[string]int{"A": 3, "B": 2},
+			wantLimited: []string{"B", "C"},
+		},
+		{
+			name:        "full cart takes nothing",
+			guest:       map[string]string{"A": "1"},
+			user:        map[string]string{"X": "5"},
+			strategy:    MergeSum,
+			perItem:     10,
+			perCart:     5,
+			want:        map[string]int{},
+			wantLimited: []string{"A"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, limited := mergeQuantities(tt.guest, tt.user, tt.strategy, tt.perItem, tt.perCart)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("merged = %v, want %v", got, tt.want)
+			}
+			if tt.wantLimited == nil {
+				tt.wantLimited = []string{}
+			}
+			if !reflect.DeepEqual(limited, tt.wantLimited) {
+				t.Errorf("limited = %v, want %v", limited, tt.wantLimited)
+			}
+		})
+	}
+}
@@ -4,22 +4,29 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// errUnsupportedCurrency is returned when the catalog can't price products in
+// the requested currency.
+var errUnsupportedCurrency = errors.New("currency is not supported")
+
 func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
     w.WriteHeader(http.StatusOK)
     w.Write([]byte("{\"status\":\"ok\"}"))
 }
 
 func (env *Env) getCartHandler(w http.ResponseWriter, r *http.Request) {
-	userEmail := r.Context().Value(UserEmailKey).(string)
-	cartKey := "cart:" + userEmail
+	cartKey := r.Context().Value(CartKeyKey).(string)
 
 	// 1. Get basic cart data (SKU -> quantity) from Redis
 	cartItemsMap, err := env.rdb.HGetAll(context.Background(), cartKey).Result()
@@ -29,9 +36,19 @@ func (env *Env) getCartHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Tax and shipping are estimated for the shopper's region (?region=DE).
+	regionCode := strings.ToUpper(r.URL.Query().Get("region"))
+	if regionCode == "" {
+		regionCode = env.defaultRegion
+	}
+	region, ok := env.regions[regionCode]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown region %s, expected one of: %s", regionCode, env.regionCodes()), http.StatusBadRequest)
+		return
+	}
+
 	if len(cartItemsMap) == 0 {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte("[]"))
+		env.writeCart(w, []CartItemDetail{}, r.URL.Query().Get("currency"), regionCode, region)
 		return
 	}
 
@@ -42,8 +59,13 @@ func (env *Env) getCartHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	sort.Strings(skusToFetch) // Sort for a predictable order
 
-	// 3. Make a SINGLE batch API call to the catalog-service
-	products, err := env.getProductDetailsBatch(skusToFetch)
+	// 3. Make a SINGLE batch API call to the catalog-service, priced in the
+	// storefront's currency if one was requested.
+	products, err := env.getProductDetailsBatch(skusToFetch, r.URL.Query().Get("currency"))
+	if errors.Is(err, errUnsupportedCurrency) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -67,27 +89,57 @@ func (env *Env) getCartHandler(w http.ResponseWriter, r *http.Request) {
 				Quantity:  quantity,
 				Name:      product.Name,
 				SKU:       product.SKU,
-				Price:     product.Price,
-				LineTotal: product.Price * float64(quantity),
+				Price:     product.EffectivePrice,
+				LineTotal: product.EffectivePrice.Mul(quantity),
+				Currency:  product.EffectivePrice.Currency,
+				Available: product.Available,
 			})
 		} else {
 			log.Printf("Orphaned cart item: SKU %s found in cart but not in catalog.", sku)
 		}
 	}
 
+	env.writeCart(w, detailedItems, r.URL.Query().Get("currency"), regionCode, region)
+}
+
+// writeCart responds with the items and their totals.
+func (env *Env) writeCart(w http.ResponseWriter, items []CartItemDetail, currency, regionCode string, region Region) {
+	cart, err := cartTotals(items, currency, region)
+	if errors.Is(err, errNoShippingRate) {
+		http.Error(w, fmt.Sprintf("Region %s can't ship this cart: %v", regionCode, err), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		// Products priced in different currencies can only be added up once
+		// the catalog converts them (?currency=).
+		log.Printf("Failed to total cart: %v", err)
+		http.Error(w, "Cart can't be totaled: "+err.Error(), http.StatusConflict)
+		return
+	}
+	cart.Region = regionCode
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(detailedItems)
+	json.NewEncoder(w).Encode(cart)
 }
 
-func (env *Env) getProductDetailsBatch(skus []string) ([]Product, error) {
+func (env *Env) getProductDetailsBatch(skus []string, currency string) ([]Product, error) {
     // Read the catalog service URL from an environment variable.
     // This decouples the code from the environment.
-    log.Printf("Attempting to use httpClient. Is it nil? %v", env.httpClient == nil)
 	catalogServiceURL := os.Getenv("CATALOG_SERVICE_URL")
     if catalogServiceURL == "" {
         // Provide a local default for development.
         catalogServiceURL = "http://localhost:8082/api/products/batch-get"
     }
+    if currency != "" {
+        u, err := url.Parse(catalogServiceURL)
+        if err != nil {
+            return nil, fmt.Errorf("invalid CATALOG_SERVICE_URL: %w", err)
+        }
+        q := u.Query()
+        q.Set("currency", currency)
+        u.RawQuery = q.Encode()
+        catalogServiceURL = u.String()
+    }
 
     requestBody, err := json.Marshal(map[string][]string{"skus": skus})
     if err != nil {
@@ -106,6 +158,9 @@ func (env *Env) getProductDetailsBatch(skus []string) ([]Product, error) {
     }
     defer resp.Body.Close()
 
+    if resp.StatusCode == http.StatusBadRequest && currency != "" {
+        return nil, fmt.Errorf("%w: %s", errUnsupportedCurrency, currency)
+    }
     if resp.StatusCode != http.StatusOK {
         return nil, fmt.Errorf("catalog-service returned non-200 status: %d", resp.StatusCode)
     }
@@ -114,14 +169,23 @@ func (env *Env) getProductDetailsBatch(skus []string) ([]Product, error) {
     if err := json.NewDecoder(resp.Body).Decode(&products); err != nil {
         return nil, fmt.Errorf("failed to decode product details: %w", err)
     }
+    // Amounts in JSON don't carry their currency; it comes with the product.
+    for i := range products {
+        var err error
+        if products[i].Price, err = products[i].Price.In(products[i].Currency); err != nil {
+            return nil, fmt.Errorf("invalid price of %s: %w", products[i].SKU, err)
+        }
+        if products[i].EffectivePrice, err = products[i].EffectivePrice.In(products[i].Currency); err != nil {
+            return nil, fmt.Errorf("invalid price of %s: %w", products[i].SKU, err)
+        }
+    }
 
     return products, nil
 }
 
 // addItemHandler now uses the specific request struct
 func (env *Env) addItemHandler(w http.ResponseWriter, r *http.Request) {
-	userEmail := r.Context().Value(UserEmailKey).(string)
-	cartKey := "cart:" + userEmail
+	cartKey := r.Context().Value(CartKeyKey).(string)
 
 	var item AddItemRequest // Use the new request struct
 	if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
@@ -133,9 +197,15 @@ func (env *Env) addItemHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := env.rdb.HIncrBy(context.Background(), cartKey, item.ProductSKU, int64(item.Quantity)).Err()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The product must exist and be in stock for the combined quantity.
+	err := env.setItemQuantity(ctx, cartKey, item.ProductSKU, func(current int) int {
+		return current + item.Quantity
+	})
 	if err != nil {
-		http.Error(w, "Failed to update cart", http.StatusInternalServerError)
+		writeCartUpdateError(w, err)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -143,14 +213,13 @@ func (env *Env) addItemHandler(w http.ResponseWriter, r *http.Request) {
 // removeItemHandler removes a specific item completely from the cart.
 // Endpoint: DELETE /api/cart/items/{productId}
 func (env *Env) removeItemHandler(w http.ResponseWriter, r *http.Request) {
-	userEmail := r.Context().Value(UserEmailKey).(string)
-	cartKey := "cart:" + userEmail
+	cartKey := r.Context().Value(CartKeyKey).(string)
 	productSKU := r.PathValue("productSku") // Get productID from URL
 
 	// HDel removes the specified fields from the hash stored at key.
 	err := env.rdb.HDel(context.Background(), cartKey, productSKU).Err()
 	if err != nil {
-		log.Printf("Failed to remove item from cart for user %s: %v", userEmail, err)
+		log.Printf("Failed to remove item from %s: %v", cartKey, err)
 		http.Error(w, "Failed to update cart", http.StatusInternalServerError)
 		return
 	}
@@ -161,8 +230,7 @@ func (env *Env) removeItemHandler(w http.ResponseWriter, r *http.Request) {
 // updateItemHandler sets the quantity for a specific item.
 // Endpoint: PUT /api/cart/items/{productId}
 func (env *Env) updateItemHandler(w http.ResponseWriter, r *http.Request) {
-	userEmail := r.Context().Value(UserEmailKey).(string)
-	cartKey := "cart:" + userEmail
+	cartKey := r.Context().Value(CartKeyKey).(string)
 	productSKU := r.PathValue("productSku")
 
 	var item UpdateItemRequest
@@ -175,11 +243,14 @@ func (env *Env) updateItemHandler(w http.ResponseWriter, r *http.Request) {
 		// If quantity is zero or less, remove the item instead.
 		env.rdb.HDel(context.Background(), cartKey, productSKU)
 	} else {
-		// HSet sets the specified fields to their respective values in the hash stored at key.
-		err := env.rdb.HSet(context.Background(), cartKey, productSKU, item.Quantity).Err()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		// The new quantity is validated against the catalog and the limits.
+		err := env.setItemQuantity(ctx, cartKey, productSKU, func(int) int { return item.Quantity })
 		if err != nil {
-			log.Printf("Failed to update item in cart for user %s: %v", userEmail, err)
-			http.Error(w, "Failed to update cart", http.StatusInternalServerError)
+			log.Printf("Failed to update item in %s: %v", cartKey, err)
+			writeCartUpdateError(w, err)
 			return
 		}
 	}
@@ -191,13 +262,12 @@ func (env *Env) updateItemHandler(w http.ResponseWriter, r *http.Request) {
 // clearCartHandler deletes all items from a user's cart.
 // Endpoint: DELETE /api/cart
 func (env *Env) clearCartHandler(w http.ResponseWriter, r *http.Request) {
-	userEmail := r.Context().Value(UserEmailKey).(string)
-	cartKey := "cart:" + userEmail
+	cartKey := r.Context().Value(CartKeyKey).(string)
 
 	// DEL deletes the entire key (the user's cart hash).
 	err := env.rdb.Del(context.Background(), cartKey).Err()
 	if err != nil {
-		log.Printf("Failed to clear cart for user %s: %v", userEmail, err)
+		log.Printf("Failed to clear %s: %v", cartKey, err)
 		http.Error(w, "Failed to update cart", http.StatusInternalServerError)
 		return
 	}
@@ -30,20 +30,42 @@ func main() {
 		Timeout: 5 * time.Second,
 	}
 
+	regions, defaultRegion, err := loadRegions()
+	if err != nil {
+		log.Fatalf("Could not load tax and shipping regions: %v", err)
+	}
+	maxItemQuantity, maxCartQuantity, err := loadQuantityLimits()
+	if err != nil {
+		log.Fatalf("Could not load cart limits: %v", err)
+	}
+	tokens, guestCartTTL, mergeStrategy, err := loadGuestCarts()
+	if err != nil {
+		log.Fatalf("Could not configure guest carts: %v", err)
+	}
+
 	// Inject both dependencies into the Env struct.
 	env := &Env{
-		rdb:        rdb,
-		httpClient: httpClient,
+		rdb:             rdb,
+		httpClient:      httpClient,
+		regions:         regions,
+		defaultRegion:   defaultRegion,
+		maxItemQuantity: maxItemQuantity,
+		maxCartQuantity: maxCartQuantity,
+		cartTokens:      tokens,
+		guestCartTTL:    guestCartTTL,
+		mergeStrategy:   mergeStrategy,
 	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /healthz", healthCheckHandler)
-	// Routes remain the same, but the getCartHandler will now be much smarter.
-	mux.Handle("GET /api/cart", jwtMiddleware(http.HandlerFunc(env.getCartHandler)))
-	mux.Handle("POST /api/cart/items", jwtMiddleware(http.HandlerFunc(env.addItemHandler)))
-	mux.Handle("PUT /api/cart/items/{productSku}", jwtMiddleware(http.HandlerFunc(env.updateItemHandler)))
-	mux.Handle("DELETE /api/cart/items/{productSku}", jwtMiddleware(http.HandlerFunc(env.removeItemHandler)))
-	mux.Handle("DELETE /api/cart", jwtMiddleware(http.HandlerFunc(env.clearCartHandler)))
+	// Signed-in users work on their own cart; guests on the cart of their
+	// X-Cart-Token, which they merge into their own cart after logging in.
+	mux.Handle("GET /api/cart", env.cartOwnerMiddleware(http.HandlerFunc(env.getCartHandler)))
+	mux.Handle("POST /api/cart/items", env.cartOwnerMiddleware(http.HandlerFunc(env.addItemHandler)))
+	mux.Handle("PUT /api/cart/items/{productSku}", env.cartOwnerMiddleware(http.HandlerFunc(env.updateItemHandler)))
+	mux.Handle("DELETE /api/cart/items/{productSku}", env.cartOwnerMiddleware(http.HandlerFunc(env.removeItemHandler)))
+	mux.Handle("DELETE /api/cart", env.cartOwnerMiddleware(http.HandlerFunc(env.clearCartHandler)))
+	mux.Handle("POST /api/cart/merge", jwtMiddleware(http.HandlerFunc(env.mergeCartHandler)))
 
 	log.Println("Cart service starting on port 8083...")
 	if err := http.ListenAndServe(":8083", mux); err != nil {
@@ -2,24 +2,46 @@ package main
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/redis/go-redis/v9"
+
+	"three-tier-cloud-shop/money"
 )
 
 // Env now includes an httpClient for service-to-service communication.
+// regions maps region codes to the calculators used for cart totals.
 type Env struct {
-	rdb        *redis.Client
-	httpClient *http.Client
+	rdb           *redis.Client
+	httpClient    *http.Client
+	regions       map[string]Region
+	defaultRegion string
+	// maxItemQuantity and maxCartQuantity cap one SKU and the whole cart.
+	maxItemQuantity int
+	maxCartQuantity int
+	// cartTokens signs guest carts, which expire after guestCartTTL.
+	// mergeStrategy is the default conflict rule when one is merged on login.
+	cartTokens    cartTokens
+	guestCartTTL  time.Duration
+	mergeStrategy string
 }
 
 // Product defines the structure of data we expect from the catalog-service.
 type Product struct {
 	ID    		string  `json:"id"`
 	Name  		string  `json:"name"`
-	Price 		float64 `json:"price"`
+	Price 		money.Money `json:"price"`
+	// EffectivePrice is the price to charge right now, including running sales.
+	EffectivePrice money.Money `json:"effectivePrice"`
+	Currency	string  `json:"currency"`
 	SKU   		string  `json:"sku"`
 	Brand		string  `json:"brand"`
     Category	string  `json:"category"`
+	// Available is false for draft, archived or deleted products.
+	Available	bool    `json:"available"`
+	// StockQuantity is how many are in stock; nil when stock isn't tracked.
+	StockQuantity *int64 `json:"stockQuantity"`
+	InStock       bool   `json:"inStock"`
 }
 
 // AddItemRequest is the expected body when adding an item to the cart.
@@ -38,8 +60,10 @@ type CartItemDetail struct {
 	Quantity    int     `json:"quantity"`
 	Name        string  `json:"name"`
 	SKU       	string  `json:"sku"`
-	Price       float64 `json:"price"`
-	LineTotal   float64 `json:"lineTotal"`
+	Price       money.Money `json:"price"`
+	LineTotal   money.Money `json:"lineTotal"`
+	Currency    string  `json:"currency"`
+	Available   bool    `json:"available"`
 }
 
 // (The contextKey definitions remain the same)
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"three-tier-cloud-shop/money"
+)
+
+// defaultRegion is used when DEFAULT_REGION is not set.
+const defaultRegion = "US"
+
+// TaxCalculator estimates the tax on a cart subtotal.
+type TaxCalculator interface {
+	EstimateTax(subtotal money.Money) (money.Money, error)
+}
+
+// ShippingCalculator estimates the cost of shipping a cart.
+type ShippingCalculator interface {
+	EstimateShipping(subtotal money.Money, itemCount int) (money.Money, error)
+}
+
+// Region holds the calculators used for carts shipped to one region.
+type Region struct {
+	Tax      TaxCalculator
+	Shipping ShippingCalculator
+}
+
+// CartResponse is the cart as returned to the frontend and checkout-service.
+// The totals only cover available items, since archived and deleted products
+// can't be bought. Tax and shipping are estimates for Region.
+type CartResponse struct {
+	Items             []CartItemDetail `json:"items"`
+	ItemCount         int              `json:"itemCount"`
+	Subtotal          money.Money      `json:"subtotal"`
+	EstimatedTax      money.Money      `json:"estimatedTax"`
+	EstimatedShipping money.Money      `json:"estimatedShipping"`
+	Total             money.Money      `json:"total"`
+	Currency          string           `json:"currency"`
+	Region            string           `json:"region"`
+}
+
+// percentageTax charges a flat rate, in basis points, rounded half up to the
+// currency's minor unit.
+type percentageTax struct {
+	basisPoints int64
+}
+
+func (t percentageTax) EstimateTax(subtotal money.Money) (money.Money, error) {
+	return money.Money{Amount: (subtotal.Amount*t.basisPoints + 5000) / 10000, Currency: subtotal.Currency}, nil
+}
+
+// errNoShippingRate is returned for a cart in a currency its region has no
+// shipping rate for.
+var errNoShippingRate = errors.New("no shipping rate for this currency")
+
+// shippingRate is the fee of one region in one currency, waived once the
+// subtotal reaches freeOver; a nil freeOver never waives it.
+type shippingRate struct {
+	fee      money.Money
+	freeOver *money.Money
+}
+
+// flatRateShipping charges one fee per cart, in the cart's currency. A region
+// without rates ships for free; a cart in a currency the region has no rate
+// for can't be shipped there.
+type flatRateShipping struct {
+	rates map[string]shippingRate
+}
+
+func (s flatRateShipping) EstimateShipping(subtotal money.Money, itemCount int) (money.Money, error) {
+	free := money.Money{Currency: subtotal.Currency}
+	if len(s.rates) == 0 {
+		return free, nil
+	}
+	rate, ok := s.rates[subtotal.Currency]
+	if !ok {
+		return money.Money{}, fmt.Errorf("%w: %s", errNoShippingRate, subtotal.Currency)
+	}
+	if itemCount == 0 || (rate.freeOver != nil && subtotal.Cmp(*rate.freeOver) >= 0) {
+		return free, nil
+	}
+	return rate.fee, nil
+}
+
+// cartTotals adds up the available items and estimates tax and shipping for
+// region.
+func cartTotals(items []CartItemDetail, currency string, region Region) (CartResponse, error) {
+	cart := CartResponse{Items: items}
+	for _, item := range items {
+		if !item.Available {
+			continue
+		}
+		subtotal, err := cart.Subtotal.Add(item.LineTotal)
+		if err != nil {
+			return CartResponse{}, err
+		}
+		cart.Subtotal = subtotal
+		cart.ItemCount += item.Quantity
+	}
+	// An empty cart is priced in the requested currency.
+	if cart.Subtotal.Currency == "" {
+		cart.Subtotal.Currency = money.NormalizeCurrency(currency)
+	}
+	cart.Currency = cart.Subtotal.Currency
+
+	var err error
+	if cart.EstimatedTax, err = region.Tax.EstimateTax(cart.Subtotal); err != nil {
+		return CartResponse{}, fmt.Errorf("estimating tax: %w", err)
+	}
+	if cart.EstimatedShipping, err = region.Shipping.EstimateShipping(cart.Subtotal, cart.ItemCount); err != nil {
+		return CartResponse{}, fmt.Errorf("estimating shipping: %w", err)
+	}
+	if cart.Total, err = cart.Subtotal.Add(cart.EstimatedTax); err != nil {
+		return CartResponse{}, err
+	}
+	if cart.Total, err = cart.Total.Add(cart.EstimatedShipping); err != nil {
+		return CartResponse{}, err
+	}
+	return cart, nil
+}
+
+// loadRegions builds the regions from TAX_RATES and SHIPPING_RATES:
+//
+//	TAX_RATES="US=7.25,DE=19"                         percent of the subtotal
+//	SHIPPING_RATES="US=USD:5.99/50,DE=EUR:4.90|USD:5.49"  CURRENCY:fee[/free from subtotal]
+//
+// A region missing from one of them has no tax or free shipping. A region
+// with shipping rates only takes carts in the currencies it lists. The
+// default region always exists.
+func loadRegions() (map[string]Region, string, error) {
+	fallback := strings.ToUpper(strings.TrimSpace(os.Getenv("DEFAULT_REGION")))
+	if fallback == "" {
+		fallback = defaultRegion
+	}
+	taxRates, err := parseRegionList(os.Getenv("TAX_RATES"))
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid TAX_RATES: %w", err)
+	}
+	shippingRates, err := parseRegionList(os.Getenv("SHIPPING_RATES"))
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid SHIPPING_RATES: %w", err)
+	}
+
+	regions := map[string]Region{}
+	region := func(code string) Region {
+		if r, ok := regions[code]; ok {
+			return r
+		}
+		return Region{Tax: percentageTax{}, Shipping: flatRateShipping{}}
+	}
+	regions[fallback] = region(fallback)
+	for code, rate := range taxRates {
+		percent, err := strconv.ParseFloat(rate, 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, "", fmt.Errorf("invalid TAX_RATES: bad rate %q for %s", rate, code)
+		}
+		r := region(code)
+		r.Tax = percentageTax{basisPoints: int64(math.Round(percent * 100))}
+		regions[code] = r
+	}
+	for code, setting := range shippingRates {
+		shipping := flatRateShipping{rates: map[string]shippingRate{}}
+		for _, entry := range strings.Split(setting, "|") {
+			currency, rate, err := parseShippingRate(entry)
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid SHIPPING_RATES: %w for %s", err, code)
+			}
+			if _, dup := shipping.rates[currency]; dup {
+				return nil, "", fmt.Errorf("invalid SHIPPING_RATES: %s is listed twice for %s", currency, code)
+			}
+			shipping.rates[currency] = rate
+		}
+		r := region(code)
+		r.Shipping = shipping
+		regions[code] = r
+	}
+	return regions, fallback, nil
+}
+
+// parseShippingRate reads one "EUR:4.90/40" entry of SHIPPING_RATES.
+func parseShippingRate(entry string) (string, shippingRate, error) {
+	currency, amounts, ok := strings.Cut(strings.TrimSpace(entry), ":")
+	if !ok || strings.TrimSpace(currency) == "" {
+		return "", shippingRate{}, fmt.Errorf("rate %q is not CURRENCY:fee", entry)
+	}
+	currency = money.NormalizeCurrency(strings.TrimSpace(currency))
+	var rate shippingRate
+	fee, freeOver, hasThreshold := strings.Cut(amounts, "/")
+	var err error
+	if rate.fee, err = money.Parse(fee, currency); err != nil || rate.fee.Amount < 0 {
+		return "", shippingRate{}, fmt.Errorf("bad fee %q", fee)
+	}
+	if hasThreshold {
+		threshold, err := money.Parse(freeOver, currency)
+		if err != nil || threshold.Amount < 0 {
+			return "", shippingRate{}, fmt.Errorf("bad threshold %q", freeOver)
+		}
+		rate.freeOver = &threshold
+	}
+	return currency, rate, nil
+}
+
+// parseRegionList splits "US=7.25,DE=19" into region codes and values.
+func parseRegionList(value string) (map[string]string, error) {
+	list := map[string]string{}
+	if strings.TrimSpace(value) == "" {
+		return list, nil
+	}
+	for _, entry := range strings.Split(value, ",") {
+		code, setting, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if !ok || code == "" || strings.TrimSpace(setting) == "" {
+			return nil, fmt.Errorf("entry %q is not REGION=value", entry)
+		}
+		if _, dup := list[code]; dup {
+			return nil, fmt.Errorf("region %s is listed twice", code)
+		}
+		list[code] = strings.TrimSpace(setting)
+	}
+	return list, nil
+}
+
+// regionCodes lists the configured regions, for error messages.
+func (env *Env) regionCodes() string {
+	codes := make([]string, 0, len(env.regions))
+	for code := range env.regions {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return strings.Join(codes, ", ")
+}
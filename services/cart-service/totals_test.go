@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"three-tier-cloud-shop/money"
+)
+
+func TestPercentageTax(t *testing.T) {
+	tests := []struct {
+		basisPoints int64
+		subtotal    money.Money
+		want        money.Money
+	}{
+		{0, money.New(1000, "USD"), money.New(0, "USD")},
+		{725, money.New(10000, "USD"), money.New(725, "USD")},
+		{725, money.New(1999, "USD"), money.New(145, "USD")},
+		{1900, money.New(1050, "EUR"), money.New(200, "EUR")},
+		{1000, money.New(5, "EUR"), money.New(1, "EUR")},
+		{1000, money.New(4, "EUR"), money.New(0, "EUR")},
+		{1000, money.New(1234, "JPY"), money.New(123, "JPY")},
+	}
+	for _, tt := range tests {
+		got, err := percentageTax{basisPoints: tt.basisPoints}.EstimateTax(tt.subtotal)
+		if err != nil || got != tt.want {
+			t.Errorf("%d bp of %+v = %+v, %v; want %+v", tt.basisPoints, tt.subtotal, got, err, tt.want)
+		}
+	}
+}
+
+func TestFlatRateShipping(t *testing.T) {
+	threshold := money.New(5000, "USD")
+	shipping := flatRateShipping{rates: map[string]shippingRate{
+		"USD": {fee: money.New(599, "USD"), freeOver: &threshold},
+		"EUR": {fee: money.New(490, "EUR")},
+	}}
+	tests := []struct {
+		name      string
+		shipping  flatRateShipping
+		subtotal  money.Money
+		itemCount int
+		want      money.Money
+		wantErr   error
+	}{
+		{name: "no rates ship free", subtotal: money.New(100, "GBP"), itemCount: 1, want: money.New(0, "GBP")},
+		{name: "fee", shipping: shipping, subtotal: money.New(4999, "USD"), itemCount: 1, want: money.New(599, "USD")},
+		{name: "free from the threshold", shipping: shipping, subtotal: money.New(5000, "USD"), itemCount: 1, want: money.New(0, "USD")},
+		{name: "no threshold", shipping: shipping, subtotal: money.New(100000, "EUR"), itemCount: 3, want: money.New(490, "EUR")},
+		{name: "empty cart", shipping: shipping, subtotal: money.New(0, "EUR"), want: money.New(0, "EUR")},
+		{name: "currency without a rate", shipping: shipping, subtotal: money.New(100, "GBP"), itemCount: 1, wantErr: errNoShippingRate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.shipping.EstimateShipping(tt.subtotal, tt.itemCount)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("EstimateShipping = %+v, %v; want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseShippingRate(t *testing.T) {
+	threshold := money.New(4000, "EUR")
+	tests := []struct {
+		entry        string
+		wantCurrency string
+		want         shippingRate
+		wantErr      bool
+	}{
+		{entry: "EUR:4.90/40", wantCurrency: "EUR", want: shippingRate{fee: money.New(490, "EUR"), freeOver: &threshold}},
+		{entry: " usd:5.99 ", wantCurrency: "USD", want: shippingRate{fee: money.New(599, "USD")}},
+		{entry: "JPY:800", wantCurrency: "JPY", want: shippingRate{fee: money.New(800, "JPY")}},
+		{entry: "5.99", wantErr: true},
+		{entry: ":5.99", wantErr: true},
+		{entry: "USD:", wantErr: true},
+		{entry: "USD:-1", wantErr: true},
+		{entry: "USD:5.999", wantErr: true},
+		{entry: "JPY:8.5", wantErr: true},
+		{entry: "USD:5/", wantErr: true},
+		{entry: "USD:5/-10", wantErr: true},
+	}
+	for _, tt := range tests {
+		currency, rate, err := parseShippingRate(tt.entry)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseShippingRate(%q) = %s %+v, want error", tt.entry, currency, rate)
+			}
+			continue
+		}
+		if err != nil || currency != tt.wantCurrency || !reflect.DeepEqual(rate, tt.want) {
+			t.Errorf("parseShippingRate(%q) = %s %+v, %v; want %s %+v", tt.entry, currency, rate, err, tt.wantCurrency, tt.want)
+		}
+	}
+}
+
+func TestParseRegionList(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{value: "", want: map[string]string{}},
+		{value: "  ", want: map[string]string{}},
+		{value: "US=7.25,de = 19", want: map[string]string{"US": "7.25", "DE": "19"}},
+		{value: "US=USD:5.99/50,DE=EUR:4.90|USD:5.49", want: map[string]string{"US": "USD:5.99/50", "DE": "EUR:4.90|USD:5.49"}},
+		{value: "US", wantErr: true},
+		{value: "=7", wantErr: true},
+		{value: "US=", wantErr: true},
+		{value: "US=7,us=8", wantErr: true},
+		{value: "US=7,", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseRegionList(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseRegionList(%q) = %v, want error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRegionList(%q) = %v, %v; want %v", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestCartTotals(t *testing.T) {
+	threshold := money.New(5000, "USD")
+	us := Region{
+		Tax: percentageTax{basisPoints: 725},
+		Shipping: flatRateShipping{rates: map[string]shippingRate{
+			"USD": {fee: money.New(599, "USD"), freeOver: &threshold},
+		}},
+	}
+	line := func(quantity int, total int64, currency string, available bool) CartItemDetail {
+		return CartItemDetail{Quantity: quantity, LineTotal: money.New(total, currency), Currency: currency, Available: available}
+	}
+	tests := []struct {
+		name     string
+		items    []CartItemDetail
+		currency string
+		region   Region
+		want     CartResponse
+		wantErr  bool
+	}{
+		{
+			name:   "tax and shipping",
+			items:  []CartItemDetail{line(2, 2000, "USD", true), line(1, 999, "USD", true)},
+			region: us,
+			want: CartResponse{
+				Subtotal: money.New(2999, "USD"), EstimatedTax: money.New(217, "USD"),
+				EstimatedShipping: money.New(599, "USD"), Total: money.New(3815, "USD"),
+				ItemCount: 3, Currency: "USD",
+			},
+		},
+		{
+			name:   "free shipping over the threshold",
+			items:  []CartItemDetail{line(1, 6000, "USD", true)},
+			region: us,
+			want: CartResponse{
+				Subtotal: money.New(6000, "USD"), EstimatedTax: money.New(435, "USD"),
+				EstimatedShipping: money.New(0, "USD"), Total: money.New(6435, "USD"),
+				ItemCount: 1, Currency: "USD",
+			},
+		},
+		{
+			name:   "unavailable items aren't counted",
+			items:  []CartItemDetail{line(1, 1000, "USD", true), line(4, 9000, "USD", false)},
+			region: us,
+			want: CartResponse{
+				Subtotal: money.New(1000, "USD"), EstimatedTax: money.New(73, "USD"),
+				EstimatedShipping: money.New(599, "USD"), Total: money.New(1672, "USD"),
+				ItemCount: 1, Currency: "USD",
+			},
+		},
+		{
+			name:     "empty cart in the requested currency",
+			currency: "eur",
+			region:   Region{Tax: percentageTax{basisPoints: 1900}, Shipping: flatRateShipping{}},
+			want: CartResponse{
+				Subtotal: money.New(0, "EUR"), EstimatedTax: money.New(0, "EUR"),
+				EstimatedShipping: money.New(0, "EUR"), Total: money.New(0, "EUR"),
+				Currency: "EUR",
+			},
+		},
+		{
+			name:    "mixed currencies",
+			items:   []CartItemDetail{line(1, 1000, "USD", true), line(1, 1000, "EUR", true)},
+			region:  us,
+			wantErr: true,
+		},
+		{
+			name:    "no shipping rate for the currency",
+			items:   []CartItemDetail{line(1, 1000, "EUR", true)},
+			region:  us,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cartTotals(tt.items, tt.currency, tt.region)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("cartTotals = %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("cartTotals: %v", err)
+			}
+			tt.want.Items = tt.items
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("cartTotals = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Defaults for MAX_ITEM_QUANTITY and MAX_CART_QUANTITY.
+const (
+	defaultMaxItemQuantity = 20
+	defaultMaxCartQuantity = 100
+)
+
+// cartUpdateAttempts is how often a cart change is retried when the cart was
+// modified concurrently.
+const cartUpdateAttempts = 3
+
+// Reasons a cart item is rejected.
+const (
+	ItemErrorUnknownSKU        = "unknown_sku"
+	ItemErrorUnavailable       = "unavailable"
+	ItemErrorInsufficientStock = "insufficient_stock"
+	ItemErrorItemLimit         = "item_limit_exceeded"
+	ItemErrorCartLimit         = "cart_limit_exceeded"
+)
+
+var (
+	// errCartBusy is returned when a cart kept changing while it was updated.
+	errCartBusy = errors.New("cart is being changed concurrently")
+	// errCatalogUnavailable is returned when a product could not be looked up.
+	errCatalogUnavailable = errors.New("catalog is unavailable")
+)
+
+// ItemError explains why a cart item was rejected. It is returned as the body
+// of a 422 response. Available is how many can be added, when that is known.
+type ItemError struct {
+	Code      string `json:"error"`
+	Message   string `json:"message"`
+	SKU       string `json:"sku"`
+	Requested int    `json:"requested"`
+	Available *int   `json:"available,omitempty"`
+}
+
+func (e *ItemError) Error() string { return e.Message }
+
+// loadQuantityLimits reads the largest quantity of one SKU and the largest
+// number of items a cart may hold.
+func loadQuantityLimits() (perItem, perCart int, err error) {
+	perItem, perCart = defaultMaxItemQuantity, defaultMaxCartQuantity
+	for name, limit := range map[string]*int{"MAX_ITEM_QUANTITY": &perItem, "MAX_CART_QUANTITY": &perCart} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return 0, 0, fmt.Errorf("invalid %s %q", name, value)
+		}
+		*limit = n
+	}
+	return perItem, perCart, nil
+}
+
+// setItemQuantity sets the quantity of sku in the cart to what quantity
+// returns for the current one. The new quantity is checked against the
+// limits and the catalog first; an *ItemError says why it was rejected. The
+// cart is watched so concurrent changes can't add up past the limits.
+func (env *Env) setItemQuantity(ctx context.Context, cartKey, sku string, quantity func(current int) int) error {
+	update := func(tx *redis.Tx) error {
+		items, err := tx.HGetAll(ctx, cartKey).Result()
+		if err != nil {
+			return err
+		}
+		current, _ := strconv.Atoi(items[sku])
+		requested := quantity(current)
+		others := 0
+		for other, value := range items {
+			if other != sku {
+				n, _ := strconv.Atoi(value)
+				others += n
+			}
+		}
+		if err := env.validateItem(sku, requested, others); err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, cartKey, sku, requested)
+			env.expireGuestCart(ctx, pipe, cartKey)
+			return nil
+		})
+		return err
+	}
+
+	for attempt := 0; attempt < cartUpdateAttempts; attempt++ {
+		err := env.rdb.Watch(ctx, update, cartKey)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return errCartBusy
+}
+
+// validateItem checks that requested of sku fits the limits, next to the
+// other items already in the cart, and that the catalog can sell that many.
+func (env *Env) validateItem(sku string, requested, others int) error {
+	reject := func(code, message string, available *int) error {
+		return &ItemError{Code: code, Message: message, SKU: sku, Requested: requested, Available: available}
+	}
+	if limit := env.maxItemQuantity; requested > limit {
+		return reject(ItemErrorItemLimit,
+			fmt.Sprintf("At most %d of an item can be in the cart", limit), &limit)
+	}
+	if others+requested > env.maxCartQuantity {
+		room := max(env.maxCartQuantity-others, 0)
+		return reject(ItemErrorCartLimit,
+			fmt.Sprintf("The cart can hold at most %d items", env.maxCartQuantity), &room)
+	}
+
+	products, err := env.getProductDetailsBatch([]string{sku}, "")
+	if err != nil {
+		return fmt.Errorf("%w: %v", errCatalogUnavailable, err)
+	}
+	if len(products) == 0 {
+		return reject(ItemErrorUnknownSKU, fmt.Sprintf("Product %s does not exist", sku), nil)
+	}
+	product := products[0]
+	if !product.Available {
+		zero := 0
+		return reject(ItemErrorUnavailable, fmt.Sprintf("%s is no longer available", product.Name), &zero)
+	}
+	// Products without a stock quantity aren't tracked and never run out.
+	if product.StockQuantity != nil && int64(requested) > *product.StockQuantity {
+		available := int(max(*product.StockQuantity, 0))
+		return reject(ItemErrorInsufficientStock,
+			fmt.Sprintf("Only %d of %s in stock", available, product.Name), &available)
+	}
+	return nil
+}
+
+// writeCartUpdateError responds to a failed setItemQuantity.
+func writeCartUpdateError(w http.ResponseWriter, err error) {
+	var rejected *ItemError
+	switch {
+	case errors.As(err, &rejected):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(rejected)
+	case errors.Is(err, errCartBusy):
+		http.Error(w, "Cart is being changed, try again", http.StatusConflict)
+	case errors.Is(err, errCatalogUnavailable):
+		log.Printf("Could not validate cart item: %v", err)
+		http.Error(w, "Product catalog is unavailable", http.StatusServiceUnavailable)
+	default:
+		log.Printf("Failed to update cart: %v", err)
+		http.Error(w, "Failed to update cart", http.StatusInternalServerError)
+	}
+}
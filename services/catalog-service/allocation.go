@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// allocationAttempts is how often an allocation is retried when the stock
+// changed between reading and reserving it.
+const allocationAttempts = 3
+
+// errStockChanged is returned when a warehouse no longer holds the stock an
+// allocation was planned with.
+var errStockChanged = errors.New("stock changed during allocation")
+
+// InsufficientStockError is returned when the warehouses together hold less
+// of a SKU than an order needs.
+type InsufficientStockError struct {
+	SKU       string
+	Requested int64
+	Available int64
+}
+
+func (e *InsufficientStockError) Error() string {
+	return fmt.Sprintf("not enough stock for %s: %d requested, %d available", e.SKU, e.Requested, e.Available)
+}
+
+// AllocationItem is an order line to allocate.
+type AllocationItem struct {
+	SKU      string `json:"sku" bson:"sku"`
+	Quantity int64  `json:"quantity" bson:"quantity"`
+}
+
+// AllocationLine is the part of an order line shipped from one warehouse.
+// Tracked is false for SKUs without a stock level, whose stock was not
+// reserved.
+type AllocationLine struct {
+	SKU       string `json:"sku" bson:"sku"`
+	Warehouse string `json:"warehouse" bson:"warehouse"`
+	Quantity  int64  `json:"quantity" bson:"quantity"`
+	Tracked   bool   `json:"tracked" bson:"tracked"`
+}
+
+// Allocation is the stock reserved for an order. It is stored under the
+// order's ID, so allocating the same order twice returns the first result.
+// Bundles are allocated as their components; Bundles lists what each bundle
+// line was expanded into.
+type Allocation struct {
+	OrderID   string            `json:"orderId" bson:"_id"`
+	Lines     []AllocationLine  `json:"lines" bson:"lines"`
+	Bundles   []BundleExpansion `json:"bundles,omitempty" bson:"bundles,omitempty"`
+	CreatedAt time.Time         `json:"createdAt" bson:"createdAt"`
+}
+
+// allocate picks the warehouses to ship items from. warehouses is in order of
+// preference and stock holds the stock per SKU and warehouse; SKUs missing
+// from stock aren't tracked and can ship from anywhere.
+//
+// Fewer shipments win: a warehouse that can ship the whole order is used
+// alone. Otherwise each line goes to a warehouse that can ship all of it,
+// preferring one the order already ships from, and only lines no single
+// warehouse can cover are split.
+func allocate(items []AllocationItem, stock map[string]map[string]int64, warehouses []string) ([]AllocationLine, error) {
+	needed := make(map[string]int64, len(items))
+	var order []string
+	for _, item := range items {
+		if _, seen := needed[item.SKU]; !seen {
+			order = append(order, item.SKU)
+		}
+		needed[item.SKU] += item.Quantity
+	}
+
+	for _, sku := range order {
+		levels, tracked := stock[sku]
+		if !tracked {
+			continue
+		}
+		var total int64
+		for _, warehouse := range warehouses {
+			total += levels[warehouse]
+		}
+		if total < needed[sku] {
+			return nil, &InsufficientStockError{SKU: sku, Requested: needed[sku], Available: total}
+		}
+	}
+
+	canShip := func(warehouse string, skus []string) bool {
+		for _, sku := range skus {
+			if levels, tracked := stock[sku]; tracked && levels[warehouse] < needed[sku] {
+				return false
+			}
+		}
+		return true
+	}
+	for _, warehouse := range warehouses {
+		if canShip(warehouse, order) {
+			lines := make([]AllocationLine, len(order))
+			for i, sku := range order {
+				_, tracked := stock[sku]
+				lines[i] = AllocationLine{SKU: sku, Warehouse: warehouse, Quantity: needed[sku], Tracked: tracked}
+			}
+			return lines, nil
+		}
+	}
+
+	var lines []AllocationLine
+	var used []string
+	var untracked []string
+	for _, sku := range order {
+		levels, tracked := stock[sku]
+		if !tracked {
+			untracked = append(untracked, sku)
+			continue
+		}
+		candidates := append(append([]string{}, used...), warehouses...)
+		whole := ""
+		for _, warehouse := range candidates {
+			if levels[warehouse] >= needed[sku] {
+				whole = warehouse
+				break
+			}
+		}
+		if whole != "" {
+			lines = append(lines, AllocationLine{SKU: sku, Warehouse: whole, Quantity: needed[sku], Tracked: true})
+			used = appendUnique(used, whole)
+			continue
+		}
+		remaining := needed[sku]
+		for _, warehouse := range candidates {
+			take := min(levels[warehouse], remaining)
+			if take <= 0 {
+				continue
+			}
+			lines = append(lines, AllocationLine{SKU: sku, Warehouse: warehouse, Quantity: take, Tracked: true})
+			used = appendUnique(used, warehouse)
+			remaining -= take
+			if remaining == 0 {
+				break
+			}
+		}
+	}
+	// Untracked SKUs join the first shipment.
+	for _, sku := range untracked {
+		lines = append(lines, AllocationLine{SKU: sku, Warehouse: used[0], Quantity: needed[sku]})
+	}
+	return lines, nil
+}
+
+func appendUnique(list []string, value string) []string {
+	if slices.Contains(list, value) {
+		return list
+	}
+	return append(list, value)
+}
+
+// allocateStock plans an allocation from the current stock and reserves it.
+// Every line is reserved with a conditional decrement; if one fails because
+// the stock moved meanwhile, the lines already reserved are given back and
+// the caller may plan again.
+func (env *Env) allocateStock(ctx context.Context, items []AllocationItem) ([]AllocationLine, error) {
+	skus := make([]string, len(items))
+	for i, item := range items {
+		skus[i] = item.SKU
+	}
+	cursor, err := env.inventory.Find(ctx, bson.M{"_id": bson.M{"$in": skus}})
+	if err != nil {
+		return nil, err
+	}
+	var levels []StockLevel
+	if err := cursor.All(ctx, &levels); err != nil {
+		return nil, err
+	}
+	stock := make(map[string]map[string]int64, len(levels))
+	for _, level := range levels {
+		stock[level.SKU] = level.Warehouses
+		if stock[level.SKU] == nil {
+			stock[level.SKU] = map[string]int64{}
+		}
+	}
+
+	lines, err := allocate(items, stock, env.warehouses)
+	if err != nil {
+		return nil, err
+	}
+	for i, line := range lines {
+		if !line.Tracked {
+			continue
+		}
+		result, err := env.inventory.UpdateOne(ctx,
+			bson.M{"_id": line.SKU, "warehouses." + line.Warehouse: bson.M{"$gte": line.Quantity}},
+			adjustStock(line.Warehouse, -line.Quantity),
+		)
+		if err == nil && result.MatchedCount == 0 {
+			err = errStockChanged
+		}
+		if err != nil {
+			env.restock(ctx, lines[:i])
+			return nil, err
+		}
+	}
+	return lines, nil
+}
+
+// restock puts the stock of allocation lines back.
+func (env *Env) restock(ctx context.Context, lines []AllocationLine) {
+	for _, line := range lines {
+		if !line.Tracked {
+			continue
+		}
+		_, err := env.inventory.UpdateOne(ctx, bson.M{"_id": line.SKU}, adjustStock(line.Warehouse, line.Quantity))
+		if err != nil {
+			log.Printf("CRITICAL: failed to restock %d of %s in %s: %v", line.Quantity, line.SKU, line.Warehouse, err)
+		}
+	}
+}
+
+// adjustStock changes the stock of a SKU in warehouse by delta, keeping its
+// total and low-stock flag up to date like a stock level update does.
+func adjustStock(warehouse string, delta int64) mongo.Pipeline {
+	field := "warehouses." + warehouse
+	return append(mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		field:       bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$" + field, 0}}, delta}},
+		"updatedAt": time.Now(),
+	}}}}, recountStock()...)
+}
+
+// createAllocationHandler reserves stock for an order and returns where each
+// line ships from (POST /api/inventory/allocations).
+// Body: {"orderId": "...", "items": [{"sku": "CAM-1", "quantity": 2}]}.
+func (env *Env) createAllocationHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		OrderID string           `json:"orderId"`
+		Items   []AllocationItem `json:"items"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.OrderID == "" || len(req.Items) == 0 {
+		http.Error(w, "orderId and items are required", http.StatusBadRequest)
+		return
+	}
+	for _, item := range req.Items {
+		if item.SKU == "" || item.Quantity < 1 {
+			http.Error(w, "Every item needs a SKU and a positive quantity", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var existing Allocation
+	err := env.allocations.FindOne(ctx, bson.M{"_id": req.OrderID}).Decode(&existing)
+	if err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(existing)
+		return
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	items, bundles, err := env.expandBundles(ctx, req.Items)
+	if err != nil {
+		log.Printf("Error expanding bundles of order %s: %v", req.OrderID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	var lines []AllocationLine
+	for attempt := 0; attempt < allocationAttempts; attempt++ {
+		lines, err = env.allocateStock(ctx, items)
+		if !errors.Is(err, errStockChanged) {
+			break
+		}
+	}
+	var insufficient *InsufficientStockError
+	switch {
+	case errors.As(err, &insufficient):
+		http.Error(w, insufficient.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errStockChanged):
+		http.Error(w, "Stock is changing too quickly, try again", http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		log.Printf("Error allocating order %s: %v", req.OrderID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	allocation := Allocation{OrderID: req.OrderID, Lines: lines, Bundles: bundles, CreatedAt: time.Now()}
+	if _, err := env.allocations.InsertOne(ctx, allocation); err != nil {
+		// A concurrent request for the same order got there first.
+		env.restock(ctx, lines)
+		if mongo.IsDuplicateKeyError(err) {
+			http.Error(w, "Order is already being allocated", http.StatusConflict)
+			return
+		}
+		log.Printf("Error saving allocation of order %s: %v", req.OrderID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	env.cache.invalidateProducts(ctx, allocatedSKUs(lines)...)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(allocation)
+}
+
+// releaseAllocationHandler gives the stock of an order that won't ship back
+// (DELETE /api/inventory/allocations/{orderId}).
+func (env *Env) releaseAllocationHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Deleting first means a release can't be applied twice.
+	var allocation Allocation
+	err := env.allocations.FindOneAndDelete(ctx, bson.M{"_id": r.PathValue("orderId")}).Decode(&allocation)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		http.Error(w, "Allocation not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	env.restock(ctx, allocation.Lines)
+	env.cache.invalidateProducts(ctx, allocatedSKUs(allocation.Lines)...)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func allocatedSKUs(lines []AllocationLine) []string {
+	skus := make([]string, 0, len(lines))
+	for _, line := range lines {
+		skus = appendUnique(skus, line.SKU)
+	}
+	return skus
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestAllocate(t *testing.T) {
+	warehouses := []string{"east", "west", "north"}
+	tests := []struct {
+		name  string
+		items []AllocationItem
+		stock map[string]map[string]int64
+		want  []AllocationLine
+	}{
+		{
+			name:  "one warehouse ships everything",
+			items: []AllocationItem{{SKU: "A", Quantity: 2}, {SKU: "B", Quantity: 1}},
+			stock: map[string]map[string]int64{
+				"A": {"east": 1, "west": 5},
+				"B": {"east": 3, "west": 1},
+			},
+			want: []AllocationLine{
+				{SKU: "A", Warehouse: "west", Quantity: 2, Tracked: true},
+				{SKU: "B", Warehouse: "west", Quantity: 1, Tracked: true},
+			},
+		},
+		{
+			name:  "preferred warehouse wins a tie",
+			items: []AllocationItem{{SKU: "A", Quantity: 1}},
+			stock: map[string]map[string]int64{"A": {"east": 1, "west": 1}},
+			want:  []AllocationLine{{SKU: "A", Warehouse: "east", Quantity: 1, Tracked: true}},
+		},
+		{
+			name:  "repeated SKUs are added up",
+			items: []AllocationItem{{SKU: "A", Quantity: 2}, {SKU: "A", Quantity: 3}},
+			stock: map[string]map[string]int64{"A": {"east": 4, "west": 5}},
+			want:  []AllocationLine{{SKU: "A", Warehouse: "west", Quantity: 5, Tracked: true}},
+		},
+		{
+			name:  "lines go whole to different warehouses",
+			items: []AllocationItem{{SKU: "A", Quantity: 2}, {SKU: "B", Quantity: 2}},
+			stock: map[string]map[string]int64{
+				"A": {"east": 2},
+				"B": {"west": 2},
+			},
+			want: []AllocationLine{
+				{SKU: "A", Warehouse: "east", Quantity: 2, Tracked: true},
+				{SKU: "B", Warehouse: "west", Quantity: 2, Tracked: true},
+			},
+		},
+		{
+			name:  "a warehouse already used is preferred",
+			items: []AllocationItem{{SKU: "A", Quantity: 2}, {SKU: "B", Quantity: 2}, {SKU: "C", Quantity: 1}},
+			stock: map[string]map[string]int64{
+				"A": {"west": 2},
+				"B": {"north": 2},
+				"C": {"east": 1, "north": 1},
+			},
+			want: []AllocationLine{
+				{SKU: "A", Warehouse: "west", Quantity: 2, Tracked: true},
+				{SKU: "B", Warehouse: "north", Quantity: 2, Tracked: true},
+				{SKU: "C", Warehouse: "north", Quantity: 1, Tracked: true},
+			},
+		},
+		{
+			name:  "a line no warehouse covers is split",
+			items: []AllocationItem{{SKU: "A", Quantity: 5}},
+			stock: map[string]map[string]int64{"A": {"east": 2, "west": 2, "north": 2}},
+			want: []AllocationLine{
+				{SKU: "A", Warehouse: "east", Quantity: 2, Tracked: true},
+				{SKU: "A", Warehouse: "west", Quantity: 2, Tracked: true},
+				{SKU: "A", Warehouse: "north", Quantity: 1, Tracked: true},
+			},
+		},
+		{
+			name:  "untracked SKUs ship from anywhere",
+			items: []AllocationItem{{SKU: "A", Quantity: 1}, {SKU: "GIFT", Quantity: 1}},
+			stock: map[string]map[string]int64{"A": {"west": 1}},
+			want: []AllocationLine{
+				{SKU: "A", Warehouse: "west", Quantity: 1, Tracked: true},
+				{SKU: "GIFT", Warehouse: "west", Quantity: 1},
+			},
+		},
+		{
+			name:  "untracked SKUs join the first shipment of a split order",
+			items: []AllocationItem{{SKU: "GIFT", Quantity: 1}, {SKU: "A", Quantity: 2}, {SKU: "B", Quantity: 2}},
+			stock: map[string]map[string]int64{
+				"A": {"west": 2},
+				"B": {"north": 2},
+			},
+			want: []AllocationLine{
+				{SKU: "A", Warehouse: "west", Quantity: 2, Tracked: true},
+				{SKU: "B", Warehouse: "north", Quantity: 2, Tracked: true},
+				{SKU: "GIFT", Warehouse: "west", Quantity: 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := allocate(tt.items, tt.stock, warehouses)
+			if err != nil {
+				t.Fatalf("allocate: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("allocate = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllocateInsufficientStock(t *testing.T) {
+	items := []AllocationItem{{SKU: "A", Quantity: 1}, {SKU: "B", Quantity: 4}}
+	stock := map[string]map[string]int64{
+		"A": {"east": 1},
+		"B": {"east": 1, "west": 2, "closed": 10},
+	}
+	_, err := allocate(items, stock, []string{"east", "west"})
+	var insufficient *InsufficientStockError
+	if !errors.As(err, &insufficient) {
+		t.Fatalf("allocate error = %v, want InsufficientStockError", err)
+	}
+	want := InsufficientStockError{SKU: "B", Requested: 4, Available: 3}
+	if *insufficient != want {
+		t.Errorf("allocate error = %+v, want %+v", *insufficient, want)
+	}
+}
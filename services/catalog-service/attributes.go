@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Attribute value types.
+const (
+	AttributeTypeString  = "string"
+	AttributeTypeNumber  = "number"
+	AttributeTypeBoolean = "boolean"
+)
+
+// attributeFilterPrefix marks the product list query parameters that filter
+// on attributes, e.g. attr.mount=Sony E or attr.megapixels.min=24.
+const attributeFilterPrefix = "attr."
+
+// attributeKeyPattern keeps keys usable as query parameters and field paths.
+var attributeKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// AttributeDefinition describes one specification of the products in a
+// category. A string attribute with AllowedValues only accepts those values;
+// Unit is how numbers are displayed ("MP", "mm").
+type AttributeDefinition struct {
+	Key           string   `json:"key" bson:"key"`
+	Label         string   `json:"label" bson:"label"`
+	Type          string   `json:"type" bson:"type"`
+	Unit          string   `json:"unit,omitempty" bson:"unit,omitempty"`
+	AllowedValues []string `json:"allowedValues,omitempty" bson:"allowedValues,omitempty"`
+	Required      bool     `json:"required" bson:"required"`
+}
+
+// validateAttributeDefinitions checks a category's own attribute definitions
+// and returns a message describing the first problem.
+func validateAttributeDefinitions(defs []AttributeDefinition) string {
+	seen := make(map[string]bool, len(defs))
+	for i := range defs {
+		def := &defs[i]
+		def.Label = strings.TrimSpace(def.Label)
+		if !attributeKeyPattern.MatchString(def.Key) {
+			return fmt.Sprintf("attribute key %q must be lowercase letters, digits and underscores", def.Key)
+		}
+		if seen[def.Key] {
+			return fmt.Sprintf("attribute %s is defined twice", def.Key)
+		}
+		seen[def.Key] = true
+		if def.Label == "" {
+			def.Label = def.Key
+		}
+		switch def.Type {
+		case AttributeTypeString:
+		case AttributeTypeNumber, AttributeTypeBoolean:
+			if len(def.AllowedValues) > 0 {
+				return fmt.Sprintf("attribute %s: allowed values only apply to string attributes", def.Key)
+			}
+		default:
+			return fmt.Sprintf("attribute %s: type must be one of string, number or boolean", def.Key)
+		}
+		if def.Unit != "" && def.Type != AttributeTypeNumber {
+			return fmt.Sprintf("attribute %s: a unit only applies to number attributes", def.Key)
+		}
+	}
+	return ""
+}
+
+// attributeSchema returns the attributes that apply to products of a category:
+// those of every ancestor, root first, then its own. A subcategory may redefine
+// an inherited attribute.
+func (env *Env) attributeSchema(ctx context.Context, category Category) ([]AttributeDefinition, error) {
+	lineage := []Category{category}
+	if len(category.Ancestors) > 0 {
+		cursor, err := env.categories.Find(ctx, bson.M{"_id": bson.M{"$in": category.Ancestors}})
+		if err != nil {
+			return nil, err
+		}
+		var ancestors []Category
+		if err := cursor.All(ctx, &ancestors); err != nil {
+			return nil, err
+		}
+		byID := make(map[string]Category, len(ancestors))
+		for _, a := range ancestors {
+			byID[a.ID.Hex()] = a
+		}
+		lineage = lineage[:0]
+		for _, id := range category.Ancestors {
+			if a, ok := byID[id.Hex()]; ok {
+				lineage = append(lineage, a)
+			}
+		}
+		lineage = append(lineage, category)
+	}
+
+	schema := make([]AttributeDefinition, 0)
+	index := make(map[string]int)
+	for _, c := range lineage {
+		for _, def := range c.Attributes {
+			if i, ok := index[def.Key]; ok {
+				schema[i] = def
+				continue
+			}
+			index[def.Key] = len(schema)
+			schema = append(schema, def)
+		}
+	}
+	return schema, nil
+}
+
+// validateProductAttributes checks the product's attributes against the schema
+// of its category and converts each value to its declared type. It writes the
+// error response itself and returns false when the handler should stop.
+func (env *Env) validateProductAttributes(ctx context.Context, w http.ResponseWriter, p *Product) bool {
+	msg, err := env.checkProductAttributes(ctx, p)
+	return writeValidation(w, msg, err)
+}
+
+// checkProductAttributes applies the rules of validateProductAttributes and
+// returns a message describing the first problem.
+func (env *Env) checkProductAttributes(ctx context.Context, p *Product) (string, error) {
+	var schema []AttributeDefinition
+	if p.CategoryID != nil {
+		var category Category
+		err := env.categories.FindOne(ctx, bson.M{"_id": *p.CategoryID}).Decode(&category)
+		if err == nil {
+			schema, err = env.attributeSchema(ctx, category)
+		}
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return "", fmt.Errorf("loading attribute schema: %w", err)
+		}
+	}
+
+	if msg := checkAttributes(p.Attributes, schema); msg != "" {
+		return msg, nil
+	}
+	if len(p.Attributes) == 0 {
+		p.Attributes = nil
+	}
+	return "", nil
+}
+
+// checkAttributes validates attrs against schema in place and returns a
+// message describing the first problem.
+func checkAttributes(attrs map[string]interface{}, schema []AttributeDefinition) string {
+	defs := make(map[string]AttributeDefinition, len(schema))
+	for _, def := range schema {
+		defs[def.Key] = def
+		if _, ok := attrs[def.Key]; def.Required && !ok {
+			return fmt.Sprintf("attribute %s is required", def.Key)
+		}
+	}
+	for key, value := range attrs {
+		def, ok := defs[key]
+		if !ok {
+			return fmt.Sprintf("attribute %s is not defined for this category", key)
+		}
+		if value == nil {
+			if def.Required {
+				return fmt.Sprintf("attribute %s is required", key)
+			}
+			delete(attrs, key)
+			continue
+		}
+		switch def.Type {
+		case AttributeTypeString:
+			s, ok := value.(string)
+			if !ok {
+				return fmt.Sprintf("attribute %s must be a string", key)
+			}
+			if len(def.AllowedValues) > 0 && !slices.Contains(def.AllowedValues, s) {
+				return fmt.Sprintf("attribute %s must be one of: %s", key, strings.Join(def.AllowedValues, ", "))
+			}
+		case AttributeTypeNumber:
+			n, ok := attributeNumber(value)
+			if !ok {
+				return fmt.Sprintf("attribute %s must be a number", key)
+			}
+			attrs[key] = n
+		case AttributeTypeBoolean:
+			if _, ok := value.(bool); !ok {
+				return fmt.Sprintf("attribute %s must be true or false", key)
+			}
+		}
+	}
+	return ""
+}
+
+// attributeNumber accepts the numeric types JSON and BSON decode into.
+func attributeNumber(value interface{}) (float64, bool) {
+	switch n := value.(type) {
+	case float64:
+		return n, true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// attributeFilter builds the conditions for the attr.* query parameters.
+// attr.<key>=a,b matches any of the values; attr.<key>.min and .max bound a
+// number attribute. Values are matched as text, number and boolean alike, as
+// the schema can differ between categories.
+func attributeFilter(values url.Values) (bson.M, error) {
+	filter := bson.M{}
+	for param, list := range values {
+		if !strings.HasPrefix(param, attributeFilterPrefix) || len(list) == 0 {
+			continue
+		}
+		key := strings.TrimPrefix(param, attributeFilterPrefix)
+		bound := ""
+		if base, ok := strings.CutSuffix(key, ".min"); ok {
+			key, bound = base, "$gte"
+		} else if base, ok := strings.CutSuffix(key, ".max"); ok {
+			key, bound = base, "$lte"
+		}
+		if !attributeKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("invalid attribute filter %q", param)
+		}
+		field := "attributes." + key
+		condition, _ := filter[field].(bson.M)
+		if condition == nil {
+			condition = bson.M{}
+		}
+
+		if bound != "" {
+			n, err := strconv.ParseFloat(list[0], 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be a number", param)
+			}
+			condition[bound] = n
+		} else {
+			candidates := bson.A{}
+			for _, v := range strings.Split(list[0], ",") {
+				candidates = append(candidates, v)
+				if n, err := strconv.ParseFloat(v, 64); err == nil {
+					candidates = append(candidates, n)
+				}
+				if v == "true" || v == "false" {
+					candidates = append(candidates, v == "true")
+				}
+			}
+			condition["$in"] = candidates
+		}
+		filter[field] = condition
+	}
+	return filter, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Audit actions, one per product event type.
+const (
+	AuditActionCreated = "created"
+	AuditActionUpdated = "updated"
+	AuditActionDeleted = "deleted"
+)
+
+// AuditEntry records one write to a product: who made it, when, and how each
+// field changed. Entries are only ever inserted.
+type AuditEntry struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id"`
+	ProductID primitive.ObjectID `json:"productId" bson:"productId"`
+	SKU       string             `json:"sku" bson:"sku"`
+	Action    string             `json:"action" bson:"action"`
+	Actor     string             `json:"actor" bson:"actor"`
+	At        time.Time          `json:"at" bson:"at"`
+	Version   int64              `json:"version" bson:"version"`
+	Changes   []FieldChange      `json:"changes" bson:"changes"`
+}
+
+// FieldChange is the old and new value of one field, in the product's JSON
+// form. From is null for a field that was just set.
+type FieldChange struct {
+	Field string      `json:"field" bson:"field"`
+	From  interface{} `json:"from" bson:"from"`
+	To    interface{} `json:"to" bson:"to"`
+}
+
+type PaginatedAuditResponse struct {
+	Entries      []AuditEntry `json:"entries"`
+	TotalPages   int64        `json:"totalPages"`
+	CurrentPage  int64        `json:"currentPage"`
+	TotalEntries int64        `json:"totalEntries"`
+}
+
+// auditEntries turns product events into audit entries. The events already
+// hold the changed fields and their old values; the new values come from the
+// product state they carry. A created product lists every field it was
+// created with.
+func auditEntries(events []OutboxEvent, actor string) []interface{} {
+	entries := make([]interface{}, 0, len(events))
+	for _, e := range events {
+		var event struct {
+			Type          string                     `json:"type"`
+			OccurredAt    time.Time                  `json:"occurredAt"`
+			ProductID     string                     `json:"productId"`
+			SKU           string                     `json:"sku"`
+			Version       int64                      `json:"version"`
+			ChangedFields []string                   `json:"changedFields"`
+			Previous      map[string]json.RawMessage `json:"previous"`
+			Product       map[string]json.RawMessage `json:"product"`
+		}
+		if err := json.Unmarshal(e.Body, &event); err != nil {
+			log.Printf("CRITICAL: cannot audit event %s: %v", e.ID.Hex(), err)
+			continue
+		}
+
+		productID, _ := primitive.ObjectIDFromHex(event.ProductID)
+		entry := AuditEntry{
+			ID:        primitive.NewObjectID(),
+			ProductID: productID,
+			SKU:       event.SKU,
+			Actor:     actor,
+			At:        event.OccurredAt,
+			Version:   event.Version,
+			Changes:   []FieldChange{},
+		}
+		fields := event.ChangedFields
+		switch event.Type {
+		case EventProductCreated:
+			entry.Action = AuditActionCreated
+			fields = nil
+			for field, value := range event.Product {
+				if !eventIgnoredFields[field] && field != "id" && !emptyJSON[string(value)] {
+					fields = append(fields, field)
+				}
+			}
+			sort.Strings(fields)
+		case EventProductDeleted:
+			entry.Action = AuditActionDeleted
+		default:
+			entry.Action = AuditActionUpdated
+		}
+		for _, field := range fields {
+			entry.Changes = append(entry.Changes, FieldChange{
+				Field: field,
+				From:  auditValue(event.Previous[field]),
+				To:    auditValue(event.Product[field]),
+			})
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// emptyJSON are the values a created product's fields default to.
+var emptyJSON = map[string]bool{"null": true, `""`: true, "0": true, "false": true, "[]": true, "{}": true}
+
+// auditValue decodes a JSON value so it is stored as a plain BSON value.
+func auditValue(raw json.RawMessage) interface{} {
+	if len(raw) == 0 {
+		return nil
+	}
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil
+	}
+	return value
+}
+
+// getProductHistoryHandler returns the audit trail of a product, newest first
+// (GET /api/products/{id}/history?page=1&limit=20).
+func (env *Env) getProductHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	objID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID format", http.StatusBadRequest)
+		return
+	}
+	page, _ := strconv.ParseInt(r.URL.Query().Get("page"), 10, 64)
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+	if limit < 1 {
+		limit = 20
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"productId": objID}
+	total, err := env.audit.CountDocuments(ctx, filter)
+	if err != nil {
+		http.Error(w, "Failed to count history", http.StatusInternalServerError)
+		return
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip((page - 1) * limit).
+		SetLimit(limit)
+	cursor, err := env.audit.Find(ctx, filter, opts)
+	if err != nil {
+		http.Error(w, "Failed to fetch history", http.StatusInternalServerError)
+		return
+	}
+	entries := make([]AuditEntry, 0)
+	if err := cursor.All(ctx, &entries); err != nil {
+		http.Error(w, "Failed to decode history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PaginatedAuditResponse{
+		Entries:      entries,
+		CurrentPage:  page,
+		TotalPages:   int64(math.Ceil(float64(total) / float64(limit))),
+		TotalEntries: total,
+	})
+}
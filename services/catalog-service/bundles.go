@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// BundleComponent is one product in a bundle and how many of it the bundle
+// contains.
+type BundleComponent struct {
+	SKU      string `json:"sku" bson:"sku"`
+	Quantity int64  `json:"quantity" bson:"quantity"`
+}
+
+// BundleExpansion records what a bundle order line was expanded into for
+// fulfillment: the components, multiplied by the number of bundles ordered.
+type BundleExpansion struct {
+	SKU        string            `json:"sku" bson:"sku"`
+	Quantity   int64             `json:"quantity" bson:"quantity"`
+	Components []BundleComponent `json:"components" bson:"components"`
+}
+
+// validateBundle checks the components of a product that is about to be
+// written. Components must be existing products that are not bundles
+// themselves, and a bundle can't be a component, so bundles never nest. It
+// writes the error response itself and returns false when the handler should
+// stop.
+func (env *Env) validateBundle(ctx context.Context, w http.ResponseWriter, p *Product) bool {
+	msg, err := env.checkBundle(ctx, p)
+	return writeValidation(w, msg, err)
+}
+
+// checkBundle applies the rules of validateBundle and returns a message
+// describing the first problem.
+func (env *Env) checkBundle(ctx context.Context, p *Product) (string, error) {
+	if len(p.Components) == 0 {
+		p.Components = nil
+		return "", nil
+	}
+
+	seen := make(map[string]bool, len(p.Components))
+	skus := make([]string, 0, len(p.Components))
+	for _, c := range p.Components {
+		switch {
+		case c.SKU == "" || c.Quantity < 1:
+			return "Every component needs a SKU and a positive quantity", nil
+		case c.SKU == p.SKU:
+			return "A bundle can't contain itself", nil
+		case seen[c.SKU]:
+			return fmt.Sprintf("Component %s is listed twice", c.SKU), nil
+		}
+		seen[c.SKU] = true
+		skus = append(skus, c.SKU)
+	}
+
+	cursor, err := env.collection.Find(ctx,
+		bson.M{"sku": bson.M{"$in": skus}, "status": bson.M{"$ne": ProductStatusDeleted}},
+		options.Find().SetProjection(bson.M{"sku": 1, "components": 1}))
+	if err != nil {
+		return "", fmt.Errorf("finding bundle components: %w", err)
+	}
+	var components []Product
+	if err := cursor.All(ctx, &components); err != nil {
+		return "", fmt.Errorf("decoding bundle components: %w", err)
+	}
+	for _, c := range components {
+		if len(c.Components) > 0 {
+			return fmt.Sprintf("Component %s is a bundle itself", c.SKU), nil
+		}
+		delete(seen, c.SKU)
+	}
+	for _, c := range p.Components {
+		if seen[c.SKU] {
+			return fmt.Sprintf("Component %s not found", c.SKU), nil
+		}
+	}
+
+	inBundles, err := env.collection.CountDocuments(ctx,
+		bson.M{"components.sku": p.SKU, "status": bson.M{"$ne": ProductStatusDeleted}},
+		options.Count().SetLimit(1))
+	if err != nil {
+		return "", fmt.Errorf("checking bundles containing %s: %w", p.SKU, err)
+	}
+	if inBundles > 0 {
+		return "A component of another bundle can't be a bundle", nil
+	}
+	return "", nil
+}
+
+// bundleStock is how many of a bundle can be put together from the stock of
+// its components. Untracked components don't limit it, and a component that
+// can no longer be sold makes it unavailable. tracked is false when nothing
+// limits the bundle.
+func bundleStock(components []BundleComponent, stock map[string]int64, sellable map[string]bool) (quantity int64, tracked bool) {
+	for _, c := range components {
+		if !sellable[c.SKU] {
+			return 0, true
+		}
+		available, ok := stock[c.SKU]
+		if !ok {
+			continue
+		}
+		bundles := max(available, 0) / c.Quantity
+		if !tracked || bundles < quantity {
+			quantity = bundles
+		}
+		tracked = true
+	}
+	return quantity, tracked
+}
+
+// sellableSKUs reports which of skus belong to public products.
+func (env *Env) sellableSKUs(ctx context.Context, skus []string) (map[string]bool, error) {
+	cursor, err := env.collection.Find(ctx, bson.M{"sku": bson.M{"$in": skus}},
+		options.Find().SetProjection(bson.M{"sku": 1, "status": 1, "publishAt": 1, "unpublishAt": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var products []Product
+	if err := cursor.All(ctx, &products); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	sellable := make(map[string]bool, len(products))
+	for _, p := range products {
+		sellable[p.SKU] = isPublic(p, now)
+	}
+	return sellable, nil
+}
+
+// expandBundles replaces the bundles among items with their components, so
+// stock is allocated for what is actually shipped.
+func (env *Env) expandBundles(ctx context.Context, items []AllocationItem) ([]AllocationItem, []BundleExpansion, error) {
+	skus := make([]string, len(items))
+	for i, item := range items {
+		skus[i] = item.SKU
+	}
+	cursor, err := env.collection.Find(ctx,
+		bson.M{"sku": bson.M{"$in": skus}, "components.0": bson.M{"$exists": true}},
+		options.Find().SetProjection(bson.M{"sku": 1, "components": 1}))
+	if err != nil {
+		return nil, nil, err
+	}
+	var bundles []Product
+	if err := cursor.All(ctx, &bundles); err != nil {
+		return nil, nil, err
+	}
+	if len(bundles) == 0 {
+		return items, nil, nil
+	}
+	components := make(map[string][]BundleComponent, len(bundles))
+	for _, b := range bundles {
+		components[b.SKU] = b.Components
+	}
+
+	expanded := make([]AllocationItem, 0, len(items))
+	var expansions []BundleExpansion
+	for _, item := range items {
+		parts, ok := components[item.SKU]
+		if !ok {
+			expanded = append(expanded, item)
+			continue
+		}
+		expansion := BundleExpansion{SKU: item.SKU, Quantity: item.Quantity}
+		for _, c := range parts {
+			expanded = append(expanded, AllocationItem{SKU: c.SKU, Quantity: c.Quantity * item.Quantity})
+			expansion.Components = append(expansion.Components, BundleComponent{SKU: c.SKU, Quantity: c.Quantity * item.Quantity})
+		}
+		expansions = append(expansions, expansion)
+	}
+	return expanded, expansions, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestBundleStock(t *testing.T) {
+	components := []BundleComponent{{SKU: "CAM", Quantity: 1}, {SKU: "BAT", Quantity: 2}}
+	allSellable := map[string]bool{"CAM": true, "BAT": true}
+	tests := []struct {
+		name        string
+		stock       map[string]int64
+		sellable    map[string]bool
+		wantQty     int64
+		wantTracked bool
+	}{
+		{
+			name:        "the scarcest component limits the bundle",
+			stock:       map[string]int64{"CAM": 5, "BAT": 7},
+			sellable:    allSellable,
+			wantQty:     3,
+			wantTracked: true,
+		},
+		{
+			name:        "untracked components don't limit it",
+			stock:       map[string]int64{"BAT": 4},
+			sellable:    allSellable,
+			wantQty:     2,
+			wantTracked: true,
+		},
+		{
+			name:     "nothing tracked",
+			stock:    map[string]int64{},
+			sellable: allSellable,
+		},
+		{
+			name:        "a component out of stock",
+			stock:       map[string]int64{"CAM": 0, "BAT": 10},
+			sellable:    allSellable,
+			wantTracked: true,
+		},
+		{
+			name:        "oversold stock counts as none",
+			stock:       map[string]int64{"CAM": -2, "BAT": 10},
+			sellable:    allSellable,
+			wantTracked: true,
+		},
+		{
+			name:        "a component that can't be sold",
+			stock:       map[string]int64{"CAM": 5, "BAT": 10},
+			sellable:    map[string]bool{"CAM": true},
+			wantTracked: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qty, tracked := bundleStock(components, tt.stock, tt.sellable)
+			if qty != tt.wantQty || tracked != tt.wantTracked {
+				t.Errorf("bundleStock = %d, %v; want %d, %v", qty, tracked, tt.wantQty, tt.wantTracked)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Products are cached one by one as their stored document, so every request
+// still prices them with the current exchange rates and sale windows. Listing
+// pages are cached as whole responses under a generation number; every catalog
+// write bumps it, which drops all pages at once.
+const (
+	productCacheTTL = 5 * time.Minute
+	// Sales and publishing windows start and end without a write, so pages
+	// are kept short enough for those to show up within a minute.
+	listingCacheTTL = time.Minute
+
+	productCachePrefix   = "catalog:product:"
+	listingCachePrefix   = "catalog:listing:"
+	listingGenerationKey = "catalog:listing-generation"
+)
+
+// catalogCache is a read-through cache in Redis. Redis is an optimization
+// only: every error is logged and treated as a miss, and a nil cache never
+// hits.
+type catalogCache struct {
+	client *redis.Client
+}
+
+// newCatalogCache connects to Redis with short timeouts, so a slow cache
+// can't slow reads down much.
+func newCatalogCache(addr string) *catalogCache {
+	return &catalogCache{client: redis.NewClient(&redis.Options{
+		Addr:         addr,
+		DialTimeout:  time.Second,
+		ReadTimeout:  200 * time.Millisecond,
+		WriteTimeout: 200 * time.Millisecond,
+	})}
+}
+
+// products returns the cached products among skus, keyed by SKU.
+func (c *catalogCache) products(ctx context.Context, skus []string) map[string]Product {
+	if c == nil || len(skus) == 0 {
+		return nil
+	}
+	keys := make([]string, len(skus))
+	for i, sku := range skus {
+		keys[i] = productCachePrefix + sku
+	}
+	values, err := c.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		log.Printf("Product cache read failed: %v", err)
+		return nil
+	}
+	cached := make(map[string]Product, len(values))
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var p Product
+		if err := bson.Unmarshal([]byte(data), &p); err != nil {
+			log.Printf("Discarding undecodable cache entry for SKU %s: %v", skus[i], err)
+			continue
+		}
+		cached[skus[i]] = p
+	}
+	return cached
+}
+
+// storeProducts caches products as read from MongoDB, before any pricing.
+func (c *catalogCache) storeProducts(ctx context.Context, products []Product) {
+	if c == nil || len(products) == 0 {
+		return
+	}
+	pipe := c.client.Pipeline()
+	for _, p := range products {
+		data, err := bson.Marshal(p)
+		if err != nil {
+			log.Printf("Could not cache product %s: %v", p.SKU, err)
+			continue
+		}
+		pipe.Set(ctx, productCachePrefix+p.SKU, data, productCacheTTL)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Product cache write failed: %v", err)
+	}
+}
+
+// invalidateProducts drops the cached products and every cached page, which
+// may list them.
+func (c *catalogCache) invalidateProducts(ctx context.Context, skus ...string) {
+	if c == nil {
+		return
+	}
+	pipe := c.client.Pipeline()
+	for _, sku := range skus {
+		pipe.Del(ctx, productCachePrefix+sku)
+	}
+	pipe.Incr(ctx, listingGenerationKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		// Entries expire on their own; until then reads may be stale.
+		log.Printf("CRITICAL: product cache invalidation failed for %v: %v", skus, err)
+	}
+}
+
+// invalidateListings drops every cached page, e.g. after the category tree changed.
+func (c *catalogCache) invalidateListings(ctx context.Context) {
+	c.invalidateProducts(ctx)
+}
+
+// listingKey is the cache key of a page: the current generation plus a hash
+// of the normalized query and the exchange rates in use. It is empty when the
+// page can't be cached. The generation must be read before the page is built,
+// so a page built from data older than a write is never stored after it.
+func (c *catalogCache) listingKey(ctx context.Context, query url.Values, ratesUpdatedAt time.Time) string {
+	if c == nil {
+		return ""
+	}
+	generation, err := c.client.Get(ctx, listingGenerationKey).Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		log.Printf("Listing cache read failed: %v", err)
+		return ""
+	}
+	sum := sha256.Sum256([]byte(query.Encode() + "|" + strconv.FormatInt(ratesUpdatedAt.UnixNano(), 10)))
+	return listingCachePrefix + strconv.FormatInt(generation, 10) + ":" + hex.EncodeToString(sum[:16])
+}
+
+// listing returns a cached page body.
+func (c *catalogCache) listing(ctx context.Context, key string) ([]byte, bool) {
+	if c == nil || key == "" {
+		return nil, false
+	}
+	body, err := c.client.Get(ctx, key).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Printf("Listing cache read failed: %v", err)
+		}
+		return nil, false
+	}
+	return body, true
+}
+
+func (c *catalogCache) storeListing(ctx context.Context, key string, body []byte) {
+	if c == nil || key == "" {
+		return
+	}
+	if err := c.client.Set(ctx, key, body, listingCacheTTL).Err(); err != nil {
+		log.Printf("Listing cache write failed: %v", err)
+	}
+}
+
+// bodyETag is a weak ETag derived from a response body.
+func bodyETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// writeJSONBody writes a JSON body with its ETag, or 304 Not Modified when the
+// client already has it.
+func writeJSONBody(w http.ResponseWriter, r *http.Request, body []byte) {
+	etag := bodyETag(body)
+	w.Header().Set("ETag", etag)
+	if ifNoneMatch(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// responseBuffer captures a handler's response so it can be cached.
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{header: make(http.Header), status: http.StatusOK}
+}
+
+func (b *responseBuffer) Header() http.Header         { return b.header }
+func (b *responseBuffer) Write(p []byte) (int, error) { return b.body.Write(p) }
+func (b *responseBuffer) WriteHeader(status int)      { b.status = status }
+
+// copyTo replays the captured response.
+func (b *responseBuffer) copyTo(w http.ResponseWriter) {
+	for key, values := range b.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(b.status)
+	w.Write(b.body.Bytes())
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Category is a node of the managed category tree. Ancestors holds the IDs
+// from the root down to the parent, so a whole subtree is one query away.
+type Category struct {
+	ID        primitive.ObjectID   `json:"id" bson:"_id,omitempty"`
+	Name      string               `json:"name" bson:"name"`
+	Slug      string               `json:"slug" bson:"slug"`
+	ParentID  *primitive.ObjectID  `json:"parentId" bson:"parentId"`
+	Ancestors []primitive.ObjectID `json:"-" bson:"ancestors"`
+	SortOrder int                  `json:"sortOrder" bson:"sortOrder"`
+	// Attributes are the specifications this category adds for its products;
+	// subcategories inherit them.
+	Attributes []AttributeDefinition `json:"attributes,omitempty" bson:"attributes,omitempty"`
+	// Children is only filled in when the tree is returned.
+	Children []*Category `json:"children,omitempty" bson:"-"`
+}
+
+// Breadcrumb is one step of the path from the root category to a product.
+type Breadcrumb struct {
+	ID   primitive.ObjectID `json:"id"`
+	Name string             `json:"name"`
+	Slug string             `json:"slug"`
+}
+
+// slugify turns a name such as "Full-frame Cameras" into "full-frame-cameras".
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(strings.TrimSpace(name)) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// getCategoryTreeHandler returns the whole category tree, each level ordered
+// by sort order and then name.
+func (env *Env) getCategoryTreeHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "sortOrder", Value: 1}, {Key: "name", Value: 1}})
+	cursor, err := env.categories.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		http.Error(w, "Failed to fetch categories", http.StatusInternalServerError)
+		return
+	}
+	var categories []*Category
+	if err := cursor.All(ctx, &categories); err != nil {
+		http.Error(w, "Failed to decode categories", http.StatusInternalServerError)
+		return
+	}
+
+	// The sort above carries over, since children are appended in order.
+	byID := make(map[primitive.ObjectID]*Category, len(categories))
+	for _, c := range categories {
+		byID[c.ID] = c
+	}
+	roots := make([]*Category, 0)
+	for _, c := range categories {
+		if c.ParentID != nil {
+			if parent, ok := byID[*c.ParentID]; ok {
+				parent.Children = append(parent.Children, c)
+				continue
+			}
+		}
+		roots = append(roots, c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(roots)
+}
+
+// getCategoryHandler returns a single category, by ID or slug, with its
+// breadcrumbs and the full attribute schema of its products.
+func (env *Env) getCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	category, err := env.findCategory(ctx, r.PathValue("id"))
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		http.Error(w, "Category not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error finding category: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	breadcrumbs, err := env.categoryBreadcrumbs(ctx, category)
+	if err != nil {
+		log.Printf("Error building breadcrumbs for category %s: %v", category.ID.Hex(), err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	schema, err := env.attributeSchema(ctx, category)
+	if err != nil {
+		log.Printf("Error building attribute schema for category %s: %v", category.ID.Hex(), err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Category
+		Breadcrumbs     []Breadcrumb          `json:"breadcrumbs"`
+		AttributeSchema []AttributeDefinition `json:"attributeSchema"`
+	}{category, breadcrumbs, schema})
+}
+
+// createCategoryHandler adds a category under an optional parent.
+func (env *Env) createCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	var category Category
+	if err := json.NewDecoder(r.Body).Decode(&category); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	category.ID = primitive.NewObjectID()
+	if !env.prepareCategory(ctx, w, &category) {
+		return
+	}
+	if _, err := env.categories.InsertOne(ctx, category); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			http.Error(w, "Category with this slug already exists", http.StatusConflict)
+			return
+		}
+		log.Printf("Error creating category: %v", err)
+		http.Error(w, "Failed to create category", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(category)
+}
+
+// updateCategoryHandler renames, reorders or moves a category (PUT). Moving a
+// category carries its whole subtree along.
+func (env *Env) updateCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	objID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid category ID format", http.StatusBadRequest)
+		return
+	}
+	var updated Category
+	if err := json.NewDecoder(r.Body).Decode(&updated); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var current Category
+	if err := env.categories.FindOne(ctx, bson.M{"_id": objID}).Decode(&current); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Category not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error finding category: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	updated.ID = objID
+	if !env.prepareCategory(ctx, w, &updated) {
+		return
+	}
+	if _, err := env.categories.ReplaceOne(ctx, bson.M{"_id": objID}, updated); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			http.Error(w, "Category with this slug already exists", http.StatusConflict)
+			return
+		}
+		log.Printf("Error updating category: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Re-root the ancestors of every descendant if the category moved.
+	if !equalIDs(current.Ancestors, updated.Ancestors) {
+		if err := env.moveCategorySubtree(ctx, objID, updated.Ancestors); err != nil {
+			log.Printf("Error moving subtree of category %s: %v", objID.Hex(), err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	// Products keep the category name for legacy clients and the brand/category facets.
+	if current.Name != updated.Name {
+		if err := env.renameProductCategory(ctx, objID, updated.Name, userEmail(r)); err != nil {
+			log.Printf("Error renaming category on products: %v", err)
+		}
+	}
+	// Category filters on cached pages may now match other products.
+	env.cache.invalidateListings(ctx)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// renameProductCategory copies a new category name onto its products and
+// records a product.updated event for each of them, made by actor.
+func (env *Env) renameProductCategory(ctx context.Context, categoryID primitive.ObjectID, name, actor string) error {
+	filter := bson.M{"categoryId": categoryID}
+	cursor, err := env.collection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	var products []Product
+	if err := cursor.All(ctx, &products); err != nil {
+		return err
+	}
+	before := make(map[string]Product, len(products))
+	for _, p := range products {
+		before[p.SKU] = p
+	}
+	if _, err := env.collection.UpdateMany(ctx, filter,
+		bson.M{"$set": bson.M{"category": name}, "$inc": bson.M{"version": 1}}); err != nil {
+		return err
+	}
+	env.recordProductChanges(ctx, actor, filter, before)
+	return nil
+}
+
+// deleteCategoryHandler removes a category that has no subcategories and no products.
+func (env *Env) deleteCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	objID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid category ID format", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	children, err := env.categories.CountDocuments(ctx, bson.M{"parentId": objID})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	products, err := env.collection.CountDocuments(ctx, bson.M{"categoryId": objID})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if children > 0 || products > 0 {
+		http.Error(w, "Category still has subcategories or products", http.StatusConflict)
+		return
+	}
+
+	result, err := env.categories.DeleteOne(ctx, bson.M{"_id": objID})
+	if err != nil {
+		log.Printf("Error deleting category: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if result.DeletedCount == 0 {
+		http.Error(w, "Category not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// prepareCategory validates a category about to be written, fills in its slug
+// and ancestors, and makes sure it isn't being moved below itself. It writes the
+// error response itself and returns false when the handler should stop.
+func (env *Env) prepareCategory(ctx context.Context, w http.ResponseWriter, category *Category) bool {
+	category.Name = strings.TrimSpace(category.Name)
+	if category.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return false
+	}
+	if category.Slug == "" {
+		category.Slug = category.Name
+	}
+	category.Slug = slugify(category.Slug)
+	if category.Slug == "" {
+		http.Error(w, "Slug must contain letters or digits", http.StatusBadRequest)
+		return false
+	}
+	if msg := validateAttributeDefinitions(category.Attributes); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return false
+	}
+	category.Children = nil
+	category.Ancestors = []primitive.ObjectID{}
+	if category.ParentID == nil {
+		return true
+	}
+
+	var parent Category
+	if err := env.categories.FindOne(ctx, bson.M{"_id": *category.ParentID}).Decode(&parent); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Parent category not found", http.StatusBadRequest)
+		} else {
+			log.Printf("Error finding parent category: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return false
+	}
+	if parent.ID == category.ID || containsID(parent.Ancestors, category.ID) {
+		http.Error(w, "A category cannot be moved below itself", http.StatusBadRequest)
+		return false
+	}
+	category.Ancestors = append(parent.Ancestors, parent.ID)
+	return true
+}
+
+// moveCategorySubtree rewrites the ancestors of every descendant of id after
+// id itself got the given new ancestors.
+func (env *Env) moveCategorySubtree(ctx context.Context, id primitive.ObjectID, ancestors []primitive.ObjectID) error {
+	cursor, err := env.categories.Find(ctx, bson.M{"ancestors": id})
+	if err != nil {
+		return err
+	}
+	var descendants []Category
+	if err := cursor.All(ctx, &descendants); err != nil {
+		return err
+	}
+	if len(descendants) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, 0, len(descendants))
+	for _, d := range descendants {
+		// Keep the part of the path below the moved category.
+		var below []primitive.ObjectID
+		for i, a := range d.Ancestors {
+			if a == id {
+				below = d.Ancestors[i:]
+				break
+			}
+		}
+		path := append(append([]primitive.ObjectID{}, ancestors...), below...)
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": d.ID}).
+			SetUpdate(bson.M{"$set": bson.M{"ancestors": path}}))
+	}
+	_, err = env.categories.BulkWrite(ctx, models)
+	return err
+}
+
+// findCategory looks a category up by ObjectID hex or by slug.
+func (env *Env) findCategory(ctx context.Context, idOrSlug string) (Category, error) {
+	filter := bson.M{"slug": slugify(idOrSlug)}
+	if objID, err := primitive.ObjectIDFromHex(idOrSlug); err == nil {
+		filter = bson.M{"_id": objID}
+	}
+	var category Category
+	err := env.categories.FindOne(ctx, filter).Decode(&category)
+	return category, err
+}
+
+// categoryBreadcrumbs returns the path from the root down to category itself.
+func (env *Env) categoryBreadcrumbs(ctx context.Context, category Category) ([]Breadcrumb, error) {
+	path := make([]Breadcrumb, 0, len(category.Ancestors)+1)
+	if len(category.Ancestors) > 0 {
+		cursor, err := env.categories.Find(ctx, bson.M{"_id": bson.M{"$in": category.Ancestors}})
+		if err != nil {
+			return nil, err
+		}
+		var ancestors []Category
+		if err := cursor.All(ctx, &ancestors); err != nil {
+			return nil, err
+		}
+		byID := make(map[primitive.ObjectID]Category, len(ancestors))
+		for _, a := range ancestors {
+			byID[a.ID] = a
+		}
+		for _, id := range category.Ancestors {
+			if a, ok := byID[id]; ok {
+				path = append(path, Breadcrumb{ID: a.ID, Name: a.Name, Slug: a.Slug})
+			}
+		}
+	}
+	return append(path, Breadcrumb{ID: category.ID, Name: category.Name, Slug: category.Slug}), nil
+}
+
+// productBreadcrumbs fills in the breadcrumbs of a product that references a
+// category. They are a nicety, so a failure is only logged.
+func (env *Env) productBreadcrumbs(ctx context.Context, p *Product) {
+	if p.CategoryID == nil {
+		return
+	}
+	var category Category
+	if err := env.categories.FindOne(ctx, bson.M{"_id": *p.CategoryID}).Decode(&category); err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			log.Printf("Error finding category of product %s: %v", p.SKU, err)
+		}
+		return
+	}
+	breadcrumbs, err := env.categoryBreadcrumbs(ctx, category)
+	if err != nil {
+		log.Printf("Error building breadcrumbs for product %s: %v", p.SKU, err)
+		return
+	}
+	p.Breadcrumbs = breadcrumbs
+}
+
+// categoryFilter matches products in any of the given categories, including
+// their descendants. Values may be category IDs, slugs or, for products not yet
+// placed in the tree, legacy free-text category names.
+func (env *Env) categoryFilter(ctx context.Context, values []string) (bson.M, error) {
+	ids, slugs := bson.A{}, bson.A{}
+	for _, v := range values {
+		if objID, err := primitive.ObjectIDFromHex(v); err == nil {
+			ids = append(ids, objID)
+		} else {
+			slugs = append(slugs, slugify(v))
+		}
+	}
+
+	cursor, err := env.categories.Find(ctx, bson.M{"$or": bson.A{
+		bson.M{"_id": bson.M{"$in": ids}},
+		bson.M{"slug": bson.M{"$in": slugs}},
+	}}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var roots []Category
+	if err := cursor.All(ctx, &roots); err != nil {
+		return nil, err
+	}
+	matched := make(bson.A, 0, len(roots))
+	for _, c := range roots {
+		matched = append(matched, c.ID)
+	}
+
+	// Every category whose path runs through one of the matched ones.
+	subtree := matched
+	if len(matched) > 0 {
+		cursor, err = env.categories.Find(ctx, bson.M{"ancestors": bson.M{"$in": matched}},
+			options.Find().SetProjection(bson.M{"_id": 1}))
+		if err != nil {
+			return nil, err
+		}
+		var descendants []Category
+		if err := cursor.All(ctx, &descendants); err != nil {
+			return nil, err
+		}
+		for _, c := range descendants {
+			subtree = append(subtree, c.ID)
+		}
+	}
+
+	return bson.M{"$or": bson.A{
+		bson.M{"categoryId": bson.M{"$in": subtree}},
+		bson.M{"category": bson.M{"$in": values}},
+	}}, nil
+}
+
+// resolveProductCategory checks the category a product references and copies
+// its name into the legacy category field. Products that only name a category
+// are linked to the category with the matching slug, if there is one. It writes
+// the error response itself and returns false when the handler should stop.
+func (env *Env) resolveProductCategory(ctx context.Context, w http.ResponseWriter, p *Product) bool {
+	msg, err := env.checkProductCategory(ctx, p)
+	return writeValidation(w, msg, err)
+}
+
+// checkProductCategory applies the rules of resolveProductCategory and
+// returns a message describing the problem.
+func (env *Env) checkProductCategory(ctx context.Context, p *Product) (string, error) {
+	var category Category
+	if p.CategoryID == nil {
+		if slugify(p.Category) == "" {
+			return "", nil
+		}
+		err := env.categories.FindOne(ctx, bson.M{"slug": slugify(p.Category)}).Decode(&category)
+		if err == nil {
+			p.CategoryID = &category.ID
+		} else if !errors.Is(err, mongo.ErrNoDocuments) {
+			log.Printf("Error finding category: %v", err)
+		}
+		return "", nil
+	}
+	if err := env.categories.FindOne(ctx, bson.M{"_id": *p.CategoryID}).Decode(&category); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return "Category not found", nil
+		}
+		return "", fmt.Errorf("finding category: %w", err)
+	}
+	p.Category = category.Name
+	return "", nil
+}
+
+// migrateCategories places products that only have a free-text category into
+// the tree, creating a top-level category for every name not seen before.
+func migrateCategories(ctx context.Context, categories, products *mongo.Collection) (int64, error) {
+	names, err := products.Distinct(ctx, "category", bson.M{
+		"categoryId": bson.M{"$exists": false},
+		"category":   bson.M{"$nin": bson.A{"", nil}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i].(string) < names[j].(string) })
+
+	var migrated int64
+	for _, value := range names {
+		name := value.(string)
+		slug := slugify(name)
+		if slug == "" {
+			continue
+		}
+		var category Category
+		err := categories.FindOneAndUpdate(ctx,
+			bson.M{"slug": slug},
+			bson.M{"$setOnInsert": bson.M{"name": name, "parentId": nil, "ancestors": bson.A{}, "sortOrder": 0}},
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+		).Decode(&category)
+		if err != nil {
+			return migrated, err
+		}
+		result, err := products.UpdateMany(ctx,
+			bson.M{"category": name, "categoryId": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"categoryId": category.ID}},
+		)
+		if err != nil {
+			return migrated, err
+		}
+		migrated += result.ModifiedCount
+	}
+	return migrated, nil
+}
+
+func containsID(ids []primitive.ObjectID, id primitive.ObjectID) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func equalIDs(a, b []primitive.ObjectID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// productETag is the entity tag of a product. It changes whenever the version does.
+func productETag(product Product) string {
+	return fmt.Sprintf(`"%s-%d"`, product.ID.Hex(), product.Version)
+}
+
+// ifMatchSatisfied reports whether the request's If-Match header (if any)
+// matches the current state of the product. A missing header always matches.
+// If-Match uses strong comparison, so weak tags never match.
+func ifMatchSatisfied(r *http.Request, product Product) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	current := productETag(product)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == current || isDetailETagOf(tag, current) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDetailETagOf reports whether tag is a tag detailETag made from etag. The
+// digest only covers fields resolved at read time, which writes don't depend
+// on, so any well-formed digest of the current version matches.
+func isDetailETagOf(tag, etag string) bool {
+	prefix := strings.TrimSuffix(etag, `"`) + "."
+	digest, ok := strings.CutPrefix(tag, prefix)
+	if !ok {
+		return false
+	}
+	digest, ok = strings.CutSuffix(digest, `"`)
+	if !ok || len(digest) != 2*detailDigestSize {
+		return false
+	}
+	_, err := hex.DecodeString(digest)
+	return err == nil
+}
+
+// detailETag adds a digest of the response body to a product ETag. Ratings,
+// breadcrumbs and sale prices are resolved at read time and can change
+// without a new version; the digest makes sure If-None-Match notices.
+func detailETag(etag string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return strings.TrimSuffix(etag, `"`) + "." + hex.EncodeToString(sum[:detailDigestSize]) + `"`
+}
+
+// detailDigestSize is how many bytes of the body's hash a detail ETag carries.
+const detailDigestSize = 6
+
+// ifNoneMatch reports whether the request's If-None-Match header matches etag,
+// meaning the client's copy is current. Comparison is weak, as for any GET.
+func ifNoneMatch(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// versionFilter matches a product only while it is still at the given version.
+// Documents written before versioning existed have no version field at all.
+func versionFilter(id primitive.ObjectID, version int64) bson.M {
+	if version == 0 {
+		return bson.M{"_id": id, "$or": bson.A{
+			bson.M{"version": bson.M{"$exists": false}},
+			bson.M{"version": 0},
+		}}
+	}
+	return bson.M{"_id": id, "version": version}
+}
+
+// applyMergePatch applies a JSON Merge Patch (RFC 7396) to a JSON document.
+func applyMergePatch(original, patch []byte) ([]byte, error) {
+	var target, patchValue interface{}
+	if err := json.Unmarshal(original, &target); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, &patchValue); err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergePatchValue(target, patchValue))
+}
+
+func mergePatchValue(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		// Anything that isn't an object replaces the target wholesale.
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+		targetObject[key] = mergePatchValue(targetObject[key], value)
+	}
+	return targetObject
+}
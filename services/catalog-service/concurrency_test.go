@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// The cases follow the examples of RFC 7396, appendix A.
+func TestApplyMergePatch(t *testing.T) {
+	tests := []struct {
+		original, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, tt := range tests {
+		got, err := applyMergePatch([]byte(tt.original), []byte(tt.patch))
+		if err != nil {
+			t.Errorf("applyMergePatch(%s, %s): %v", tt.original, tt.patch, err)
+			continue
+		}
+		var gotValue, wantValue interface{}
+		if err := json.Unmarshal(got, &gotValue); err != nil {
+			t.Fatalf("applyMergePatch(%s, %s) returned invalid JSON %s", tt.original, tt.patch, got)
+		}
+		if err := json.Unmarshal([]byte(tt.want), &wantValue); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(gotValue, wantValue) {
+			t.Errorf("applyMergePatch(%s, %s) = %s, want %s", tt.original, tt.patch, got, tt.want)
+		}
+	}
+}
+
+func TestApplyMergePatchInvalidJSON(t *testing.T) {
+	if _, err := applyMergePatch([]byte(`{"a":`), []byte(`{}`)); err == nil {
+		t.Error("invalid original accepted")
+	}
+	if _, err := applyMergePatch([]byte(`{}`), []byte(`{"a"`)); err == nil {
+		t.Error("invalid patch accepted")
+	}
+}
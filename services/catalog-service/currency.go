@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"three-tier-cloud-shop/money"
+)
+
+// exchangeRateRefreshInterval is how often each replica reloads the rate table,
+// so changes made through the admin endpoint reach every replica.
+const exchangeRateRefreshInterval = time.Minute
+
+// exchangeRatesDocID is the _id of the single document holding the current rates.
+const exchangeRatesDocID = "current"
+
+// errUnsupportedCurrency is returned when a price can't be expressed in the
+// requested currency: no explicit price and no exchange rate.
+var errUnsupportedCurrency = errors.New("currency is not supported")
+
+// ExchangeRates converts between currencies through a common base currency.
+// Rates are decimal strings ("0.92" EUR per 1 USD) so they stay exact.
+type ExchangeRates struct {
+	Base      string            `json:"base" bson:"base"`
+	Rates     map[string]string `json:"rates" bson:"rates"`
+	UpdatedAt time.Time         `json:"updatedAt" bson:"updatedAt"`
+}
+
+// exchangeRateTable is the in-memory copy of the rates used on every read.
+type exchangeRateTable struct {
+	mu         sync.RWMutex
+	current    ExchangeRates
+	parsed     map[string]*big.Rat
+	collection *mongo.Collection
+}
+
+func newExchangeRateTable(collection *mongo.Collection) *exchangeRateTable {
+	return &exchangeRateTable{collection: collection, parsed: map[string]*big.Rat{}}
+}
+
+// validateExchangeRates normalizes the currencies and parses every rate.
+func validateExchangeRates(rates *ExchangeRates) (map[string]*big.Rat, error) {
+	rates.Base = money.NormalizeCurrency(rates.Base)
+	parsed := map[string]*big.Rat{rates.Base: big.NewRat(1, 1)}
+	normalized := make(map[string]string, len(rates.Rates))
+	for currency, value := range rates.Rates {
+		rate, ok := new(big.Rat).SetString(value)
+		if !ok || rate.Sign() <= 0 {
+			return nil, fmt.Errorf("rate for %s must be a positive decimal, got %q", currency, value)
+		}
+		currency = money.NormalizeCurrency(currency)
+		normalized[currency] = value
+		parsed[currency] = rate
+	}
+	rates.Rates = normalized
+	return parsed, nil
+}
+
+// load reads the current rates from MongoDB. A missing document leaves the
+// table empty, which simply means no conversions are possible.
+func (t *exchangeRateTable) load(ctx context.Context) error {
+	var rates ExchangeRates
+	err := t.collection.FindOne(ctx, bson.M{"_id": exchangeRatesDocID}).Decode(&rates)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	parsed, err := validateExchangeRates(&rates)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.current, t.parsed = rates, parsed
+	t.mu.Unlock()
+	return nil
+}
+
+// save validates and stores new rates, then makes them current on this replica.
+func (t *exchangeRateTable) save(ctx context.Context, rates ExchangeRates) (ExchangeRates, error) {
+	parsed, err := validateExchangeRates(&rates)
+	if err != nil {
+		return ExchangeRates{}, err
+	}
+	rates.UpdatedAt = time.Now()
+	_, err = t.collection.ReplaceOne(ctx, bson.M{"_id": exchangeRatesDocID}, rates, options.Replace().SetUpsert(true))
+	if err != nil {
+		return ExchangeRates{}, err
+	}
+	t.mu.Lock()
+	t.current, t.parsed = rates, parsed
+	t.mu.Unlock()
+	return rates, nil
+}
+
+// loadFile seeds the rates from a JSON file in the ExchangeRates shape.
+func (t *exchangeRateTable) loadFile(ctx context.Context, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var rates ExchangeRates
+	if err := json.Unmarshal(data, &rates); err != nil {
+		return fmt.Errorf("invalid exchange rate file: %w", err)
+	}
+	_, err = t.save(ctx, rates)
+	return err
+}
+
+// refreshLoop reloads the rates periodically until ctx is cancelled.
+func (t *exchangeRateTable) refreshLoop(ctx context.Context) {
+	ticker := time.NewTicker(exchangeRateRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := t.load(ctx); err != nil {
+				log.Printf("Failed to refresh exchange rates: %v", err)
+			}
+		}
+	}
+}
+
+// snapshot returns a copy of the current rates.
+func (t *exchangeRateTable) snapshot() ExchangeRates {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.current
+}
+
+// supports reports whether amounts can be converted to currency.
+func (t *exchangeRateTable) supports(currency string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, ok := t.parsed[money.NormalizeCurrency(currency)]
+	return ok
+}
+
+// convert expresses m in another currency, rounding half away from zero to the
+// target's minor unit.
+func (t *exchangeRateTable) convert(m money.Money, currency string) (money.Money, error) {
+	currency = money.NormalizeCurrency(currency)
+	if m.Currency == currency {
+		return m, nil
+	}
+	t.mu.RLock()
+	fromRate, fromOK := t.parsed[m.Currency]
+	toRate, toOK := t.parsed[currency]
+	t.mu.RUnlock()
+	if !fromOK || !toOK {
+		return money.Money{}, fmt.Errorf("%w: %s", errUnsupportedCurrency, currency)
+	}
+
+	// amount / 10^fromExp / fromRate * toRate * 10^toExp
+	value := new(big.Rat).SetFrac(big.NewInt(m.Amount), pow10(money.Exponent(m.Currency)))
+	value.Quo(value, fromRate)
+	value.Mul(value, toRate)
+	value.Mul(value, new(big.Rat).SetInt(pow10(money.Exponent(currency))))
+	return money.Money{Amount: roundRat(value), Currency: currency}, nil
+}
+
+func pow10(exp int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exp)), nil)
+}
+
+// roundRat rounds to the nearest integer, halves away from zero.
+func roundRat(r *big.Rat) int64 {
+	num, denom := r.Num(), r.Denom()
+	quo, rem := new(big.Int).QuoRem(num, denom, new(big.Int))
+	if new(big.Int).Mul(new(big.Int).Abs(rem), big.NewInt(2)).Cmp(denom) >= 0 {
+		if num.Sign() < 0 {
+			quo.Sub(quo, big.NewInt(1))
+		} else {
+			quo.Add(quo, big.NewInt(1))
+		}
+	}
+	return quo.Int64()
+}
+
+// priceProducts resolves the effective price of every product and expresses
+// all amounts in the requested currency. An empty currency keeps each
+// product's own currency.
+func (env *Env) priceProducts(products []Product, currency string) error {
+	now := time.Now()
+	for i := range products {
+		if err := env.priceProduct(&products[i], currency, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// priceProduct prefers an explicit price from the product's price list and
+// falls back to converting with the exchange rates.
+func (env *Env) priceProduct(p *Product, currency string, now time.Time) error {
+	if currency != "" && money.NormalizeCurrency(currency) != p.Price.Currency {
+		currency = money.NormalizeCurrency(currency)
+		if listed, ok := p.Prices[currency]; ok {
+			// An explicit price list entry replaces the regular price; a sale
+			// keeps the same discount ratio against it.
+			if p.SalePrice != nil {
+				ratio := new(big.Rat).SetFrac(big.NewInt(p.SalePrice.Amount), big.NewInt(p.Price.Amount))
+				salePrice := money.Money{Amount: roundRat(ratio.Mul(ratio, new(big.Rat).SetInt64(listed.Amount))), Currency: currency}
+				p.SalePrice = &salePrice
+			}
+			p.Price = listed
+		} else {
+			converted, err := env.rates.convert(p.Price, currency)
+			if err != nil {
+				return err
+			}
+			if p.SalePrice != nil {
+				salePrice, err := env.rates.convert(*p.SalePrice, currency)
+				if err != nil {
+					return err
+				}
+				p.SalePrice = &salePrice
+			}
+			p.Price = converted
+		}
+	}
+	p.resolvePricing(now)
+	return nil
+}
+
+// localizedETag is the product's ETag, made weak and specific to the currency
+// and the rates in effect when a price was converted. It can't be used with
+// If-Match, which needs the product's own ETag.
+func (env *Env) localizedETag(p Product, currency string) string {
+	if currency == "" {
+		return productETag(p)
+	}
+	etag := strings.Trim(productETag(p), `"`)
+	updatedAt := env.rates.snapshot().UpdatedAt.Unix()
+	return fmt.Sprintf(`W/"%s-%s-%d"`, etag, money.NormalizeCurrency(currency), updatedAt)
+}
+
+// getExchangeRatesHandler returns the current exchange rate table.
+func (env *Env) getExchangeRatesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(env.rates.snapshot())
+}
+
+// putExchangeRatesHandler replaces the exchange rate table.
+// Body: {"base": "USD", "rates": {"EUR": "0.92", "GBP": "0.79"}}.
+func (env *Env) putExchangeRatesHandler(w http.ResponseWriter, r *http.Request) {
+	var rates ExchangeRates
+	if err := json.NewDecoder(r.Body).Decode(&rates); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	saved, err := env.rates.save(ctx, rates)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(saved)
+}
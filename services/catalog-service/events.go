@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// catalogExchange is the topic exchange product events are published to,
+// with the event type as routing key (bind "product.*" to get them all).
+// Inventory events go to the same exchange as "inventory.*".
+const catalogExchange = "catalog_exchange"
+
+// Product event types.
+const (
+	EventProductCreated = "product.created"
+	EventProductUpdated = "product.updated"
+	EventProductDeleted = "product.deleted"
+)
+
+// outboxRelayInterval is how often the relay looks for unpublished events.
+const outboxRelayInterval = time.Second
+
+// outboxBatchSize caps how many events the relay publishes per pass.
+const outboxBatchSize = 100
+
+// outboxRetention is how long published events are kept for troubleshooting.
+const outboxRetention = 7 * 24 * time.Hour
+
+// ProductEvent is the message body of every product event. Product is the
+// state after the change; Previous holds the old value of each changed field
+// when it is known. Delivery is at-least-once, so consumers dedupe on EventID.
+type ProductEvent struct {
+	EventID       string                     `json:"eventId"`
+	Type          string                     `json:"type"`
+	OccurredAt    time.Time                  `json:"occurredAt"`
+	ProductID     string                     `json:"productId"`
+	SKU           string                     `json:"sku"`
+	Version       int64                      `json:"version"`
+	ChangedFields []string                   `json:"changedFields,omitempty"`
+	Previous      map[string]json.RawMessage `json:"previous,omitempty"`
+	Product       Product                    `json:"product"`
+}
+
+// OutboxEvent is an event waiting in the outbox to be published.
+type OutboxEvent struct {
+	ID          primitive.ObjectID `bson:"_id"`
+	RoutingKey  string             `bson:"routingKey"`
+	Body        []byte             `bson:"body"`
+	CreatedAt   time.Time          `bson:"createdAt"`
+	PublishedAt *time.Time         `bson:"publishedAt,omitempty"`
+	// SKUs are the product's SKUs before and after the change, whose cached
+	// copies the write made stale.
+	SKUs []string `bson:"-"`
+}
+
+// eventIgnoredFields are resolved at read time or only bookkeeping, so they
+// never count as changes on their own.
+var eventIgnoredFields = map[string]bool{
+	"version":        true,
+	"effectivePrice": true,
+	"onSale":         true,
+	"breadcrumbs":    true,
+	"stockQuantity":  true,
+	"inStock":        true,
+}
+
+// newProductEvent builds the outbox entry for a product change. With a
+// previous state the changed fields are worked out by comparing the two;
+// otherwise the caller names them.
+func newProductEvent(eventType string, before *Product, after Product, fields ...string) OutboxEvent {
+	id := primitive.NewObjectID()
+	after.resolvePricing(time.Now())
+	event := ProductEvent{
+		EventID:       id.Hex(),
+		Type:          eventType,
+		OccurredAt:    time.Now().UTC(),
+		ProductID:     after.ID.Hex(),
+		SKU:           after.SKU,
+		Version:       after.Version,
+		ChangedFields: fields,
+		Product:       after,
+	}
+	if before != nil {
+		// Resolve both states the same way, so derived fields only differ
+		// when the product did.
+		previous := *before
+		previous.resolvePricing(time.Now())
+		event.ChangedFields, event.Previous = productChanges(previous, after)
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		// Products always encode; this would be a programming error.
+		log.Printf("Error encoding %s event for %s: %v", eventType, after.SKU, err)
+	}
+	skus := []string{after.SKU}
+	if before != nil && before.SKU != after.SKU {
+		skus = append(skus, before.SKU)
+	}
+	return OutboxEvent{ID: id, RoutingKey: eventType, Body: body, CreatedAt: event.OccurredAt, SKUs: skus}
+}
+
+// productChanges compares the JSON form of two product states field by field.
+func productChanges(before, after Product) ([]string, map[string]json.RawMessage) {
+	var old, updated map[string]json.RawMessage
+	beforeJSON, _ := json.Marshal(before)
+	afterJSON, _ := json.Marshal(after)
+	json.Unmarshal(beforeJSON, &old)
+	json.Unmarshal(afterJSON, &updated)
+
+	var fields []string
+	previous := make(map[string]json.RawMessage)
+	for key, value := range updated {
+		if eventIgnoredFields[key] || bytes.Equal(old[key], value) {
+			continue
+		}
+		fields = append(fields, key)
+		if oldValue, ok := old[key]; ok {
+			previous[key] = oldValue
+		}
+	}
+	for key, value := range old {
+		if _, ok := updated[key]; !ok && !eventIgnoredFields[key] {
+			fields = append(fields, key)
+			previous[key] = value
+		}
+	}
+	sort.Strings(fields)
+	return fields, previous
+}
+
+// writeWithEvents runs a product write made by actor and records the events
+// it returns in the outbox and the audit trail. On a replica set all of it
+// happens in one transaction, so an event is recorded if and only if the
+// write happened. A standalone server has no transactions; the events are
+// then recorded right after the write.
+func (env *Env) writeWithEvents(ctx context.Context, actor string, write func(ctx context.Context) ([]OutboxEvent, error)) error {
+	if !env.transactions {
+		events, err := write(ctx)
+		if err != nil {
+			return err
+		}
+		env.recordEvents(ctx, actor, events)
+		return nil
+	}
+
+	session, err := env.collection.Database().Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+	var events []OutboxEvent
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		var err error
+		events, err = write(sc)
+		if err != nil || len(events) == 0 {
+			return nil, err
+		}
+		if _, err = env.outbox.InsertMany(sc, outboxDocuments(events)); err != nil {
+			return nil, err
+		}
+		_, err = env.audit.InsertMany(sc, auditEntries(events, actor))
+		return nil, err
+	})
+	if err != nil {
+		return err
+	}
+	env.invalidateCache(ctx, events)
+	return nil
+}
+
+// recordEvents adds events to the outbox and the audit trail outside of a
+// transaction. The write they describe already happened, so a failure can
+// only be logged.
+func (env *Env) recordEvents(ctx context.Context, actor string, events []OutboxEvent) {
+	if len(events) == 0 {
+		return
+	}
+	if _, err := env.outbox.InsertMany(ctx, outboxDocuments(events)); err != nil {
+		log.Printf("CRITICAL: failed to record %d product events: %v", len(events), err)
+	}
+	if _, err := env.audit.InsertMany(ctx, auditEntries(events, actor)); err != nil {
+		log.Printf("CRITICAL: failed to audit %d product changes by %s: %v", len(events), actor, err)
+	}
+	env.invalidateCache(ctx, events)
+}
+
+// invalidateCache drops the cached copies of the products events describe.
+func (env *Env) invalidateCache(ctx context.Context, events []OutboxEvent) {
+	if len(events) == 0 {
+		return
+	}
+	var skus []string
+	for _, e := range events {
+		skus = append(skus, e.SKUs...)
+	}
+	env.cache.invalidateProducts(ctx, skus...)
+}
+
+// recordProductChanges records events for the products matching filter after
+// a multi-document write, comparing each with its state before the write.
+// Products missing from before were created by it.
+func (env *Env) recordProductChanges(ctx context.Context, actor string, filter bson.M, before map[string]Product) {
+	cursor, err := env.collection.Find(ctx, filter)
+	if err != nil {
+		log.Printf("CRITICAL: failed to load changed products for events: %v", err)
+		return
+	}
+	var products []Product
+	if err := cursor.All(ctx, &products); err != nil {
+		log.Printf("CRITICAL: failed to load changed products for events: %v", err)
+		return
+	}
+	var events []OutboxEvent
+	for _, p := range products {
+		if previous, ok := before[p.SKU]; ok {
+			events = append(events, newProductEvent(EventProductUpdated, &previous, p))
+		} else {
+			events = append(events, newProductEvent(EventProductCreated, nil, p))
+		}
+	}
+	env.recordEvents(ctx, actor, events)
+}
+
+func outboxDocuments(events []OutboxEvent) []interface{} {
+	docs := make([]interface{}, len(events))
+	for i, e := range events {
+		docs[i] = e
+	}
+	return docs
+}
+
+// supportsTransactions reports whether the server is a replica set member or
+// a mongos, the deployments that support multi-document transactions.
+func supportsTransactions(ctx context.Context, client *mongo.Client) bool {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		log.Printf("Could not detect transaction support: %v", err)
+		return false
+	}
+	return hello.SetName != "" || hello.Msg == "isdbgrid"
+}
+
+// runOutboxRelay publishes outbox events to RabbitMQ in the order they were
+// recorded, reconnecting whenever the connection drops.
+func (env *Env) runOutboxRelay(ctx context.Context, amqpURL string) {
+	for {
+		if err := env.relayOutbox(ctx, amqpURL); err != nil {
+			log.Printf("Outbox relay stopped: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(amqpReconnectDelay):
+		}
+	}
+}
+
+func (env *Env) relayOutbox(ctx context.Context, amqpURL string) error {
+	conn, err := amqp.Dial(amqpURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	// Publisher confirms: an event is only marked published once the broker has it.
+	if err := ch.Confirm(false); err != nil {
+		return err
+	}
+	if err := ch.ExchangeDeclare(catalogExchange, "topic", true, false, false, false, nil); err != nil {
+		return err
+	}
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	ticker := time.NewTicker(outboxRelayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-closed:
+			return err
+		case <-ticker.C:
+			if err := env.publishPendingEvents(ctx, ch); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// publishPendingEvents publishes one batch of unpublished events. It stops at
+// the first failure so events of a product are never delivered out of order.
+func (env *Env) publishPendingEvents(ctx context.Context, ch *amqp.Channel) error {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(outboxBatchSize)
+	cursor, err := env.outbox.Find(ctx, bson.M{"publishedAt": bson.M{"$exists": false}}, opts)
+	if err != nil {
+		return err
+	}
+	var events []OutboxEvent
+	if err := cursor.All(ctx, &events); err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		publishCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		confirmation, err := ch.PublishWithDeferredConfirmWithContext(publishCtx, catalogExchange, event.RoutingKey, false, false,
+			amqp.Publishing{
+				ContentType:  "application/json",
+				DeliveryMode: amqp.Persistent,
+				MessageId:    event.ID.Hex(),
+				Timestamp:    event.CreatedAt,
+				Type:         event.RoutingKey,
+				Body:         event.Body,
+			})
+		if err == nil {
+			var acked bool
+			acked, err = confirmation.WaitContext(publishCtx)
+			if err == nil && !acked {
+				err = errors.New("broker rejected event " + event.ID.Hex())
+			}
+		}
+		cancel()
+		if err != nil {
+			return err
+		}
+		if _, err := env.outbox.UpdateByID(ctx, event.ID, bson.M{"$set": bson.M{"publishedAt": time.Now()}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
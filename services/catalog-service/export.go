@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// exportFlushEvery controls how often a streaming export flushes to the client.
+const exportFlushEvery = 500
+
+// productExporter writes products one at a time in a specific format.
+type productExporter interface {
+	begin() error
+	write(product Product) error
+	end() error
+}
+
+// exportProductsHandler streams the whole catalog straight from a Mongo cursor,
+// so memory use stays flat no matter how large the catalog is.
+// Supported formats are csv, jsonl and feed-xml (a Google-Shopping-style RSS feed).
+// Every format exports the public products (active and published) by default;
+// "status" selects other states instead, e.g. status=draft,archived, and
+// status=all exports every product, deleted ones included.
+// With "currency" every price is exported in that currency, e.g. for an EU feed.
+func (env *Env) exportProductsHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "jsonl"
+	}
+
+	filter, err := exportFilter(r.URL.Query().Get("status"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var exporter productExporter
+	var contentType, extension string
+	switch format {
+	case "csv":
+		exporter, contentType, extension = newCSVExporter(w), "text/csv; charset=utf-8", "csv"
+	case "jsonl":
+		exporter, contentType, extension = &jsonLinesExporter{encoder: json.NewEncoder(w)}, "application/x-ndjson", "jsonl"
+	case "feed-xml":
+		exporter, contentType, extension = newFeedExporter(w), "application/xml; charset=utf-8", "xml"
+	default:
+		http.Error(w, "Unsupported export format, use csv, jsonl or feed-xml", http.StatusBadRequest)
+		return
+	}
+
+	currency := r.URL.Query().Get("currency")
+	if currency != "" && !env.rates.supports(currency) {
+		http.Error(w, errUnsupportedCurrency.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Minute)
+	defer cancel()
+
+	cursor, err := env.collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "sku", Value: 1}}))
+	if err != nil {
+		http.Error(w, "Failed to fetch products", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	filename := fmt.Sprintf("products-%s.%s", time.Now().UTC().Format("20060102-150405"), extension)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	// Once streaming has started the status code is already sent, so errors can
+	// only be logged and the response cut short.
+	if err := env.streamProducts(ctx, cursor, exporter, w, currency); err != nil {
+		log.Printf("Export (%s) aborted: %v", format, err)
+	}
+}
+
+// exportFilter turns the "status" parameter of an export into a filter.
+func exportFilter(statusQuery string) (bson.M, error) {
+	switch statusQuery {
+	case "":
+		return publicProductFilter(), nil
+	case "all":
+		return bson.M{}, nil
+	}
+	statuses := strings.Split(statusQuery, ",")
+	for _, status := range statuses {
+		if !isEditableProductStatus(status) && status != ProductStatusDeleted {
+			return nil, fmt.Errorf("unknown status %q, use draft, active, archived, deleted or all", status)
+		}
+	}
+	return bson.M{"status": bson.M{"$in": statuses}}, nil
+}
+
+func (env *Env) streamProducts(ctx context.Context, cursor *mongo.Cursor, exporter productExporter, w http.ResponseWriter, currency string) error {
+	flusher, _ := w.(http.Flusher)
+	if err := exporter.begin(); err != nil {
+		return err
+	}
+	count := 0
+	for cursor.Next(ctx) {
+		var product Product
+		if err := cursor.Decode(&product); err != nil {
+			return fmt.Errorf("failed to decode product: %w", err)
+		}
+		if err := env.priceProduct(&product, currency, time.Now()); err != nil {
+			return fmt.Errorf("failed to price product %s: %w", product.SKU, err)
+		}
+		if err := exporter.write(product); err != nil {
+			return err
+		}
+		count++
+		if count%exportFlushEvery == 0 && flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	return exporter.end()
+}
+
+// --- CSV ---
+
+var csvExportHeader = []string{"id", "sku", "name", "description", "price", "effectivePrice", "currency", "brand", "category", "status", "imageUrl"}
+
+type csvExporter struct {
+	writer *csv.Writer
+}
+
+func newCSVExporter(w http.ResponseWriter) *csvExporter {
+	return &csvExporter{writer: csv.NewWriter(w)}
+}
+
+func (e *csvExporter) begin() error {
+	return e.writer.Write(csvExportHeader)
+}
+
+func (e *csvExporter) write(product Product) error {
+	return e.writer.Write([]string{
+		product.ID.Hex(),
+		product.SKU,
+		product.Name,
+		product.Description,
+		product.Price.String(),
+		product.EffectivePrice.String(),
+		product.Currency,
+		product.Brand,
+		product.Category,
+		product.Status,
+		primaryImageURL(product),
+	})
+}
+
+func (e *csvExporter) end() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+// --- JSON Lines ---
+
+type jsonLinesExporter struct {
+	encoder *json.Encoder
+}
+
+func (e *jsonLinesExporter) begin() error { return nil }
+
+func (e *jsonLinesExporter) write(product Product) error {
+	return e.encoder.Encode(product)
+}
+
+func (e *jsonLinesExporter) end() error { return nil }
+
+// --- Shopping feed (RSS 2.0 with the Google "g:" namespace) ---
+
+type feedItem struct {
+	XMLName      xml.Name `xml:"item"`
+	ID           string   `xml:"g:id"`
+	Title        string   `xml:"title"`
+	Description  string   `xml:"description"`
+	Link         string   `xml:"link"`
+	ImageLink    string   `xml:"g:image_link,omitempty"`
+	Price        string   `xml:"g:price"`
+	SalePrice    string   `xml:"g:sale_price,omitempty"`
+	SaleDates    string   `xml:"g:sale_price_effective_date,omitempty"`
+	Availability string   `xml:"g:availability"`
+	Condition    string   `xml:"g:condition"`
+	Brand        string   `xml:"g:brand,omitempty"`
+	ProductType  string   `xml:"g:product_type,omitempty"`
+}
+
+type feedExporter struct {
+	w             http.ResponseWriter
+	encoder       *xml.Encoder
+	storefrontURL string
+}
+
+func newFeedExporter(w http.ResponseWriter) *feedExporter {
+	storefrontURL := os.Getenv("STOREFRONT_URL")
+	if storefrontURL == "" {
+		storefrontURL = "http://localhost:5173"
+	}
+	return &feedExporter{w: w, encoder: xml.NewEncoder(w), storefrontURL: strings.TrimSuffix(storefrontURL, "/")}
+}
+
+func (e *feedExporter) begin() error {
+	_, err := fmt.Fprintf(e.w, "%s<rss version=\"2.0\" xmlns:g=\"http://base.google.com/ns/1.0\">\n<channel>\n<title>Cloud Shop</title>\n<link>%s</link>\n<description>Cloud Shop product feed</description>\n",
+		xml.Header, e.storefrontURL)
+	return err
+}
+
+func (e *feedExporter) write(product Product) error {
+	imageLink := primaryImageURL(product)
+	// Locally stored media has a relative URL; feeds need absolute links.
+	if strings.HasPrefix(imageLink, "/") {
+		imageLink = e.storefrontURL + imageLink
+	}
+	availability := "in stock"
+	if !isPublic(product, time.Now()) {
+		availability = "out of stock"
+	}
+	item := feedItem{
+		ID:           product.SKU,
+		Title:        product.Name,
+		Description:  product.Description,
+		Link:         e.storefrontURL + "/products?search=" + url.QueryEscape(product.Name),
+		ImageLink:    imageLink,
+		Price:        product.Price.String() + " " + product.Price.Currency,
+		Availability: availability,
+		Condition:    "new",
+		Brand:        product.Brand,
+		ProductType:  product.Category,
+	}
+	// Announce sales that are running or still to come, with their date range.
+	if product.SalePrice != nil && (product.SaleEndsAt == nil || product.SaleEndsAt.After(time.Now())) {
+		item.SalePrice = product.SalePrice.String() + " " + product.SalePrice.Currency
+		if product.SaleStartsAt != nil && product.SaleEndsAt != nil {
+			item.SaleDates = product.SaleStartsAt.Format(time.RFC3339) + "/" + product.SaleEndsAt.Format(time.RFC3339)
+		}
+	}
+	if err := e.encoder.Encode(item); err != nil {
+		return err
+	}
+	_, err := e.w.Write([]byte("\n"))
+	return err
+}
+
+func (e *feedExporter) end() error {
+	_, err := e.w.Write([]byte("</channel>\n</rss>\n"))
+	return err
+}
+
+// primaryImageURL returns the URL of the product's first image, if any.
+func primaryImageURL(product Product) string {
+	if len(product.Images) == 0 {
+		return ""
+	}
+	return product.Images[0].URL
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"io"
 	"log"
 	"math"
 	"net/http"
@@ -25,7 +26,7 @@ func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 
 // getAllProductsHandler returns the complete list of all products without pagination.
 func (env *Env) getAllProductsHandler(w http.ResponseWriter, r *http.Request) {
-	cursor, err := env.collection.Find(context.TODO(), bson.D{})
+	cursor, err := env.collection.Find(context.TODO(), publicProductFilter())
 	if err != nil {
 		http.Error(w, "Failed to fetch products", http.StatusInternalServerError)
 		return
@@ -41,6 +42,14 @@ func (env *Env) getAllProductsHandler(w http.ResponseWriter, r *http.Request) {
 	if products == nil {
 		products = make([]Product, 0)
 	}
+	if err := env.priceProducts(products, r.URL.Query().Get("currency")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := env.resolveStock(context.TODO(), products); err != nil {
+		http.Error(w, "Failed to fetch stock", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -48,7 +57,30 @@ func (env *Env) getAllProductsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // getProductsHandler now supports filtering, searching, and pagination.
+// Only active, currently published products are visible to the public.
+// Pages are cached in Redis and revalidated with If-None-Match.
 func (env *Env) getProductsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	key := env.cache.listingKey(ctx, r.URL.Query(), env.rates.snapshot().UpdatedAt)
+	if body, ok := env.cache.listing(ctx, key); ok {
+		writeJSONBody(w, r, body)
+		return
+	}
+	page := newResponseBuffer()
+	env.listProducts(page, r, publicProductFilter())
+	if page.status != http.StatusOK {
+		page.copyTo(w)
+		return
+	}
+	env.cache.storeListing(ctx, key, page.body.Bytes())
+	writeJSONBody(w, r, page.body.Bytes())
+}
+
+// listProducts applies the search, brand, category, attribute, sort and
+// pagination query parameters on top of baseFilter and writes a PaginatedProductsResponse.
+func (env *Env) listProducts(w http.ResponseWriter, r *http.Request, baseFilter bson.M) {
 	// --- 1. Parse Query Parameters ---
 	queryValues := r.URL.Query()
 	pageStr := queryValues.Get("page")
@@ -70,8 +102,8 @@ func (env *Env) getProductsHandler(w http.ResponseWriter, r *http.Request) {
 	skip := (page - 1) * limit
 
 	// --- 2. Build Dynamic MongoDB Filter ---
-	// Start with an empty filter that matches everything.
-	filter := bson.M{}
+	// Start from the caller's base filter (e.g. only active products).
+	filter := baseFilter
 
 	// Add conditions to the filter only if the query params exist.
 	if searchQuery != "" {
@@ -84,14 +116,32 @@ func (env *Env) getProductsHandler(w http.ResponseWriter, r *http.Request) {
 		// Use the $in operator to match any brand in the list.
 		filter["brand"] = bson.M{"$in": brands}
 	}
-	if categoriesQuery != "" {
-		categories := strings.Split(categoriesQuery, ",")
-		filter["category"] = bson.M{"$in": categories}
-	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	if categoriesQuery != "" {
+		// A category includes all of its subcategories.
+		inCategories, err := env.categoryFilter(ctx, strings.Split(categoriesQuery, ","))
+		if err != nil {
+			log.Printf("Error resolving categories: %v", err)
+			http.Error(w, "Failed to fetch products", http.StatusInternalServerError)
+			return
+		}
+		for key, value := range inCategories {
+			filter[key] = value
+		}
+	}
+
+	attributes, err := attributeFilter(queryValues)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for key, value := range attributes {
+		filter[key] = value
+	}
+
 	// --- 3. Execute Queries ---
 	// Get the total count of documents that MATCH THE FILTER.
 	totalDocs, err := env.collection.CountDocuments(ctx, filter)
@@ -104,7 +154,7 @@ func (env *Env) getProductsHandler(w http.ResponseWriter, r *http.Request) {
 	findOptions := options.Find()
 	findOptions.SetLimit(limit)
 	findOptions.SetSkip(skip)
-	findOptions.SetSort(bson.D{{Key: "name", Value: 1}})
+	findOptions.SetSort(productSort(queryValues.Get("sort")))
 
 	// Execute the Find query WITH THE FILTER to get the documents for the current page.
 	cursor, err := env.collection.Find(ctx, filter, findOptions)
@@ -120,6 +170,15 @@ func (env *Env) getProductsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := env.priceProducts(products, queryValues.Get("currency")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := env.resolveStock(ctx, products); err != nil {
+		http.Error(w, "Failed to fetch stock", http.StatusInternalServerError)
+		return
+	}
+
 	// --- 4. Create and Send Response ---
 	response := PaginatedProductsResponse{
 		Products:      products,
@@ -132,6 +191,18 @@ func (env *Env) getProductsHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 }
+// productSort maps the "sort" query parameter to a sort order. Names break
+// ties so pages stay stable.
+func productSort(sort string) bson.D {
+	switch sort {
+	case "rating":
+		return bson.D{{Key: "averageRating", Value: -1}, {Key: "reviewCount", Value: -1}, {Key: "name", Value: 1}}
+	case "reviews":
+		return bson.D{{Key: "reviewCount", Value: -1}, {Key: "averageRating", Value: -1}, {Key: "name", Value: 1}}
+	}
+	return bson.D{{Key: "name", Value: 1}}
+}
+
 func (env *Env) getProductByIDHandler(w http.ResponseWriter, r *http.Request) {
 	// Get the ID from the URL path.
 	productIDString := r.PathValue("id")
@@ -140,7 +211,8 @@ func (env *Env) getProductByIDHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid product ID format", http.StatusBadRequest)
 		return
 	}
-	filter := bson.M{"_id": objID}
+	filter := viewableProductFilter()
+	filter["_id"] = objID
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -156,13 +228,7 @@ func (env *Env) getProductByIDHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-		// Write the result back to the client as JSON.
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(product); err != nil {
-		log.Printf("Error encoding product to JSON: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-	}
-
+	env.writeProductDetail(ctx, w, r, product)
 }
 
 
@@ -175,25 +241,59 @@ func (env *Env) getProductBySKUHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// The filter now uses the "sku" field instead of "_id".
-	filter := bson.M{"sku": productSKU}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	var product Product
-	err := env.collection.FindOne(ctx, filter).Decode(&product)
-	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
-			http.Error(w, "Product with that SKU not found", http.StatusNotFound)
-		} else {
+	// Products are cached whatever their status, so visibility is checked here.
+	product, cached := env.cache.products(ctx, []string{productSKU})[productSKU]
+	if !cached {
+		err := env.collection.FindOne(ctx, bson.M{"sku": productSKU}).Decode(&product)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
 			log.Printf("Error finding product by SKU %s: %v", productSKU, err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
 		}
+		if err == nil {
+			env.cache.storeProducts(ctx, []Product{product})
+		}
+	}
+	if product.SKU == "" || !isViewable(product, time.Now()) {
+		http.Error(w, "Product with that SKU not found", http.StatusNotFound)
 		return
 	}
+	env.writeProductDetail(ctx, w, r, product)
+}
 
+// writeProductDetail prices a product in the requested currency, adds its
+// breadcrumbs and writes it with its ETag, or 304 Not Modified when the
+// client's copy is still current.
+func (env *Env) writeProductDetail(ctx context.Context, w http.ResponseWriter, r *http.Request, product Product) {
+	currency := r.URL.Query().Get("currency")
+	if err := env.priceProduct(&product, currency, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	env.productBreadcrumbs(ctx, &product)
+	single := []Product{product}
+	if err := env.resolveStock(ctx, single); err != nil {
+		http.Error(w, "Failed to fetch stock", http.StatusInternalServerError)
+		return
+	}
+	product = single[0]
+	body, err := json.Marshal(product)
+	if err != nil {
+		log.Printf("Error encoding product to JSON: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	etag := detailETag(env.localizedETag(product, currency), body)
+	w.Header().Set("ETag", etag)
+	if ifNoneMatch(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(product)
+	w.Write(append(body, '\n'))
 }
 
 
@@ -213,27 +313,70 @@ func (env *Env) batchGetProductsBySKUHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	// Use the MongoDB "$in" operator to find all documents where the "sku" field
-	// matches any value in the provided slice. This is very efficient.
-	filter := bson.M{"sku": bson.M{"$in": requestBody.SKUs}}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	cursor, err := env.collection.Find(ctx, filter)
-	if err != nil {
-		http.Error(w, "Failed to fetch products", http.StatusInternalServerError)
-		return
+	// Serve what we can from the cache and fetch only the rest.
+	found := env.cache.products(ctx, requestBody.SKUs)
+	if found == nil {
+		found = make(map[string]Product, len(requestBody.SKUs))
 	}
-	defer cursor.Close(ctx)
+	missing := make([]string, 0, len(requestBody.SKUs))
+	for _, sku := range requestBody.SKUs {
+		if _, ok := found[sku]; !ok {
+			missing = append(missing, sku)
+		}
+	}
+	if len(missing) > 0 {
+		// Use the MongoDB "$in" operator to find all documents where the "sku" field
+		// matches any value in the provided slice. This is very efficient.
+		cursor, err := env.collection.Find(ctx, bson.M{"sku": bson.M{"$in": missing}})
+		if err != nil {
+			http.Error(w, "Failed to fetch products", http.StatusInternalServerError)
+			return
+		}
+		defer cursor.Close(ctx)
 
-	var products []Product
-	if err = cursor.All(ctx, &products); err != nil {
-		http.Error(w, "Failed to decode products", http.StatusInternalServerError)
+		var fetched []Product
+		if err = cursor.All(ctx, &fetched); err != nil {
+			http.Error(w, "Failed to decode products", http.StatusInternalServerError)
+			return
+		}
+		env.cache.storeProducts(ctx, fetched)
+		for _, p := range fetched {
+			found[p.SKU] = p
+		}
+	}
+
+	// Drafts, archived and deleted products are still returned so carts and
+	// order history can show them, but they are flagged as unavailable. A
+	// product moved back to draft must not vanish from the carts holding it.
+	products := make([]Product, 0, len(found))
+	for _, sku := range requestBody.SKUs {
+		p, ok := found[sku]
+		if !ok {
+			continue
+		}
+		products = append(products, p)
+		delete(found, sku) // a SKU listed twice is returned once
+	}
+
+	if err := env.priceProducts(products, r.URL.Query().Get("currency")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if err := env.resolveStock(ctx, products); err != nil {
+		http.Error(w, "Failed to fetch stock", http.StatusInternalServerError)
+		return
+	}
+	batchProducts := make([]BatchProduct, 0, len(products))
+	now := time.Now()
+	for _, p := range products {
+		batchProducts = append(batchProducts, BatchProduct{Product: p, Available: isPublic(p, now)})
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(products)
+	json.NewEncoder(w).Encode(batchProducts)
 }
 
 
@@ -245,10 +388,33 @@ func (env *Env) createProductHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if newProduct.Name == "" || newProduct.SKU == "" || newProduct.Price <= 0 {
+	if err := newProduct.applyCurrency(); err != nil {
+		http.Error(w, "Invalid amount: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if newProduct.Name == "" || newProduct.SKU == "" || !newProduct.Price.IsPositive() {
 		http.Error(w, "Name, SKU, and a positive Price are required", http.StatusBadRequest)
 		return
 	}
+	if newProduct.Status == "" {
+		newProduct.Status = ProductStatusActive
+	}
+	if !isEditableProductStatus(newProduct.Status) {
+		http.Error(w, "Status must be one of draft, active or archived", http.StatusBadRequest)
+		return
+	}
+	if msg := validateSale(newProduct); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	if msg := validatePublishing(newProduct); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	if msg := validatePriceList(newProduct); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
 
 
 	var existingProduct Product
@@ -269,18 +435,42 @@ func (env *Env) createProductHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	insertResult, err := env.collection.InsertOne(ctx, newProduct)
+	if !env.resolveProductCategory(ctx, w, &newProduct) || !env.validateProductAttributes(ctx, w, &newProduct) ||
+		!env.validateBundle(ctx, w, &newProduct) {
+		return
+	}
+	if err := env.resolveProductSlug(ctx, &newProduct, nil); err != nil {
+		writeSlugError(w, err)
+		return
+	}
+	// Images are attached through the upload endpoint, never inline.
+	newProduct.Images = nil
+	newProduct.AverageRating, newProduct.ReviewCount = 0, 0
+	newProduct.Version = 1
+	err = env.writeWithEvents(ctx, userEmail(r), func(ctx context.Context) ([]OutboxEvent, error) {
+		insertResult, err := env.collection.InsertOne(ctx, newProduct)
+		if err != nil {
+			return nil, err
+		}
+		// The ID is returned in the `insertResult.InsertedID`. We must type-assert it.
+		newProduct.ID = insertResult.InsertedID.(primitive.ObjectID)
+		return []OutboxEvent{newProductEvent(EventProductCreated, nil, newProduct)}, nil
+	})
+	if isSlugConflict(err) {
+		http.Error(w, "Product with this slug already exists", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		log.Printf("Error creating product: %v", err)
 		http.Error(w, "Failed to create product", http.StatusInternalServerError)
 		return
 	}
-
-	// The ID is returned in the `insertResult.InsertedID`. We must type-assert it.
-	newProduct.ID = insertResult.InsertedID.(primitive.ObjectID)
+	env.recordPriceChange(ctx, newProduct, PriceChangeCreated, userEmail(r))
+	newProduct.resolvePricing(time.Now())
 
 	
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", productETag(newProduct))
 	w.WriteHeader(http.StatusCreated)
 	if err := json.NewEncoder(w).Encode(newProduct); err != nil {
 		log.Printf("Error encoding created product to JSON: %v", err)
@@ -289,6 +479,8 @@ func (env *Env) createProductHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 
+// updateProductHandler replaces the editable fields of a product (PUT).
+// Images are managed through their own endpoints and are always carried over.
 func (env *Env) updateProductHandler(w http.ResponseWriter, r *http.Request) {
 	ProductIDString := r.PathValue("id")
 	objID, err := primitive.ObjectIDFromHex(ProductIDString)
@@ -302,7 +494,7 @@ func (env *Env) updateProductHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	if updatedProduct.Name == "" || updatedProduct.SKU == "" || updatedProduct.Price <= 0 {
+	if updatedProduct.Name == "" || updatedProduct.SKU == "" || !updatedProduct.Price.IsPositive() {
 		http.Error(w, "Name, SKU, and a positive Price are required", http.StatusBadRequest)
 		return
 	}
@@ -310,30 +502,187 @@ func (env *Env) updateProductHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	current, ok := env.findProductForWrite(ctx, w, r, objID)
+	if !ok {
+		return
+	}
+	if current.Status == ProductStatusDeleted {
+		http.Error(w, "Product is deleted, restore it before editing", http.StatusConflict)
+		return
+	}
+	// Omitting the currency keeps the product's current one.
+	if updatedProduct.Currency == "" {
+		updatedProduct.Currency = current.Price.Currency
+	}
+	if err := updatedProduct.applyCurrency(); err != nil {
+		http.Error(w, "Invalid amount: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Clients unaware of the category tree keep the product where it is.
+	if updatedProduct.CategoryID == nil && updatedProduct.Category == current.Category {
+		updatedProduct.CategoryID = current.CategoryID
+	}
+	env.replaceProduct(ctx, w, r, current, updatedProduct)
+}
+
+// patchProductHandler applies a JSON Merge Patch (RFC 7396) to a product, so
+// clients only send the fields they want to change.
+func (env *Env) patchProductHandler(w http.ResponseWriter, r *http.Request) {
+	objID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID format", http.StatusBadRequest)
+		return
+	}
+	patch, err := io.ReadAll(r.Body)
+	if err != nil || !json.Valid(patch) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	current, ok := env.findProductForWrite(ctx, w, r, objID)
+	if !ok {
+		return
+	}
+	if current.Status == ProductStatusDeleted {
+		http.Error(w, "Product is deleted, restore it before editing", http.StatusConflict)
+		return
+	}
+
+	// Merge the patch into the JSON representation of the current product.
+	current.resolvePricing(time.Now())
+	original, err := json.Marshal(current)
+	if err != nil {
+		log.Printf("Error encoding product for patch: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	merged, err := applyMergePatch(original, patch)
+	if err != nil {
+		http.Error(w, "Invalid merge patch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var patchedProduct Product
+	if err := json.Unmarshal(merged, &patchedProduct); err != nil {
+		http.Error(w, "Patched product is invalid: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := patchedProduct.applyCurrency(); err != nil {
+		http.Error(w, "Invalid amount: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if patchedProduct.Name == "" || patchedProduct.SKU == "" || !patchedProduct.Price.IsPositive() {
+		http.Error(w, "Name, SKU, and a positive Price are required", http.StatusBadRequest)
+		return
+	}
+
+	env.replaceProduct(ctx, w, r, current, patchedProduct)
+}
+
+// findProductForWrite loads the product about to be modified and enforces the
+// request's If-Match precondition. It writes the error response itself and
+// returns false when the handler should stop.
+func (env *Env) findProductForWrite(ctx context.Context, w http.ResponseWriter, r *http.Request, objID primitive.ObjectID) (Product, bool) {
+	var current Product
+	err := env.collection.FindOne(ctx, bson.M{"_id": objID}).Decode(&current)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Product not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error finding product: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return Product{}, false
+	}
+	if !ifMatchSatisfied(r, current) {
+		w.Header().Set("ETag", productETag(current))
+		http.Error(w, "Product has been modified, reload and retry", http.StatusPreconditionFailed)
+		return Product{}, false
+	}
+	return current, true
+}
+
+// replaceProduct writes updated over current as the next version. The write only
+// succeeds if nobody else changed the product since it was read.
+func (env *Env) replaceProduct(ctx context.Context, w http.ResponseWriter, r *http.Request, current, updated Product) {
+	if updated.Status == "" {
+		updated.Status = current.Status
+	}
+	if !isEditableProductStatus(updated.Status) {
+		http.Error(w, "Status must be one of draft, active or archived", http.StatusBadRequest)
+		return
+	}
+	if msg := validateSale(updated); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	if msg := validatePublishing(updated); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	if msg := validatePriceList(updated); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	if !env.resolveProductCategory(ctx, w, &updated) || !env.validateProductAttributes(ctx, w, &updated) ||
+		!env.validateBundle(ctx, w, &updated) {
+		return
+	}
+	if err := env.resolveProductSlug(ctx, &updated, &current); err != nil {
+		writeSlugError(w, err)
+		return
+	}
+	updated.DeletedAt = nil
 
-	// Define the filter to find the document to replace.
-	filter := bson.M{"_id": objID}
+	updated.ID = current.ID
+	updated.Images = current.Images
+	updated.AverageRating, updated.ReviewCount = current.AverageRating, current.ReviewCount
+	updated.Version = current.Version + 1
 
-	result, err := env.collection.ReplaceOne(ctx, filter, updatedProduct)
+	var result *mongo.UpdateResult
+	err := env.writeWithEvents(ctx, userEmail(r), func(ctx context.Context) ([]OutboxEvent, error) {
+		var err error
+		result, err = env.collection.ReplaceOne(ctx, versionFilter(current.ID, current.Version), updated)
+		if err != nil || result.MatchedCount == 0 {
+			return nil, err
+		}
+		return []OutboxEvent{newProductEvent(EventProductUpdated, &current, updated)}, nil
+	})
 	if err != nil {
+		if isSlugConflict(err) {
+			http.Error(w, "Product with this slug already exists", http.StatusConflict)
+			return
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			http.Error(w, "Product with this SKU already exists", http.StatusConflict)
+			return
+		}
 		log.Printf("Error updating product: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	// If MatchedCount is 0, it means no document with that ID was found.
+	// Someone else wrote between our read and our write.
 	if result.MatchedCount == 0 {
-		http.Error(w, "Product not found", http.StatusNotFound)
+		if r.Header.Get("If-Match") != "" {
+			http.Error(w, "Product has been modified, reload and retry", http.StatusPreconditionFailed)
+		} else {
+			http.Error(w, "Product was modified concurrently, reload and retry", http.StatusConflict)
+		}
 		return
 	}
+	if pricingChanged(current, updated) {
+		env.recordPriceChange(ctx, updated, PriceChangeUpdated, userEmail(r))
+	}
+	updated.resolvePricing(time.Now())
+
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", productETag(updated))
 	w.WriteHeader(http.StatusOK)
-    
-    // Set the ID on the returned object since the decoded one won't have it.
-    updatedProduct.ID = objID
-	if err := json.NewEncoder(w).Encode(updatedProduct); err != nil {
+	if err := json.NewEncoder(w).Encode(updated); err != nil {
 		log.Printf("Error encoding updated product to JSON: %v", err)
 	}
-
 }
 
 func (env *Env) deleteProductHandler(w http.ResponseWriter, r *http.Request) {
@@ -346,18 +695,38 @@ func (env *Env) deleteProductHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	current, ok := env.findProductForWrite(ctx, w, r, objID)
+	if !ok {
+		return
+	}
+	if current.Status == ProductStatusDeleted {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
 
-	// Define the filter to find the document to delete.
-	filter := bson.M{"_id": objID}
-
-	result, err := env.collection.DeleteOne(ctx, filter)
+	// Products are only soft-deleted: carts and orders still reference the SKU.
+	deleted := current
+	now := time.Now()
+	deleted.Status, deleted.DeletedAt, deleted.Version = ProductStatusDeleted, &now, current.Version+1
+	var result *mongo.UpdateResult
+	err = env.writeWithEvents(ctx, userEmail(r), func(ctx context.Context) ([]OutboxEvent, error) {
+		var err error
+		result, err = env.collection.UpdateOne(ctx, versionFilter(objID, current.Version), bson.M{
+			"$set": bson.M{"status": ProductStatusDeleted, "deletedAt": now},
+			"$inc": bson.M{"version": 1},
+		})
+		if err != nil || result.MatchedCount == 0 {
+			return nil, err
+		}
+		return []OutboxEvent{newProductEvent(EventProductDeleted, &current, deleted)}, nil
+	})
 	if err != nil {
 		log.Printf("Error deleting product: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	if result.DeletedCount == 0 {
-		http.Error(w, "Product not found", http.StatusNotFound)
+	if result.MatchedCount == 0 {
+		http.Error(w, "Product has been modified, reload and retry", http.StatusPreconditionFailed)
 		return
 	}
 		w.WriteHeader(http.StatusNoContent)
@@ -371,7 +740,7 @@ func (env *Env) getUniqueBrandsHandler(w http.ResponseWriter, r *http.Request) {
 	defer cancel()
 
 	// The "distinct" command finds the unique values for a specified field.
-	brands, err := env.collection.Distinct(ctx, "brand", bson.D{})
+	brands, err := env.collection.Distinct(ctx, "brand", publicProductFilter())
 	if err != nil {
 		http.Error(w, "Failed to fetch brands", http.StatusInternalServerError)
 		return
@@ -386,7 +755,7 @@ func (env *Env) getUniqueCategoriesHandler(w http.ResponseWriter, r *http.Reques
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	categories, err := env.collection.Distinct(ctx, "category", bson.D{})
+	categories, err := env.collection.Distinct(ctx, "category", publicProductFilter())
 	if err != nil {
 		http.Error(w, "Failed to fetch categories", http.StatusInternalServerError)
 		return
@@ -394,4 +763,19 @@ func (env *Env) getUniqueCategoriesHandler(w http.ResponseWriter, r *http.Reques
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(categories)
-}
\ No newline at end of file
+}
+// writeValidation answers a failed product check: msg describes a problem
+// with the request, err a failure to check it. It returns true when neither
+// is set and the handler may go on.
+func writeValidation(w http.ResponseWriter, msg string, err error) bool {
+	switch {
+	case err != nil:
+		log.Printf("Error validating product: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return false
+	case msg != "":
+		http.Error(w, msg, http.StatusBadRequest)
+		return false
+	}
+	return true
+}
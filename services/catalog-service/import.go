@@ -0,0 +1,527 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"three-tier-cloud-shop/money"
+)
+
+// maxImportSize caps the size of an import upload.
+const maxImportSize = 20 << 20
+
+// Import row outcomes.
+const (
+	ImportActionCreated  = "created"
+	ImportActionUpdated  = "updated"
+	ImportActionRejected = "rejected"
+)
+
+// ImportRowResult reports what happened (or, on a dry run, what would happen) to one row.
+type ImportRowResult struct {
+	Row    int      `json:"row"`
+	SKU    string   `json:"sku"`
+	Action string   `json:"action"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// ImportReport is the response of the import endpoint.
+type ImportReport struct {
+	DryRun   bool              `json:"dryRun"`
+	Created  int               `json:"created"`
+	Updated  int               `json:"updated"`
+	Rejected int               `json:"rejected"`
+	Rows     []ImportRowResult `json:"rows"`
+}
+
+// importRow is a single parsed input row before validation. Fields holds the
+// product fields the row supplied, by JSON name: the CSV columns or the JSON
+// keys present. An update leaves all other fields alone.
+type importRow struct {
+	Row     int
+	Product Product
+	Fields  map[string]bool
+	Errors  []string
+}
+
+// importProductsHandler upserts products by SKU from a CSV or JSON upload
+// (the data.json shape). Every row is validated and reported individually;
+// with ?dryRun=true nothing is written.
+func (env *Env) importProductsHandler(w http.ResponseWriter, r *http.Request) {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryRun"))
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "text/csv":
+			format = "csv"
+		case "application/json", "":
+			format = "json"
+		}
+	}
+
+	var rows []importRow
+	var err error
+	switch format {
+	case "csv":
+		rows, err = parseCSVImport(r.Body)
+	case "json":
+		rows, err = parseJSONImport(r.Body)
+	default:
+		http.Error(w, "Unsupported import format, send text/csv or application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("Import file is larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid import file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	report, err := env.importProducts(ctx, rows, dryRun, userEmail(r))
+	if err != nil {
+		log.Printf("Error importing products: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
+
+// importProducts validates rows against each other and the existing catalog,
+// then upserts the valid ones in a single unordered BulkWrite.
+func (env *Env) importProducts(ctx context.Context, rows []importRow, dryRun bool, changedBy string) (ImportReport, error) {
+	report := ImportReport{DryRun: dryRun, Rows: make([]ImportRowResult, len(rows))}
+
+	// --- 1. Validate each row on its own and look for duplicate SKUs in the file ---
+	seen := make(map[string]int)
+	skus := make([]string, 0, len(rows))
+	for i := range rows {
+		rows[i].Errors = append(rows[i].Errors, validateImportProduct(rows[i].Product)...)
+		sku := rows[i].Product.SKU
+		if sku == "" {
+			continue
+		}
+		if first, ok := seen[sku]; ok {
+			rows[i].Errors = append(rows[i].Errors, fmt.Sprintf("duplicate SKU, first seen in row %d", first))
+			continue
+		}
+		seen[sku] = rows[i].Row
+		skus = append(skus, sku)
+	}
+
+	// --- 2. Find which SKUs already exist to tell creates from updates ---
+	existing := make(map[string]Product)
+	if len(skus) > 0 {
+		cursor, err := env.collection.Find(ctx, bson.M{"sku": bson.M{"$in": skus}})
+		if err != nil {
+			return report, err
+		}
+		var products []Product
+		if err := cursor.All(ctx, &products); err != nil {
+			return report, err
+		}
+		for _, p := range products {
+			existing[p.SKU] = p
+		}
+	}
+
+	// --- 3. Build the report and the write models ---
+	// Slugs handed out in this batch, so two new products can't get the same one.
+	reservedSlugs := make(map[string]bool)
+	var models []mongo.WriteModel
+	var modelRows []int // index into rows for every model
+	for i, row := range rows {
+		result := ImportRowResult{Row: row.Row, SKU: row.Product.SKU}
+		current, exists := existing[row.Product.SKU]
+		if exists && current.Status == ProductStatusDeleted {
+			row.Errors = append(row.Errors, "product is deleted, restore it before importing")
+		}
+		product := mergeImport(row, current, exists)
+		if len(row.Errors) == 0 {
+			errs, err := env.checkImportProduct(ctx, &product)
+			if err != nil {
+				return report, err
+			}
+			row.Errors = errs
+		}
+		if len(row.Errors) > 0 {
+			result.Action = ImportActionRejected
+			result.Errors = row.Errors
+			report.Rows[i] = result
+			continue
+		}
+
+		if exists {
+			result.Action = ImportActionUpdated
+		} else {
+			result.Action = ImportActionCreated
+		}
+		report.Rows[i] = result
+
+		// As on edit, the slug only changes with the name and the old one redirects.
+		previousSlug := ""
+		if exists && current.Slug != "" && current.Name == product.Name {
+			product.Slug = current.Slug
+		} else {
+			slug, err := uniqueProductSlug(ctx, env.collection, slugify(product.Name), current.ID, reservedSlugs)
+			if err != nil {
+				return report, err
+			}
+			reservedSlugs[slug] = true
+			product.Slug = slug
+			if exists && current.Slug != slug {
+				previousSlug = current.Slug
+			}
+		}
+		models = append(models, importWriteModel(product, row.Fields, previousSlug))
+		modelRows = append(modelRows, i)
+		rows[i].Product = product
+	}
+
+	// --- 4. Write everything in one round trip ---
+	if !dryRun && len(models) > 0 {
+		_, err := env.collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		var bulkErr mongo.BulkWriteException
+		if errors.As(err, &bulkErr) {
+			for _, writeErr := range bulkErr.WriteErrors {
+				i := modelRows[writeErr.Index]
+				report.Rows[i].Action = ImportActionRejected
+				report.Rows[i].Errors = append(report.Rows[i].Errors, writeErr.Message)
+			}
+		} else if err != nil {
+			return report, err
+		}
+
+		// Record the new price of every row that was written and changed it.
+		var written []string
+		for _, i := range modelRows {
+			if report.Rows[i].Action == ImportActionRejected {
+				continue
+			}
+			written = append(written, rows[i].Product.SKU)
+			imported := rows[i].Product
+			if current, exists := existing[imported.SKU]; exists && !pricingChanged(current, imported) {
+				continue
+			}
+			env.recordPriceChange(ctx, imported, PriceChangeImported, changedBy)
+		}
+		// A bulk write can partly fail, so events are recorded for what was
+		// actually written instead of in a transaction.
+		if len(written) > 0 {
+			env.recordProductChanges(ctx, changedBy, bson.M{"sku": bson.M{"$in": written}}, existing)
+		}
+	}
+
+	for _, row := range report.Rows {
+		switch row.Action {
+		case ImportActionCreated:
+			report.Created++
+		case ImportActionUpdated:
+			report.Updated++
+		case ImportActionRejected:
+			report.Rejected++
+		}
+	}
+	return report, nil
+}
+
+// mergeImport returns the product an imported row leaves behind: the row
+// itself for a new product, or the current product with the fields the row
+// supplied replaced.
+func mergeImport(row importRow, current Product, exists bool) Product {
+	imported := row.Product
+	if !exists {
+		if imported.Status == "" {
+			imported.Status = ProductStatusActive
+		}
+		return imported
+	}
+	merged := current
+	// Name, SKU and price are required, so every row has them.
+	merged.Name, merged.Price = imported.Name, imported.Price
+	if row.Fields["description"] {
+		merged.Description = imported.Description
+	}
+	if row.Fields["brand"] {
+		merged.Brand = imported.Brand
+	}
+	// Renaming the category takes the product out of its place in the tree,
+	// unless the row places it by categoryId too.
+	if row.Fields["categoryId"] || (row.Fields["category"] && imported.Category != current.Category) {
+		merged.Category, merged.CategoryID = imported.Category, imported.CategoryID
+	}
+	if row.Fields["status"] && imported.Status != "" {
+		merged.Status = imported.Status
+	}
+	if row.Fields["prices"] {
+		merged.Prices = imported.Prices
+	}
+	if row.Fields["salePrice"] {
+		merged.SalePrice = imported.SalePrice
+	}
+	if row.Fields["saleStartsAt"] {
+		merged.SaleStartsAt = imported.SaleStartsAt
+	}
+	if row.Fields["saleEndsAt"] {
+		merged.SaleEndsAt = imported.SaleEndsAt
+	}
+	if row.Fields["publishAt"] {
+		merged.PublishAt = imported.PublishAt
+	}
+	if row.Fields["unpublishAt"] {
+		merged.UnpublishAt = imported.UnpublishAt
+	}
+	if row.Fields["attributes"] {
+		merged.Attributes = imported.Attributes
+	}
+	if row.Fields["components"] {
+		merged.Components = imported.Components
+	}
+	return merged
+}
+
+// checkImportProduct checks the product a row leaves behind with the same
+// rules as create and update, resolving its category on the way. It returns
+// the problems found; err is set when they could not be checked.
+func (env *Env) checkImportProduct(ctx context.Context, product *Product) ([]string, error) {
+	var errs []string
+	for _, msg := range []string{validateSale(*product), validatePublishing(*product)} {
+		if msg != "" {
+			errs = append(errs, msg)
+		}
+	}
+	for _, check := range []func(context.Context, *Product) (string, error){
+		env.checkProductCategory, env.checkProductAttributes, env.checkBundle,
+	} {
+		msg, err := check(ctx, product)
+		if err != nil {
+			return nil, err
+		}
+		if msg != "" {
+			errs = append(errs, msg)
+		}
+	}
+	return errs, nil
+}
+
+// importWriteModel upserts product by SKU. Only the fields an import carries
+// are written, so images and other catalog-managed data survive an import.
+// Of those, the ones missing from fields are only written when the row creates
+// the product, and an optional one supplied empty is removed. A non-empty
+// previousSlug is kept as a former slug.
+func importWriteModel(product Product, fields map[string]bool, previousSlug string) mongo.WriteModel {
+	set := bson.M{"name": product.Name, "slug": product.Slug, "price": product.Price}
+	setOnInsert := bson.M{}
+	unset := bson.M{}
+
+	categorized := fields["category"] || fields["categoryId"]
+	for _, f := range []struct {
+		name     string
+		value    interface{}
+		supplied bool
+	}{
+		{"description", product.Description, fields["description"]},
+		{"brand", product.Brand, fields["brand"]},
+		{"category", product.Category, categorized},
+		{"status", product.Status, fields["status"]},
+	} {
+		if f.supplied {
+			set[f.name] = f.value
+		} else {
+			setOnInsert[f.name] = f.value
+		}
+	}
+	switch {
+	case categorized && product.CategoryID == nil:
+		unset["categoryId"] = ""
+	case categorized:
+		set["categoryId"] = product.CategoryID
+	case product.CategoryID != nil:
+		setOnInsert["categoryId"] = product.CategoryID
+	}
+
+	for _, f := range []struct {
+		name  string
+		value interface{}
+		empty bool
+	}{
+		{"prices", product.Prices, len(product.Prices) == 0},
+		{"salePrice", product.SalePrice, product.SalePrice == nil},
+		{"saleStartsAt", product.SaleStartsAt, product.SaleStartsAt == nil},
+		{"saleEndsAt", product.SaleEndsAt, product.SaleEndsAt == nil},
+		{"publishAt", product.PublishAt, product.PublishAt == nil},
+		{"unpublishAt", product.UnpublishAt, product.UnpublishAt == nil},
+		{"attributes", product.Attributes, len(product.Attributes) == 0},
+		{"components", product.Components, len(product.Components) == 0},
+	} {
+		switch {
+		case !fields[f.name]:
+		case f.empty:
+			unset[f.name] = ""
+		default:
+			set[f.name] = f.value
+		}
+	}
+
+	update := bson.M{"$set": set, "$inc": bson.M{"version": 1}}
+	if len(setOnInsert) > 0 {
+		update["$setOnInsert"] = setOnInsert
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	if previousSlug != "" {
+		update["$addToSet"] = bson.M{"previousSlugs": previousSlug}
+	}
+	return mongo.NewUpdateOneModel().
+		SetFilter(bson.M{"sku": product.SKU}).
+		SetUpdate(update).
+		SetUpsert(true)
+}
+
+// validateImportProduct checks a row on its own; checkImportProduct then
+// applies the rules that depend on the catalog.
+func validateImportProduct(product Product) []string {
+	var errs []string
+	if product.Name == "" {
+		errs = append(errs, "name is required")
+	}
+	if product.SKU == "" {
+		errs = append(errs, "sku is required")
+	}
+	if !product.Price.IsPositive() {
+		errs = append(errs, "price must be positive")
+	}
+	if product.Status != "" && !isEditableProductStatus(product.Status) {
+		errs = append(errs, "status must be one of draft, active or archived")
+	}
+	if msg := validatePriceList(product); msg != "" {
+		errs = append(errs, msg)
+	}
+	return errs
+}
+
+// parseJSONImport reads an array of products in the data.json shape.
+func parseJSONImport(body io.Reader) ([]importRow, error) {
+	var raw []json.RawMessage
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		return nil, err
+	}
+	rows := make([]importRow, 0, len(raw))
+	for i, item := range raw {
+		row := importRow{Row: i + 1}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(item, &fields); err == nil {
+			row.Fields = make(map[string]bool, len(fields))
+			for name := range fields {
+				row.Fields[name] = true
+			}
+		}
+		if err := json.Unmarshal(item, &row.Product); err != nil {
+			row.Errors = append(row.Errors, "invalid product: "+err.Error())
+		} else if err := row.Product.applyCurrency(); err != nil {
+			row.Errors = append(row.Errors, err.Error())
+		}
+		row.Product.SKU = strings.TrimSpace(row.Product.SKU)
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// parseCSVImport reads a CSV file whose header row names the product fields:
+// name, sku and price, and any of description, brand, category, status and
+// currency. Updates keep the current value of a field without a column.
+// Rows are numbered by the line they start on, the header being line 1.
+func parseCSVImport(body io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("missing header row: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"name", "sku", "price"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("header is missing the %q column", required)
+		}
+	}
+
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		// A malformed row is reported and skipped; anything else, such as
+		// an upload over maxImportSize, ends the import.
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			rows = append(rows, importRow{Row: parseErr.StartLine, Errors: []string{err.Error()}})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// A quoted field can span lines, so the row starts where its first field does.
+		line, _ := reader.FieldPos(0)
+		row := importRow{Row: line, Fields: make(map[string]bool, len(columns))}
+		for name, i := range columns {
+			if i < len(record) {
+				row.Fields[name] = true
+			}
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		row.Product = Product{
+			Currency:    field("currency"),
+			Name:        field("name"),
+			Description: field("description"),
+			SKU:         field("sku"),
+			Brand:       field("brand"),
+			Category:    field("category"),
+			Status:      field("status"),
+		}
+		if price := field("price"); price != "" {
+			row.Product.Price, err = money.Parse(price, field("currency"))
+			if err != nil {
+				row.Errors = append(row.Errors, err.Error())
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
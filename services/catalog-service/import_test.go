@@ -0,0 +1,214 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"three-tier-cloud-shop/money"
+)
+
+func importedRows(t *testing.T, format, body string) []importRow {
+	t.Helper()
+	var rows []importRow
+	var err error
+	if format == "csv" {
+		rows, err = parseCSVImport(strings.NewReader(body))
+	} else {
+		rows, err = parseJSONImport(strings.NewReader(body))
+	}
+	if err != nil {
+		t.Fatalf("parsing %s import: %v", format, err)
+	}
+	for _, row := range rows {
+		if len(row.Errors) > 0 {
+			t.Fatalf("row %d: %v", row.Row, row.Errors)
+		}
+	}
+	return rows
+}
+
+func TestMergeImport(t *testing.T) {
+	categoryID := primitive.NewObjectID()
+	salePrice := money.New(19900, "USD")
+	current := Product{
+		Name:        "Camera",
+		Description: "A camera",
+		SKU:         "CAM-1",
+		Price:       money.New(24900, "USD"),
+		SalePrice:   &salePrice,
+		Brand:       "Nikon",
+		Category:    "Cameras",
+		CategoryID:  &categoryID,
+		Attributes:  map[string]interface{}{"megapixels": 24},
+		Status:      ProductStatusDraft,
+	}
+	tests := []struct {
+		name   string
+		format string
+		body   string
+		want   func(p *Product)
+	}{
+		{
+			name:   "only the CSV columns present change",
+			format: "csv",
+			body:   "sku,name,price\nCAM-1,Camera Z,229.00\n",
+			want: func(p *Product) {
+				p.Name, p.Price = "Camera Z", money.New(22900, "USD")
+			},
+		},
+		{
+			name:   "an empty column clears its field",
+			format: "csv",
+			body:   "sku,name,price,description,brand\nCAM-1,Camera,249.00,,Canon\n",
+			want: func(p *Product) {
+				p.Description, p.Brand = "", "Canon"
+			},
+		},
+		{
+			name:   "the same category keeps its place in the tree",
+			format: "csv",
+			body:   "sku,name,price,category\nCAM-1,Camera,249.00,Cameras\n",
+			want:   func(p *Product) {},
+		},
+		{
+			name:   "a new category name leaves the tree",
+			format: "csv",
+			body:   "sku,name,price,category\nCAM-1,Camera,249.00,Lenses\n",
+			want: func(p *Product) {
+				p.Category, p.CategoryID = "Lenses", nil
+			},
+		},
+		{
+			name:   "an empty status keeps the current one",
+			format: "csv",
+			body:   "sku,name,price,status\nCAM-1,Camera,249.00,\n",
+			want:   func(p *Product) {},
+		},
+		{
+			name:   "only the JSON keys present change",
+			format: "json",
+			body:   `[{"sku":"CAM-1","name":"Camera","price":"239.00","brand":"Canon"}]`,
+			want: func(p *Product) {
+				p.Price, p.Brand = money.New(23900, "USD"), "Canon"
+			},
+		},
+		{
+			name:   "a JSON null clears an optional field",
+			format: "json",
+			body:   `[{"sku":"CAM-1","name":"Camera","price":"249.00","salePrice":null,"attributes":null}]`,
+			want: func(p *Product) {
+				p.SalePrice, p.Attributes = nil, nil
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			row := importedRows(t, tt.format, tt.body)[0]
+			want := current
+			tt.want(&want)
+			if got := mergeImport(row, current, true); !reflect.DeepEqual(got, want) {
+				t.Errorf("mergeImport = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestMergeImportNewProduct(t *testing.T) {
+	row := importedRows(t, "csv", "sku,name,price\nCAM-2,Camera,249.00\n")[0]
+	got := mergeImport(row, Product{}, false)
+	want := Product{Name: "Camera", SKU: "CAM-2", Price: money.New(24900, "USD"), Status: ProductStatusActive}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeImport = %+v, want %+v", got, want)
+	}
+}
+
+func TestImportWriteModel(t *testing.T) {
+	categoryID := primitive.NewObjectID()
+	product := Product{
+		Name:        "Camera",
+		Slug:        "camera",
+		Description: "A camera",
+		SKU:         "CAM-1",
+		Price:       money.New(24900, "USD"),
+		Brand:       "Nikon",
+		Category:    "Cameras",
+		CategoryID:  &categoryID,
+		Status:      ProductStatusActive,
+	}
+	tests := []struct {
+		name    string
+		product func(p *Product)
+		fields  []string
+		want    bson.M
+	}{
+		{
+			name:   "fields without a column are only written on insert",
+			fields: []string{"sku", "name", "price"},
+			want: bson.M{
+				"$set": bson.M{"name": "Camera", "slug": "camera", "price": money.New(24900, "USD")},
+				"$setOnInsert": bson.M{
+					"description": "A camera", "brand": "Nikon", "category": "Cameras",
+					"categoryId": &categoryID, "status": ProductStatusActive,
+				},
+				"$inc": bson.M{"version": 1},
+			},
+		},
+		{
+			name:   "supplied fields are set",
+			fields: []string{"sku", "name", "price", "description", "brand", "category", "status"},
+			want: bson.M{
+				"$set": bson.M{
+					"name": "Camera", "slug": "camera", "price": money.New(24900, "USD"),
+					"description": "A camera", "brand": "Nikon", "category": "Cameras",
+					"categoryId": &categoryID, "status": ProductStatusActive,
+				},
+				"$inc": bson.M{"version": 1},
+			},
+		},
+		{
+			name:    "a category outside the tree unsets categoryId",
+			product: func(p *Product) { p.Category, p.CategoryID = "Lenses", nil },
+			fields:  []string{"sku", "name", "price", "category"},
+			want: bson.M{
+				"$set":         bson.M{"name": "Camera", "slug": "camera", "price": money.New(24900, "USD"), "category": "Lenses"},
+				"$setOnInsert": bson.M{"description": "A camera", "brand": "Nikon", "status": ProductStatusActive},
+				"$unset":       bson.M{"categoryId": ""},
+				"$inc":         bson.M{"version": 1},
+			},
+		},
+		{
+			name:   "optional fields supplied empty are removed",
+			fields: []string{"sku", "name", "price", "description", "brand", "category", "status", "salePrice", "prices"},
+			want: bson.M{
+				"$set": bson.M{
+					"name": "Camera", "slug": "camera", "price": money.New(24900, "USD"),
+					"description": "A camera", "brand": "Nikon", "category": "Cameras",
+					"categoryId": &categoryID, "status": ProductStatusActive,
+				},
+				"$unset": bson.M{"salePrice": "", "prices": ""},
+				"$inc":   bson.M{"version": 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := product
+			if tt.product != nil {
+				tt.product(&p)
+			}
+			fields := make(map[string]bool, len(tt.fields))
+			for _, name := range tt.fields {
+				fields[name] = true
+			}
+			model := importWriteModel(p, fields, "").(*mongo.UpdateOneModel)
+			if got := model.Update.(bson.M); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("update = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EventInventoryLowStock is published to catalogExchange when a SKU's stock
+// falls to its reorder threshold.
+const EventInventoryLowStock = "inventory.low_stock"
+
+// defaultWarehouse holds all stock when WAREHOUSES is not set.
+const defaultWarehouse = "main"
+
+// lowStockCheckInterval is how often the checker looks for low stock.
+const lowStockCheckInterval = 5 * time.Minute
+
+// Sell-through is measured over the last sellThroughDefaultDays days of orders
+// unless the report asks for another window.
+const (
+	sellThroughDefaultDays = 30
+	sellThroughMaxDays     = 365
+)
+
+// StockLevel is the stock of one SKU across the warehouses. Quantity is the
+// total of Warehouses, kept in step on every write. A SKU is low on stock once
+// Quantity is at or below a positive ReorderThreshold; a threshold of 0
+// disables alerts.
+type StockLevel struct {
+	SKU              string           `json:"sku" bson:"_id"`
+	Warehouses       map[string]int64 `json:"warehouses" bson:"warehouses"`
+	Quantity         int64            `json:"quantity" bson:"quantity"`
+	ReorderThreshold int64            `json:"reorderThreshold" bson:"reorderThreshold"`
+	// LowStockSince is set when the low-stock event is emitted and cleared once
+	// the SKU is restocked above its threshold, so each shortage is reported once.
+	LowStockSince *time.Time `json:"lowStockSince,omitempty" bson:"lowStockSince,omitempty"`
+	UpdatedAt     time.Time  `json:"updatedAt" bson:"updatedAt"`
+}
+
+// LowStockEvent is the message body of an inventory.low_stock event.
+type LowStockEvent struct {
+	EventID          string    `json:"eventId"`
+	Type             string    `json:"type"`
+	OccurredAt       time.Time `json:"occurredAt"`
+	SKU              string    `json:"sku"`
+	Quantity         int64     `json:"quantity"`
+	ReorderThreshold int64     `json:"reorderThreshold"`
+}
+
+// LowStockItem is a SKU in the low-stock report. SellThroughRate is the share
+// of the window's stock that sold: UnitsSold / (UnitsSold + Quantity).
+type LowStockItem struct {
+	StockLevel
+	Name            string  `json:"name"`
+	UnitsSold       int64   `json:"unitsSold"`
+	SellThroughRate float64 `json:"sellThroughRate"`
+}
+
+type LowStockReport struct {
+	WindowDays int            `json:"windowDays"`
+	Items      []LowStockItem `json:"items"`
+}
+
+// lowStockFilter matches the SKUs at or below their reorder threshold.
+func lowStockFilter() bson.M {
+	return bson.M{
+		"reorderThreshold": bson.M{"$gt": 0},
+		"$expr":            bson.M{"$lte": bson.A{"$quantity", "$reorderThreshold"}},
+	}
+}
+
+// putStockLevelHandler sets the stock of a SKU in some warehouses and/or its
+// reorder threshold (PUT /api/admin/inventory/{sku}).
+// Body: {"warehouses": {"north": 12}, "reorderThreshold": 5}. Warehouses and
+// fields left out keep their value.
+func (env *Env) putStockLevelHandler(w http.ResponseWriter, r *http.Request) {
+	sku := r.PathValue("sku")
+	var req struct {
+		Warehouses       map[string]int64 `json:"warehouses"`
+		ReorderThreshold *int64           `json:"reorderThreshold"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Warehouses) == 0 && req.ReorderThreshold == nil {
+		http.Error(w, "warehouses or reorderThreshold is required", http.StatusBadRequest)
+		return
+	}
+	for warehouse, quantity := range req.Warehouses {
+		if !slices.Contains(env.warehouses, warehouse) {
+			http.Error(w, "Unknown warehouse "+warehouse, http.StatusBadRequest)
+			return
+		}
+		if quantity < 0 {
+			http.Error(w, "Stock must not be negative", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.ReorderThreshold != nil && *req.ReorderThreshold < 0 {
+		http.Error(w, "reorderThreshold must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var product Product
+	err := env.collection.FindOne(ctx,
+		bson.M{"sku": sku, "status": bson.M{"$ne": ProductStatusDeleted}},
+		options.FindOne().SetProjection(bson.M{"components": 1}),
+	).Decode(&product)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		http.Error(w, "Product with that SKU not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(product.Components) > 0 {
+		http.Error(w, "A bundle has no stock of its own; stock its components", http.StatusBadRequest)
+		return
+	}
+
+	set := bson.M{"updatedAt": time.Now()}
+	for warehouse, quantity := range req.Warehouses {
+		set["warehouses."+warehouse] = quantity
+	}
+	if req.ReorderThreshold != nil {
+		set["reorderThreshold"] = *req.ReorderThreshold
+	}
+	update := append(mongo.Pipeline{{{Key: "$set", Value: set}}}, recountStock()...)
+	var level StockLevel
+	err = env.inventory.FindOneAndUpdate(ctx, bson.M{"_id": sku}, update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&level)
+	if err != nil {
+		log.Printf("Error updating stock of %s: %v", sku, err)
+		http.Error(w, "Failed to update stock", http.StatusInternalServerError)
+		return
+	}
+	// Listings show availability.
+	env.cache.invalidateProducts(ctx, sku)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(level)
+}
+
+// recountStock are the final stages of every update pipeline that changes
+// warehouse stock. They total the warehouses and clear the low-stock flag in
+// the same write that lifts the SKU above its threshold.
+func recountStock() mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"quantity": bson.M{"$sum": bson.M{"$map": bson.M{
+				"input": bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$warehouses", bson.M{}}}},
+				"in":    "$$this.v",
+			}}},
+			"reorderThreshold": bson.M{"$ifNull": bson.A{"$reorderThreshold", 0}},
+		}}},
+		{{Key: "$set", Value: bson.M{"lowStockSince": bson.M{"$cond": bson.A{
+			bson.M{"$or": bson.A{
+				bson.M{"$lte": bson.A{"$reorderThreshold", 0}},
+				bson.M{"$gt": bson.A{"$quantity", "$reorderThreshold"}},
+			}},
+			"$$REMOVE",
+			"$lowStockSince",
+		}}}}},
+	}
+}
+
+// getLowStockHandler lists the SKUs at or below their reorder threshold, the
+// fastest selling first (GET /api/admin/inventory/low-stock?days=30).
+func (env *Env) getLowStockHandler(w http.ResponseWriter, r *http.Request) {
+	days := sellThroughDefaultDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > sellThroughMaxDays {
+			http.Error(w, "days must be between 1 and "+strconv.Itoa(sellThroughMaxDays), http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := env.inventory.Find(ctx, lowStockFilter())
+	if err != nil {
+		http.Error(w, "Failed to fetch stock levels", http.StatusInternalServerError)
+		return
+	}
+	var levels []StockLevel
+	if err := cursor.All(ctx, &levels); err != nil {
+		http.Error(w, "Failed to decode stock levels", http.StatusInternalServerError)
+		return
+	}
+	skus := make([]string, len(levels))
+	for i, level := range levels {
+		skus[i] = level.SKU
+	}
+
+	sold, err := env.unitsSold(ctx, skus, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		log.Printf("Error computing sell-through: %v", err)
+		http.Error(w, "Failed to read orders", http.StatusInternalServerError)
+		return
+	}
+	names := make(map[string]string, len(skus))
+	cursor, err = env.collection.Find(ctx, bson.M{"sku": bson.M{"$in": skus}}, options.Find().SetProjection(bson.M{"sku": 1, "name": 1}))
+	if err != nil {
+		http.Error(w, "Failed to fetch products", http.StatusInternalServerError)
+		return
+	}
+	var products []Product
+	if err := cursor.All(ctx, &products); err != nil {
+		http.Error(w, "Failed to decode products", http.StatusInternalServerError)
+		return
+	}
+	for _, p := range products {
+		names[p.SKU] = p.Name
+	}
+
+	items := make([]LowStockItem, len(levels))
+	for i, level := range levels {
+		item := LowStockItem{StockLevel: level, Name: names[level.SKU], UnitsSold: sold[level.SKU]}
+		if total := item.UnitsSold + max(level.Quantity, 0); total > 0 {
+			item.SellThroughRate = float64(item.UnitsSold) / float64(total)
+		}
+		items[i] = item
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].SellThroughRate != items[j].SellThroughRate {
+			return items[i].SellThroughRate > items[j].SellThroughRate
+		}
+		return items[i].SKU < items[j].SKU
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LowStockReport{WindowDays: days, Items: items})
+}
+
+// unitsSold sums the quantities of skus in the orders placed since since.
+func (env *Env) unitsSold(ctx context.Context, skus []string, since time.Time) (map[string]int64, error) {
+	sold := make(map[string]int64, len(skus))
+	if len(skus) == 0 {
+		return sold, nil
+	}
+	cursor, err := env.orders.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"createdAt": bson.M{"$gte": since}, "items.sku": bson.M{"$in": skus}}}},
+		{{Key: "$unwind", Value: "$items"}},
+		{{Key: "$match", Value: bson.M{"items.sku": bson.M{"$in": skus}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$items.sku", "units": bson.M{"$sum": "$items.quantity"}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		SKU   string `bson:"_id"`
+		Units int64  `bson:"units"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		sold[row.SKU] = row.Units
+	}
+	return sold, nil
+}
+
+// runLowStockChecker emits low-stock events until ctx is cancelled.
+func (env *Env) runLowStockChecker(ctx context.Context) {
+	ticker := time.NewTicker(lowStockCheckInterval)
+	defer ticker.Stop()
+	for {
+		env.checkLowStock(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkLowStock writes an inventory.low_stock event to the outbox for every
+// SKU that became low on stock since the last pass. Each SKU is claimed by
+// setting LowStockSince first, so several replicas never report it twice.
+func (env *Env) checkLowStock(ctx context.Context) {
+	filter := lowStockFilter()
+	filter["lowStockSince"] = bson.M{"$exists": false}
+	for {
+		now := time.Now()
+		var level StockLevel
+		err := env.inventory.FindOneAndUpdate(ctx, filter,
+			bson.M{"$set": bson.M{"lowStockSince": now}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&level)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return
+		}
+		if err != nil {
+			log.Printf("Low-stock checker failed to claim a SKU: %v", err)
+			return
+		}
+
+		id := primitive.NewObjectID()
+		body, _ := json.Marshal(LowStockEvent{
+			EventID:          id.Hex(),
+			Type:             EventInventoryLowStock,
+			OccurredAt:       now,
+			SKU:              level.SKU,
+			Quantity:         level.Quantity,
+			ReorderThreshold: level.ReorderThreshold,
+		})
+		_, err = env.outbox.InsertOne(ctx, OutboxEvent{ID: id, RoutingKey: EventInventoryLowStock, Body: body, CreatedAt: now})
+		if err != nil {
+			// Release the claim so the next pass reports the SKU.
+			log.Printf("Failed to record low-stock event for %s: %v", level.SKU, err)
+			if _, err := env.inventory.UpdateOne(ctx, bson.M{"_id": level.SKU}, bson.M{"$unset": bson.M{"lowStockSince": ""}}); err != nil {
+				log.Printf("CRITICAL: low-stock alert for %s is lost: %v", level.SKU, err)
+			}
+			return
+		}
+		log.Printf("SKU %s is low on stock: %d left, reorder threshold %d", level.SKU, level.Quantity, level.ReorderThreshold)
+	}
+}
+
+// resolveStock fills in the availability of products from their stock levels,
+// and that of bundles from their components. A product without a stock level
+// isn't tracked and is always in stock.
+func (env *Env) resolveStock(ctx context.Context, products []Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+	var skus, componentSKUs []string
+	for _, p := range products {
+		skus = append(skus, p.SKU)
+		for _, c := range p.Components {
+			componentSKUs = append(componentSKUs, c.SKU)
+		}
+	}
+	cursor, err := env.inventory.Find(ctx, bson.M{"_id": bson.M{"$in": append(skus, componentSKUs...)}}, options.Find().SetProjection(bson.M{"quantity": 1}))
+	if err != nil {
+		return err
+	}
+	var levels []StockLevel
+	if err := cursor.All(ctx, &levels); err != nil {
+		return err
+	}
+	quantities := make(map[string]int64, len(levels))
+	for _, level := range levels {
+		quantities[level.SKU] = level.Quantity
+	}
+	var sellable map[string]bool
+	if len(componentSKUs) > 0 {
+		if sellable, err = env.sellableSKUs(ctx, componentSKUs); err != nil {
+			return err
+		}
+	}
+
+	for i := range products {
+		p := &products[i]
+		quantity, tracked := quantities[p.SKU]
+		if len(p.Components) > 0 {
+			quantity, tracked = bundleStock(p.Components, quantities, sellable)
+		}
+		p.StockQuantity = nil
+		p.InStock = !tracked || quantity > 0
+		if tracked {
+			p.StockQuantity = &quantity
+		}
+	}
+	return nil
+}
+
+// parseWarehouses reads the WAREHOUSES setting: warehouse codes separated by
+// commas, the preferred warehouse first.
+func parseWarehouses(value string) ([]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return []string{defaultWarehouse}, nil
+	}
+	var warehouses []string
+	for _, code := range strings.Split(value, ",") {
+		code = strings.TrimSpace(code)
+		if !attributeKeyPattern.MatchString(code) {
+			return nil, fmt.Errorf("invalid warehouse code %q", code)
+		}
+		if slices.Contains(warehouses, code) {
+			return nil, fmt.Errorf("warehouse %s is listed twice", code)
+		}
+		warehouses = append(warehouses, code)
+	}
+	return warehouses, nil
+}
+
+// migrateStockWarehouses puts stock recorded before warehouses existed into
+// the preferred warehouse.
+func migrateStockWarehouses(ctx context.Context, inventory *mongo.Collection, warehouse string) (int64, error) {
+	result, err := inventory.UpdateMany(ctx,
+		bson.M{"warehouses": bson.M{"$exists": false}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"warehouses": bson.M{warehouse: bson.M{"$ifNull": bson.A{"$quantity", 0}}},
+		}}}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
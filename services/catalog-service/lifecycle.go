@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// publishedFilter matches the products inside their publishing window at now.
+// It uses $and, so callers can still add an $or of their own.
+func publishedFilter(now time.Time) bson.M {
+	return bson.M{"$and": bson.A{
+		bson.M{"$or": bson.A{bson.M{"publishAt": nil}, bson.M{"publishAt": bson.M{"$lte": now}}}},
+		bson.M{"$or": bson.A{bson.M{"unpublishAt": nil}, bson.M{"unpublishAt": bson.M{"$gt": now}}}},
+	}}
+}
+
+// isPublished is publishedFilter for a product already in memory.
+func isPublished(publishAt, unpublishAt *time.Time, now time.Time) bool {
+	return (publishAt == nil || !publishAt.After(now)) && (unpublishAt == nil || unpublishAt.After(now))
+}
+
+// publicProductFilter matches the products shown in public listings: active
+// and currently published.
+func publicProductFilter() bson.M {
+	filter := publishedFilter(time.Now())
+	filter["status"] = ProductStatusActive
+	return filter
+}
+
+// isPublic is publicProductFilter for a product already in memory.
+func isPublic(p Product, now time.Time) bool {
+	return p.Status == ProductStatusActive && isPublished(p.PublishAt, p.UnpublishAt, now)
+}
+
+// viewableProductFilter matches the products that can be fetched individually
+// by ID, SKU or slug: the public ones, and archived products, which stay
+// reachable so links from old orders keep working.
+func viewableProductFilter() bson.M {
+	return bson.M{"$or": bson.A{publicProductFilter(), bson.M{"status": ProductStatusArchived}}}
+}
+
+// isViewable is viewableProductFilter for a product already in memory.
+func isViewable(p Product, now time.Time) bool {
+	return p.Status == ProductStatusArchived || isPublic(p, now)
+}
+
+// validatePublishing checks the publishing window of a product that is about
+// to be written.
+func validatePublishing(p Product) string {
+	if p.PublishAt != nil && p.UnpublishAt != nil && !p.UnpublishAt.After(*p.PublishAt) {
+		return "unpublishAt must be after publishAt"
+	}
+	return ""
+}
+
+// isEditableProductStatus reports whether status may be set through create,
+// PUT or PATCH. Deleting goes through DELETE so deletedAt is recorded.
+func isEditableProductStatus(status string) bool {
+	switch status {
+	case ProductStatusDraft, ProductStatusActive, ProductStatusArchived:
+		return true
+	}
+	return false
+}
+
+// migrateProductStatus marks products created before the lifecycle existed as active.
+func migrateProductStatus(ctx context.Context, collection *mongo.Collection) (int64, error) {
+	result, err := collection.UpdateMany(ctx,
+		bson.M{"status": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"status": ProductStatusActive}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// archiveProductHandler hides a product from listings while keeping it
+// resolvable for carts and order history.
+func (env *Env) archiveProductHandler(w http.ResponseWriter, r *http.Request) {
+	env.transitionProductStatus(w, r, ProductStatusArchived,
+		[]string{ProductStatusDraft, ProductStatusActive})
+}
+
+// restoreProductHandler brings an archived or deleted product back to active.
+func (env *Env) restoreProductHandler(w http.ResponseWriter, r *http.Request) {
+	env.transitionProductStatus(w, r, ProductStatusActive,
+		[]string{ProductStatusArchived, ProductStatusDeleted})
+}
+
+// transitionProductStatus moves a product to the target status if it is
+// currently in one of the allowed source states.
+func (env *Env) transitionProductStatus(w http.ResponseWriter, r *http.Request, target string, from []string) {
+	objID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID format", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	current, ok := env.findProductForWrite(ctx, w, r, objID)
+	if !ok {
+		return
+	}
+	allowed := false
+	for _, status := range from {
+		if current.Status == status {
+			allowed = true
+		}
+	}
+	if !allowed {
+		http.Error(w, "Cannot move a "+current.Status+" product to "+target, http.StatusConflict)
+		return
+	}
+
+	updated := current
+	updated.Status = target
+	env.replaceProduct(ctx, w, r, current, updated)
+}
+
+// getAdminProductsHandler lists products in every state for the back office.
+// An optional comma-separated "status" parameter narrows the result.
+func (env *Env) getAdminProductsHandler(w http.ResponseWriter, r *http.Request) {
+	filter := bson.M{}
+	if statusQuery := r.URL.Query().Get("status"); statusQuery != "" {
+		filter["status"] = bson.M{"$in": strings.Split(statusQuery, ",")}
+	}
+	env.listProducts(w, r, filter)
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// maxImageUploadSize caps a single image upload.
+const maxImageUploadSize = 10 << 20
+
+// Decoding allocates memory for every pixel, so the dimensions an image
+// declares are checked before it is decoded.
+const (
+	maxImageDimension = 8000
+	maxImagePixels    = 40_000_000
+)
+
+// thumbnailSizes are the widths generated for every uploaded image.
+// Height follows the original aspect ratio.
+var thumbnailSizes = []struct {
+	Name  string
+	Width int
+}{
+	{"small", 160},
+	{"medium", 480},
+	{"large", 1024},
+}
+
+// allowedImageTypes maps accepted upload content types to file extensions.
+var allowedImageTypes = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/webp": "webp",
+}
+
+// uploadProductImageHandler accepts a multipart upload (fields "image" and
+// "altText"), stores the original plus thumbnails and appends it to the product.
+func (env *Env) uploadProductImageHandler(w http.ResponseWriter, r *http.Request) {
+	objID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID format", http.StatusBadRequest)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageUploadSize)
+	if err := r.ParseMultipartForm(maxImageUploadSize); err != nil {
+		http.Error(w, "Image is too large or the form is invalid", http.StatusBadRequest)
+		return
+	}
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		http.Error(w, "An 'image' file field is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Failed to read image", http.StatusBadRequest)
+		return
+	}
+	contentType := http.DetectContentType(data)
+	ext, ok := allowedImageTypes[contentType]
+	if !ok {
+		http.Error(w, "Unsupported image type, use JPEG, PNG or WebP", http.StatusUnsupportedMediaType)
+		return
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		http.Error(w, "Image could not be decoded", http.StatusBadRequest)
+		return
+	}
+	if config.Width > maxImageDimension || config.Height > maxImageDimension ||
+		config.Width*config.Height > maxImagePixels {
+		http.Error(w, fmt.Sprintf("Image is too large, at most %dx%d pixels are allowed", maxImageDimension, maxImageDimension), http.StatusRequestEntityTooLarge)
+		return
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		http.Error(w, "Image could not be decoded", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var product Product
+	if err := env.collection.FindOne(ctx, bson.M{"_id": objID}).Decode(&product); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Product not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error finding product: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// --- Store the original and every thumbnail ---
+	imageID := primitive.NewObjectID().Hex()
+	prefix := "products/" + objID.Hex() + "/" + imageID + "/"
+	newImage := ProductImage{
+		ID:         imageID,
+		AltText:    r.FormValue("altText"),
+		Position:   len(product.Images),
+		Thumbnails: make(map[string]string, len(thumbnailSizes)),
+	}
+	if newImage.AltText == "" {
+		newImage.AltText = product.Name
+	}
+
+	originalKey := prefix + "original." + ext
+	newImage.URL, err = env.media.Put(ctx, originalKey, bytes.NewReader(data), int64(len(data)), contentType)
+	if err != nil {
+		log.Printf("Error storing image: %v", err)
+		http.Error(w, "Failed to store image", http.StatusInternalServerError)
+		return
+	}
+	newImage.Keys = append(newImage.Keys, originalKey)
+
+	for _, size := range thumbnailSizes {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, resizeToWidth(img, size.Width), &jpeg.Options{Quality: 85}); err != nil {
+			log.Printf("Error encoding %s thumbnail: %v", size.Name, err)
+			env.deleteMedia(newImage.Keys)
+			http.Error(w, "Failed to generate thumbnails", http.StatusInternalServerError)
+			return
+		}
+		key := prefix + size.Name + ".jpg"
+		url, err := env.media.Put(ctx, key, &buf, int64(buf.Len()), "image/jpeg")
+		if err != nil {
+			log.Printf("Error storing %s thumbnail: %v", size.Name, err)
+			env.deleteMedia(newImage.Keys)
+			http.Error(w, "Failed to store image", http.StatusInternalServerError)
+			return
+		}
+		newImage.Thumbnails[size.Name] = url
+		newImage.Keys = append(newImage.Keys, key)
+	}
+
+	// --- Attach the image reference to the product ---
+	err = env.writeWithEvents(ctx, userEmail(r), func(ctx context.Context) ([]OutboxEvent, error) {
+		return env.updateProductImages(ctx, &product, bson.M{"_id": objID}, bson.M{
+			"$push": bson.M{"images": newImage},
+			"$inc":  bson.M{"version": 1},
+		})
+	})
+	if err != nil {
+		log.Printf("Error attaching image to product: %v", err)
+		env.deleteMedia(newImage.Keys)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newImage)
+}
+
+// updateProductImageHandler changes the alt text of a single image.
+func (env *Env) updateProductImageHandler(w http.ResponseWriter, r *http.Request) {
+	objID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID format", http.StatusBadRequest)
+		return
+	}
+	var requestBody struct {
+		AltText string `json:"altText"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": objID, "images.id": r.PathValue("imageId")}
+	var events []OutboxEvent
+	err = env.writeWithEvents(ctx, userEmail(r), func(ctx context.Context) ([]OutboxEvent, error) {
+		events, err = env.updateProductImages(ctx, nil, filter, bson.M{
+			"$set": bson.M{"images.$.altText": requestBody.AltText},
+			"$inc": bson.M{"version": 1},
+		})
+		return events, err
+	})
+	if err != nil {
+		log.Printf("Error updating image: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(events) == 0 {
+		http.Error(w, "Product or image not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reorderProductImagesHandler sets the display order of a product's images.
+// The body must list every image ID exactly once: {"imageIds": ["...", "..."]}.
+func (env *Env) reorderProductImagesHandler(w http.ResponseWriter, r *http.Request) {
+	objID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID format", http.StatusBadRequest)
+		return
+	}
+	var requestBody struct {
+		ImageIDs []string `json:"imageIds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var product Product
+	if err := env.collection.FindOne(ctx, bson.M{"_id": objID}).Decode(&product); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Product not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error finding product: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	imagesByID := make(map[string]ProductImage, len(product.Images))
+	for _, img := range product.Images {
+		imagesByID[img.ID] = img
+	}
+	if len(requestBody.ImageIDs) != len(product.Images) {
+		http.Error(w, "imageIds must list every image of the product exactly once", http.StatusBadRequest)
+		return
+	}
+	reordered := make([]ProductImage, 0, len(product.Images))
+	for i, id := range requestBody.ImageIDs {
+		img, ok := imagesByID[id]
+		if !ok {
+			http.Error(w, "imageIds must list every image of the product exactly once", http.StatusBadRequest)
+			return
+		}
+		delete(imagesByID, id)
+		img.Position = i
+		reordered = append(reordered, img)
+	}
+
+	var events []OutboxEvent
+	err = env.writeWithEvents(ctx, userEmail(r), func(ctx context.Context) ([]OutboxEvent, error) {
+		events, err = env.updateProductImages(ctx, &product, versionFilter(objID, product.Version), bson.M{
+			"$set": bson.M{"images": reordered},
+			"$inc": bson.M{"version": 1},
+		})
+		return events, err
+	})
+	if err != nil {
+		log.Printf("Error reordering images: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(events) == 0 {
+		http.Error(w, "Product was modified concurrently, reload and retry", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reordered)
+}
+
+// deleteProductImageHandler detaches an image from the product and removes its files.
+func (env *Env) deleteProductImageHandler(w http.ResponseWriter, r *http.Request) {
+	objID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID format", http.StatusBadRequest)
+		return
+	}
+	imageID := r.PathValue("imageId")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var product Product
+	err = env.collection.FindOne(ctx, bson.M{"_id": objID, "images.id": imageID}).Decode(&product)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Product or image not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error finding product: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Drop the image and close the gap it leaves in the ordering.
+	remaining := make([]ProductImage, 0, len(product.Images))
+	var removed ProductImage
+	for _, img := range product.Images {
+		if img.ID == imageID {
+			removed = img
+			continue
+		}
+		img.Position = len(remaining)
+		remaining = append(remaining, img)
+	}
+	var events []OutboxEvent
+	err = env.writeWithEvents(ctx, userEmail(r), func(ctx context.Context) ([]OutboxEvent, error) {
+		events, err = env.updateProductImages(ctx, &product, versionFilter(objID, product.Version), bson.M{
+			"$set": bson.M{"images": remaining},
+			"$inc": bson.M{"version": 1},
+		})
+		return events, err
+	})
+	if err != nil {
+		log.Printf("Error removing image: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(events) == 0 {
+		http.Error(w, "Product was modified concurrently, reload and retry", http.StatusConflict)
+		return
+	}
+
+	env.deleteMedia(removed.Keys)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteMedia removes stored files on a best-effort basis; a leftover file is
+// harmless, so failures are only logged.
+func (env *Env) deleteMedia(keys []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, key := range keys {
+		if err := env.media.Delete(ctx, key); err != nil {
+			log.Printf("Failed to delete media %s: %v", key, err)
+		}
+	}
+}
+
+// resizeToWidth scales img down to the given width, keeping its aspect ratio.
+// Images already narrower than width are re-encoded at their original size.
+func resizeToWidth(img image.Image, width int) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() <= width {
+		width = bounds.Dx()
+	}
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	// Thumbnails are JPEGs, so flatten transparent areas onto white.
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+	return dst
+}
+
+// updateProductImages applies an image update to the product matching filter
+// and returns the resulting product.updated event, or none if nothing matched.
+func (env *Env) updateProductImages(ctx context.Context, before *Product, filter, update bson.M) ([]OutboxEvent, error) {
+	var after Product
+	err := env.collection.FindOneAndUpdate(ctx, filter, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&after)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []OutboxEvent{newProductEvent(EventProductUpdated, before, after, "images")}, nil
+}
@@ -1,13 +1,42 @@
 package main
 
 import (
+	"net/http"
+	"time"
+
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+
+	"three-tier-cloud-shop/money"
 )
 
-// Env holds the 'products' collection handle.
+// Env holds the collection handles, the media storage backend, the exchange
+// rates and the HTTP client for other services.
 type Env struct {
-	collection *mongo.Collection
+	collection      *mongo.Collection // products
+	priceHistory    *mongo.Collection
+	scheduledPrices *mongo.Collection
+	categories      *mongo.Collection
+	reviews         *mongo.Collection
+	reviewVotes     *mongo.Collection
+	// The co-purchase index, the orders it already counted, and the
+	// checkout-service's orders it can be rebuilt from.
+	coPurchases      *mongo.Collection
+	coPurchaseOrders *mongo.Collection
+	orders           *mongo.Collection
+	// Product events waiting to be published, and whether MongoDB can write
+	// them in the same transaction as the product.
+	outbox       *mongo.Collection
+	transactions bool
+	media        MediaStorage
+	httpClient   *http.Client // For calls to the checkout-service
+	rates        *exchangeRateTable
+	suggestions  *suggestionIndex
+	cache        *catalogCache
+	audit        *mongo.Collection // append-only product write history
+	inventory    *mongo.Collection // stock levels, keyed by SKU
+	allocations  *mongo.Collection // stock reserved per order
+	warehouses   []string          // in order of preference
 }
 
 // Product struct now includes all fields from our seed data.
@@ -16,9 +45,84 @@ type Product struct {
 	Name        string             `json:"name" bson:"name"`
 	Description string             `json:"description" bson:"description"`
 	SKU         string             `json:"sku" bson:"sku"`
-	Price       float64            `json:"price" bson:"price"`
-	Brand       string             `json:"brand" bson:"brand"`
-	Category    string             `json:"category" bson:"category"`
+	Price       money.Money        `json:"price" bson:"price"`
+	// Currency applies to every amount of the product; it is not stored separately.
+	Currency string `json:"currency" bson:"-"`
+	// Slug is the product's readable URL name; PreviousSlugs redirect to it.
+	Slug          string   `json:"slug" bson:"slug,omitempty"`
+	PreviousSlugs []string `json:"-" bson:"previousSlugs,omitempty"`
+	// An optional sale price, active between SaleStartsAt and SaleEndsAt (either may be open-ended).
+	SalePrice    *money.Money `json:"salePrice,omitempty" bson:"salePrice,omitempty"`
+	SaleStartsAt *time.Time `json:"saleStartsAt,omitempty" bson:"saleStartsAt,omitempty"`
+	SaleEndsAt   *time.Time `json:"saleEndsAt,omitempty" bson:"saleEndsAt,omitempty"`
+	// Prices holds explicit prices in other currencies, keyed by ISO 4217 code.
+	// Currencies without an entry are converted with the exchange rates.
+	Prices map[string]money.Money `json:"prices,omitempty" bson:"prices,omitempty"`
+	// EffectivePrice and OnSale are resolved at read time and never stored.
+	EffectivePrice money.Money `json:"effectivePrice" bson:"-"`
+	OnSale         bool   `json:"onSale" bson:"-"`
+	Brand          string `json:"brand" bson:"brand"`
+	Category       string `json:"category" bson:"category"`
+	// CategoryID places the product in the category tree; Category then
+	// mirrors that category's name.
+	CategoryID *primitive.ObjectID `json:"categoryId,omitempty" bson:"categoryId,omitempty"`
+	// Breadcrumbs run from the root category down to the product's own and
+	// are only filled in on product detail.
+	Breadcrumbs []Breadcrumb `json:"breadcrumbs,omitempty" bson:"-"`
+	// Attributes are typed specifications ("megapixels": 24), validated
+	// against the attribute schema of the category.
+	Attributes map[string]interface{} `json:"attributes,omitempty" bson:"attributes,omitempty"`
+	Images     []ProductImage         `json:"images" bson:"images,omitempty"`
+	// Components make the product a bundle of other SKUs, sold at its own
+	// price and shipped as its components.
+	Components []BundleComponent `json:"components,omitempty" bson:"components,omitempty"`
+	// AverageRating and ReviewCount summarize the approved reviews and are
+	// maintained by moderation, never by product writes.
+	AverageRating float64 `json:"averageRating" bson:"averageRating"`
+	ReviewCount   int64   `json:"reviewCount" bson:"reviewCount"`
+	// StockQuantity is the stock across all warehouses and InStock whether
+	// any is left, both resolved at read time; for a bundle, how many can be
+	// put together from its components. Products whose stock isn't tracked
+	// have no StockQuantity and are always in stock.
+	StockQuantity *int64 `json:"stockQuantity,omitempty" bson:"-"`
+	InStock       bool   `json:"inStock" bson:"-"`
+	// Version is incremented on every write and backs the ETag / If-Match checks.
+	Version   int64      `json:"version" bson:"version"`
+	Status    string     `json:"status" bson:"status"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+	// An active product is only public between PublishAt and UnpublishAt
+	// (either may be open-ended), so launches can be staged ahead of time.
+	PublishAt   *time.Time `json:"publishAt,omitempty" bson:"publishAt,omitempty"`
+	UnpublishAt *time.Time `json:"unpublishAt,omitempty" bson:"unpublishAt,omitempty"`
+}
+
+// Product lifecycle states. Only active products show up in public listings,
+// and only while they are published. Drafts are never public.
+const (
+	ProductStatusDraft    = "draft"
+	ProductStatusActive   = "active"
+	ProductStatusArchived = "archived"
+	ProductStatusDeleted  = "deleted"
+)
+
+// BatchProduct is a batch-get result. Draft, archived, deleted and unpublished
+// products are returned too, so callers must check Available before selling
+// them.
+type BatchProduct struct {
+	Product
+	Available bool `json:"available"`
+}
+
+// ProductImage references an uploaded image and its generated thumbnails.
+// Images are kept in display order; the first one is the primary image.
+type ProductImage struct {
+	ID         string            `json:"id" bson:"id"`
+	URL        string            `json:"url" bson:"url"`
+	AltText    string            `json:"altText" bson:"altText"`
+	Position   int               `json:"position" bson:"position"`
+	Thumbnails map[string]string `json:"thumbnails" bson:"thumbnails"`
+	// Keys are the storage keys of the original and every thumbnail, needed for cleanup.
+	Keys []string `json:"-" bson:"keys"`
 }
 
 type PaginatedProductsResponse struct {
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"three-tier-cloud-shop/money"
+)
+
+// priceSchedulerInterval is how often due scheduled prices are applied.
+const priceSchedulerInterval = time.Minute
+
+// Reasons recorded on price history entries.
+const (
+	PriceChangeCreated   = "created"
+	PriceChangeUpdated   = "updated"
+	PriceChangeImported  = "imported"
+	PriceChangeScheduled = "scheduled"
+)
+
+// PriceChange is an append-only record of a product's pricing at a point in time.
+type PriceChange struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	SKU          string             `json:"sku" bson:"sku"`
+	Price        money.Money        `json:"price" bson:"price"`
+	SalePrice    *money.Money       `json:"salePrice,omitempty" bson:"salePrice,omitempty"`
+	SaleStartsAt *time.Time         `json:"saleStartsAt,omitempty" bson:"saleStartsAt,omitempty"`
+	SaleEndsAt   *time.Time         `json:"saleEndsAt,omitempty" bson:"saleEndsAt,omitempty"`
+	Reason       string             `json:"reason" bson:"reason"`
+	ChangedBy    string             `json:"changedBy" bson:"changedBy"`
+	ChangedAt    time.Time          `json:"changedAt" bson:"changedAt"`
+}
+
+// ScheduledPrice is a future change of a product's regular price.
+type ScheduledPrice struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	SKU         string             `json:"sku" bson:"sku"`
+	Price       money.Money        `json:"price" bson:"price"`
+	EffectiveAt time.Time          `json:"effectiveAt" bson:"effectiveAt"`
+	CreatedBy   string             `json:"createdBy" bson:"createdBy"`
+	CreatedAt   time.Time          `json:"createdAt" bson:"createdAt"`
+	AppliedAt   *time.Time         `json:"appliedAt,omitempty" bson:"appliedAt,omitempty"`
+	// Rejected says why a due schedule was not applied, e.g. because the
+	// product was deleted; AppliedAt then records when that was decided.
+	Rejected string `json:"rejected,omitempty" bson:"rejected,omitempty"`
+}
+
+var (
+	// errScheduleRejected is returned when a due schedule can't be applied
+	// to its product and retrying won't help.
+	errScheduleRejected = errors.New("scheduled price rejected")
+	// errScheduleConflict is returned when the product changed while a
+	// schedule was applied to it.
+	errScheduleConflict = errors.New("product changed while applying scheduled price")
+)
+
+// resolvePricing sets EffectivePrice to the sale price while a sale is running,
+// and to the regular price otherwise.
+func (p *Product) resolvePricing(now time.Time) {
+	p.Currency = p.Price.Currency
+	p.EffectivePrice = p.Price
+	p.OnSale = false
+	if p.SalePrice == nil {
+		return
+	}
+	if p.SaleStartsAt != nil && now.Before(*p.SaleStartsAt) {
+		return
+	}
+	if p.SaleEndsAt != nil && !now.Before(*p.SaleEndsAt) {
+		return
+	}
+	p.EffectivePrice = *p.SalePrice
+	p.OnSale = true
+}
+
+// applyCurrency puts every amount of a product decoded from JSON into the
+// product's currency, since amounts in JSON don't carry one themselves.
+func (p *Product) applyCurrency() error {
+	p.Currency = money.NormalizeCurrency(p.Currency)
+	var err error
+	if p.Price, err = p.Price.In(p.Currency); err != nil {
+		return fmt.Errorf("price: %w", err)
+	}
+	if p.SalePrice != nil {
+		salePrice, err := p.SalePrice.In(p.Currency)
+		if err != nil {
+			return fmt.Errorf("salePrice: %w", err)
+		}
+		p.SalePrice = &salePrice
+	}
+	// The price list is keyed by currency, so each entry takes its key's.
+	if len(p.Prices) > 0 {
+		prices := make(map[string]money.Money, len(p.Prices))
+		for currency, price := range p.Prices {
+			currency = money.NormalizeCurrency(currency)
+			if prices[currency], err = price.In(currency); err != nil {
+				return fmt.Errorf("prices.%s: %w", currency, err)
+			}
+		}
+		p.Prices = prices
+	}
+	return nil
+}
+
+// validateSale checks the sale fields of a product that is about to be written.
+func validateSale(p Product) string {
+	if p.SalePrice == nil {
+		if p.SaleStartsAt != nil || p.SaleEndsAt != nil {
+			return "saleStartsAt and saleEndsAt require a salePrice"
+		}
+		return ""
+	}
+	if !p.SalePrice.IsPositive() || p.SalePrice.Cmp(p.Price) >= 0 {
+		return "salePrice must be positive and lower than price"
+	}
+	if p.SaleStartsAt != nil && p.SaleEndsAt != nil && !p.SaleEndsAt.After(*p.SaleStartsAt) {
+		return "saleEndsAt must be after saleStartsAt"
+	}
+	return ""
+}
+
+// validatePriceList checks the explicit per-currency prices of a product.
+func validatePriceList(p Product) string {
+	for currency, price := range p.Prices {
+		if !price.IsPositive() {
+			return "prices." + currency + " must be positive"
+		}
+	}
+	return ""
+}
+
+// pricingChanged reports whether any pricing field differs between two versions.
+func pricingChanged(before, after Product) bool {
+	return before.Price != after.Price ||
+		!equalMoneyPtr(before.SalePrice, after.SalePrice) ||
+		!equalTimePtr(before.SaleStartsAt, after.SaleStartsAt) ||
+		!equalTimePtr(before.SaleEndsAt, after.SaleEndsAt)
+}
+
+func equalMoneyPtr(a, b *money.Money) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func equalTimePtr(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// recordPriceChange appends the product's current pricing to the history.
+// History is best-effort: the product write already happened, so a failure is logged.
+func (env *Env) recordPriceChange(ctx context.Context, p Product, reason, changedBy string) {
+	entry := PriceChange{
+		SKU:          p.SKU,
+		Price:        p.Price,
+		SalePrice:    p.SalePrice,
+		SaleStartsAt: p.SaleStartsAt,
+		SaleEndsAt:   p.SaleEndsAt,
+		Reason:       reason,
+		ChangedBy:    changedBy,
+		ChangedAt:    time.Now(),
+	}
+	if _, err := env.priceHistory.InsertOne(ctx, entry); err != nil {
+		log.Printf("Failed to record price history for SKU %s: %v", p.SKU, err)
+	}
+}
+
+// userEmail returns the authenticated user placed in the context by jwtMiddleware.
+func userEmail(r *http.Request) string {
+	email, _ := r.Context().Value(UserEmailKey).(string)
+	return email
+}
+
+// getPriceHistoryHandler returns every recorded price of a SKU, newest first.
+func (env *Env) getPriceHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	sku := r.PathValue("sku")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "changedAt", Value: -1}})
+	cursor, err := env.priceHistory.Find(ctx, bson.M{"sku": sku}, opts)
+	if err != nil {
+		http.Error(w, "Failed to fetch price history", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	history := make([]PriceChange, 0)
+	if err = cursor.All(ctx, &history); err != nil {
+		http.Error(w, "Failed to decode price history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// schedulePriceHandler plans a future regular price for a SKU.
+// Body: {"price": 1999.99, "effectiveAt": "2026-11-27T00:00:00Z"}.
+func (env *Env) schedulePriceHandler(w http.ResponseWriter, r *http.Request) {
+	sku := r.PathValue("sku")
+	var scheduled ScheduledPrice
+	if err := json.NewDecoder(r.Body).Decode(&scheduled); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !scheduled.Price.IsPositive() || !scheduled.EffectiveAt.After(time.Now()) {
+		http.Error(w, "A positive price and a future effectiveAt are required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var product Product
+	err := env.collection.FindOne(ctx, bson.M{"sku": sku, "status": bson.M{"$ne": ProductStatusDeleted}}).Decode(&product)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Product with that SKU not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error checking SKU %s: %v", sku, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	// The scheduled price is in the product's currency.
+	if scheduled.Price, err = scheduled.Price.In(product.Price.Currency); err != nil {
+		http.Error(w, "Invalid price: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	product.Price = scheduled.Price
+	if msg := validateSale(product); msg != "" {
+		http.Error(w, "Scheduled price conflicts with the product's sale: "+msg, http.StatusBadRequest)
+		return
+	}
+
+	scheduled.ID = primitive.NilObjectID
+	scheduled.SKU = sku
+	scheduled.CreatedBy = userEmail(r)
+	scheduled.CreatedAt = time.Now()
+	scheduled.AppliedAt = nil
+	insertResult, err := env.scheduledPrices.InsertOne(ctx, scheduled)
+	if err != nil {
+		log.Printf("Error scheduling price: %v", err)
+		http.Error(w, "Failed to schedule price", http.StatusInternalServerError)
+		return
+	}
+	scheduled.ID = insertResult.InsertedID.(primitive.ObjectID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(scheduled)
+}
+
+// getScheduledPricesHandler lists the pending scheduled prices of a SKU.
+func (env *Env) getScheduledPricesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"sku": r.PathValue("sku"), "appliedAt": bson.M{"$exists": false}}
+	opts := options.Find().SetSort(bson.D{{Key: "effectiveAt", Value: 1}})
+	cursor, err := env.scheduledPrices.Find(ctx, filter, opts)
+	if err != nil {
+		http.Error(w, "Failed to fetch scheduled prices", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	scheduled := make([]ScheduledPrice, 0)
+	if err = cursor.All(ctx, &scheduled); err != nil {
+		http.Error(w, "Failed to decode scheduled prices", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scheduled)
+}
+
+// deleteScheduledPriceHandler cancels a scheduled price that hasn't been applied yet.
+func (env *Env) deleteScheduledPriceHandler(w http.ResponseWriter, r *http.Request) {
+	objID, err := primitive.ObjectIDFromHex(r.PathValue("scheduleId"))
+	if err != nil {
+		http.Error(w, "Invalid schedule ID format", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": objID, "sku": r.PathValue("sku"), "appliedAt": bson.M{"$exists": false}}
+	result, err := env.scheduledPrices.DeleteOne(ctx, filter)
+	if err != nil {
+		log.Printf("Error deleting scheduled price: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if result.DeletedCount == 0 {
+		http.Error(w, "Scheduled price not found or already applied", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runPriceScheduler applies due scheduled prices until ctx is cancelled.
+func (env *Env) runPriceScheduler(ctx context.Context) {
+	ticker := time.NewTicker(priceSchedulerInterval)
+	defer ticker.Stop()
+	for {
+		env.applyDueScheduledPrices(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// applyDueScheduledPrices applies every scheduled price whose time has come,
+// oldest first. Each schedule is claimed atomically, so several replicas can
+// run the scheduler without applying a price twice. A price the product can't
+// take, e.g. one no longer above its sale price, is rejected; a schedule that
+// failed for any other reason is released and tried again on the next pass.
+func (env *Env) applyDueScheduledPrices(ctx context.Context) {
+	for {
+		now := time.Now()
+		var scheduled ScheduledPrice
+		err := env.scheduledPrices.FindOneAndUpdate(ctx,
+			bson.M{"appliedAt": bson.M{"$exists": false}, "effectiveAt": bson.M{"$lte": now}},
+			bson.M{"$set": bson.M{"appliedAt": now}},
+			options.FindOneAndUpdate().SetSort(bson.D{{Key: "effectiveAt", Value: 1}}),
+		).Decode(&scheduled)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return
+		}
+		if err != nil {
+			log.Printf("Price scheduler failed to claim a schedule: %v", err)
+			return
+		}
+
+		product, err := env.applyScheduledPrice(ctx, scheduled)
+		if errors.Is(err, errScheduleRejected) {
+			log.Printf("Price scheduler rejected %s for SKU %s: %v", scheduled.ID.Hex(), scheduled.SKU, err)
+			if _, err := env.scheduledPrices.UpdateOne(ctx, bson.M{"_id": scheduled.ID}, bson.M{"$set": bson.M{"rejected": err.Error()}}); err != nil {
+				log.Printf("Failed to record why %s was rejected: %v", scheduled.ID.Hex(), err)
+			}
+			continue
+		}
+		if err != nil {
+			// Release the claim so the next pass tries again.
+			log.Printf("Price scheduler could not apply %s to SKU %s: %v", scheduled.ID.Hex(), scheduled.SKU, err)
+			if _, err := env.scheduledPrices.UpdateOne(ctx, bson.M{"_id": scheduled.ID}, bson.M{"$unset": bson.M{"appliedAt": ""}}); err != nil {
+				log.Printf("CRITICAL: scheduled price %s is lost: %v", scheduled.ID.Hex(), err)
+			}
+			return
+		}
+		env.recordPriceChange(ctx, product, PriceChangeScheduled, scheduled.CreatedBy)
+		log.Printf("Applied scheduled price %s %s to SKU %s.", scheduled.Price, scheduled.Price.Currency, scheduled.SKU)
+	}
+}
+
+// applyScheduledPrice sets the regular price of the schedule's product, with
+// the same sale price rule as an edit, and returns the updated product.
+func (env *Env) applyScheduledPrice(ctx context.Context, scheduled ScheduledPrice) (Product, error) {
+	var product Product
+	err := env.writeWithEvents(ctx, scheduled.CreatedBy, func(ctx context.Context) ([]OutboxEvent, error) {
+		var before Product
+		err := env.collection.FindOne(ctx, bson.M{"sku": scheduled.SKU, "status": bson.M{"$ne": ProductStatusDeleted}}).Decode(&before)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, fmt.Errorf("%w: product not found", errScheduleRejected)
+		}
+		if err != nil {
+			return nil, err
+		}
+		product = before
+		product.Price, product.Version = scheduled.Price, before.Version+1
+		if msg := validateSale(product); msg != "" {
+			return nil, fmt.Errorf("%w: %s", errScheduleRejected, msg)
+		}
+		result, err := env.collection.UpdateOne(ctx, versionFilter(before.ID, before.Version),
+			bson.M{"$set": bson.M{"price": scheduled.Price}, "$inc": bson.M{"version": 1}})
+		if err != nil {
+			return nil, err
+		}
+		if result.MatchedCount == 0 {
+			return nil, errScheduleConflict
+		}
+		return []OutboxEvent{newProductEvent(EventProductUpdated, &before, product)}, nil
+	})
+	return product, err
+}
+
+// migrateLegacyPrices converts prices stored as floating-point numbers into
+// Money documents. Every legacy price was in money.DefaultCurrency.
+func migrateLegacyPrices(ctx context.Context, collection *mongo.Collection, fields ...string) (int64, error) {
+	var migrated int64
+	for _, field := range fields {
+		result, err := collection.UpdateMany(ctx,
+			bson.M{field: bson.M{"$type": "number"}},
+			mongo.Pipeline{{{Key: "$set", Value: bson.M{field: bson.M{
+				"amount":   bson.M{"$toLong": bson.M{"$round": bson.A{bson.M{"$multiply": bson.A{"$" + field, 100}}, 0}}},
+				"currency": money.DefaultCurrency,
+			}}}}},
+		)
+		if err != nil {
+			return migrated, err
+		}
+		migrated += result.ModifiedCount
+	}
+	return migrated, nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"three-tier-cloud-shop/money"
+)
+
+// Prices are compared within a category and currency. Groups smaller than
+// outlierMinGroup are too small to call anything an outlier; otherwise a price
+// outside the Tukey fences (outlierFence interquartile ranges beyond the
+// quartiles) is reported.
+const (
+	outlierMinGroup = 5
+	outlierFence    = 1.5
+)
+
+// cartKeyPattern matches the carts the cart-service keeps in Redis, one hash
+// per user with a field per SKU.
+const cartKeyPattern = "cart:*"
+
+// QualityReport lists the data-quality problems found in the catalog.
+// Deleted products are left out of every check except the references from
+// carts and orders. CartsChecked is false when Redis could not be read.
+type QualityReport struct {
+	GeneratedAt         time.Time        `json:"generatedAt"`
+	ProductsScanned     int64            `json:"productsScanned"`
+	MissingDescriptions []QualityProduct `json:"missingDescriptions"`
+	ZeroPrices          []QualityProduct `json:"zeroPrices"`
+	PriceOutliers       []PriceOutlier   `json:"priceOutliers"`
+	DuplicateNames      []DuplicateName  `json:"duplicateNames"`
+	DanglingSKUs        []DanglingSKU    `json:"danglingSkus"`
+	BrandVariants       []BrandVariants  `json:"brandVariants"`
+	CartsChecked        bool             `json:"cartsChecked"`
+}
+
+// QualityProduct identifies a product in the report.
+type QualityProduct struct {
+	ID     string `json:"id"`
+	SKU    string `json:"sku"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// PriceOutlier is a price far from the others in its category.
+type PriceOutlier struct {
+	QualityProduct
+	Category string      `json:"category"`
+	Price    money.Money `json:"price"`
+	Median   money.Money `json:"median"`
+	Currency string      `json:"currency"`
+}
+
+// DuplicateName is a name, compared without case and surrounding spaces,
+// that several products share.
+type DuplicateName struct {
+	Name string   `json:"name"`
+	SKUs []string `json:"skus"`
+}
+
+// DanglingSKU is a SKU that carts or orders still reference although its
+// product is gone. Status is "missing" when no product has the SKU at all.
+type DanglingSKU struct {
+	SKU    string `json:"sku"`
+	Status string `json:"status"`
+	Orders int64  `json:"orders"`
+	Carts  int64  `json:"carts"`
+}
+
+// BrandVariants are spellings of one brand that differ only in case or
+// surrounding spaces.
+type BrandVariants struct {
+	Variants []string `json:"variants"`
+}
+
+// getCatalogHealthHandler scans the whole catalog and reports its data-quality
+// problems (GET /api/admin/catalog-health).
+func (env *Env) getCatalogHealthHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	report := QualityReport{
+		GeneratedAt:         time.Now(),
+		MissingDescriptions: []QualityProduct{},
+		ZeroPrices:          []QualityProduct{},
+		PriceOutliers:       []PriceOutlier{},
+		DuplicateNames:      []DuplicateName{},
+		DanglingSKUs:        []DanglingSKU{},
+		BrandVariants:       []BrandVariants{},
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "sku", Value: 1}}).
+		SetProjection(bson.M{"sku": 1, "name": 1, "description": 1, "price": 1, "category": 1, "status": 1})
+	cursor, err := env.collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		http.Error(w, "Failed to fetch products", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	statuses := make(map[string]string)
+	names := make(map[string][]string)
+	nameOrder := []string{}
+	groups := make(map[[2]string][]Product)
+	var groupOrder [][2]string
+	for cursor.Next(ctx) {
+		var p Product
+		if err := cursor.Decode(&p); err != nil {
+			log.Printf("Skipping undecodable product: %v", err)
+			continue
+		}
+		statuses[p.SKU] = p.Status
+		if p.Status == ProductStatusDeleted {
+			continue
+		}
+		report.ProductsScanned++
+		entry := qualityProduct(p)
+
+		if strings.TrimSpace(p.Description) == "" {
+			report.MissingDescriptions = append(report.MissingDescriptions, entry)
+		}
+		if !p.Price.IsPositive() {
+			report.ZeroPrices = append(report.ZeroPrices, entry)
+		} else {
+			group := [2]string{p.Category, p.Price.Currency}
+			if _, ok := groups[group]; !ok {
+				groupOrder = append(groupOrder, group)
+			}
+			groups[group] = append(groups[group], p)
+		}
+		name := strings.ToLower(strings.TrimSpace(p.Name))
+		if _, ok := names[name]; !ok {
+			nameOrder = append(nameOrder, name)
+		}
+		names[name] = append(names[name], p.SKU)
+	}
+	if err := cursor.Err(); err != nil {
+		http.Error(w, "Failed to read products", http.StatusInternalServerError)
+		return
+	}
+
+	for _, group := range groupOrder {
+		report.PriceOutliers = append(report.PriceOutliers, priceOutliers(group[0], groups[group])...)
+	}
+	for _, name := range nameOrder {
+		if skus := names[name]; len(skus) > 1 {
+			report.DuplicateNames = append(report.DuplicateNames, DuplicateName{Name: name, SKUs: skus})
+		}
+	}
+
+	brands, err := env.collection.Distinct(ctx, "brand", bson.M{"status": bson.M{"$ne": ProductStatusDeleted}})
+	if err != nil {
+		http.Error(w, "Failed to fetch brands", http.StatusInternalServerError)
+		return
+	}
+	report.BrandVariants = brandVariants(brands)
+
+	orderRefs, err := orderedSKUs(ctx, env.orders)
+	if err != nil {
+		log.Printf("Error reading ordered SKUs: %v", err)
+		http.Error(w, "Failed to read orders", http.StatusInternalServerError)
+		return
+	}
+	var cartRefs map[string]int64
+	if env.cache != nil {
+		cartRefs, err = cartSKUs(ctx, env.cache.client)
+		if err != nil {
+			log.Printf("Could not read carts for the catalog health report: %v", err)
+		}
+		report.CartsChecked = err == nil
+	}
+	report.DanglingSKUs = danglingSKUs(statuses, orderRefs, cartRefs)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func qualityProduct(p Product) QualityProduct {
+	return QualityProduct{ID: p.ID.Hex(), SKU: p.SKU, Name: p.Name, Status: p.Status}
+}
+
+// priceOutliers returns the products of one category and currency whose price
+// lies outside the Tukey fences of the group.
+func priceOutliers(category string, products []Product) []PriceOutlier {
+	if len(products) < outlierMinGroup {
+		return nil
+	}
+	amounts := make([]float64, len(products))
+	for i, p := range products {
+		amounts[i] = float64(p.Price.Amount)
+	}
+	sort.Float64s(amounts)
+	q1, median, q3 := quantile(amounts, 0.25), quantile(amounts, 0.5), quantile(amounts, 0.75)
+	low, high := q1-outlierFence*(q3-q1), q3+outlierFence*(q3-q1)
+
+	var outliers []PriceOutlier
+	for _, p := range products {
+		if amount := float64(p.Price.Amount); amount < low || amount > high {
+			outliers = append(outliers, PriceOutlier{
+				QualityProduct: qualityProduct(p),
+				Category:       category,
+				Price:          p.Price,
+				Median:         money.Money{Amount: int64(median + 0.5), Currency: p.Price.Currency},
+				Currency:       p.Price.Currency,
+			})
+		}
+	}
+	return outliers
+}
+
+// quantile interpolates linearly between the closest ranks of sorted values.
+func quantile(sorted []float64, q float64) float64 {
+	pos := q * float64(len(sorted)-1)
+	i := int(pos)
+	if i+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[i] + (pos-float64(i))*(sorted[i+1]-sorted[i])
+}
+
+// brandVariants groups brand names that only differ in case or surrounding
+// spaces.
+func brandVariants(brands []interface{}) []BrandVariants {
+	byKey := make(map[string][]string)
+	var keys []string
+	for _, b := range brands {
+		brand, ok := b.(string)
+		if !ok || strings.TrimSpace(brand) == "" {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(brand))
+		if _, seen := byKey[key]; !seen {
+			keys = append(keys, key)
+		}
+		byKey[key] = append(byKey[key], brand)
+	}
+	sort.Strings(keys)
+	variants := []BrandVariants{}
+	for _, key := range keys {
+		if len(byKey[key]) > 1 {
+			variants = append(variants, BrandVariants{Variants: byKey[key]})
+		}
+	}
+	return variants
+}
+
+// orderedSKUs counts the orders that contain each SKU.
+func orderedSKUs(ctx context.Context, orders *mongo.Collection) (map[string]int64, error) {
+	cursor, err := orders.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$unwind", Value: "$items"}},
+		{{Key: "$group", Value: bson.M{"_id": bson.M{"sku": "$items.sku", "order": "$_id"}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$_id.sku", "orders": bson.M{"$sum": 1}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		SKU    string `bson:"_id"`
+		Orders int64  `bson:"orders"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	refs := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		refs[row.SKU] = row.Orders
+	}
+	return refs, nil
+}
+
+// cartSKUs counts the carts in Redis that contain each SKU.
+func cartSKUs(ctx context.Context, client *redis.Client) (map[string]int64, error) {
+	refs := make(map[string]int64)
+	iter := client.Scan(ctx, 0, cartKeyPattern, 500).Iterator()
+	for iter.Next(ctx) {
+		skus, err := client.HKeys(ctx, iter.Val()).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, sku := range skus {
+			refs[sku]++
+		}
+	}
+	return refs, iter.Err()
+}
+
+// danglingSKUs returns the referenced SKUs whose product is deleted or was
+// never in the catalog.
+func danglingSKUs(statuses map[string]string, orderRefs, cartRefs map[string]int64) []DanglingSKU {
+	seen := make(map[string]bool)
+	dangling := []DanglingSKU{}
+	for _, refs := range []map[string]int64{orderRefs, cartRefs} {
+		for sku := range refs {
+			status, exists := statuses[sku]
+			if seen[sku] || sku == "" || (exists && status != ProductStatusDeleted) {
+				continue
+			}
+			seen[sku] = true
+			if !exists {
+				status = "missing"
+			}
+			dangling = append(dangling, DanglingSKU{SKU: sku, Status: status, Orders: orderRefs[sku], Carts: cartRefs[sku]})
+		}
+	}
+	sort.Slice(dangling, func(i, j int) bool { return dangling[i].SKU < dangling[j].SKU })
+	return dangling
+}
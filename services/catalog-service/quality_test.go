@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+
+	"three-tier-cloud-shop/money"
+)
+
+func TestPriceOutliers(t *testing.T) {
+	products := func(amounts ...int64) []Product {
+		list := make([]Product, len(amounts))
+		for i, amount := range amounts {
+			list[i] = Product{SKU: string(rune('A' + i)), Price: money.New(amount, "EUR")}
+		}
+		return list
+	}
+	tests := []struct {
+		name       string
+		products   []Product
+		wantSKUs   []string
+		wantMedian int64
+	}{
+		{
+			name:     "group too small",
+			products: products(1000, 1000, 1000, 99900),
+		},
+		{
+			name:     "prices close together",
+			products: products(1000, 1100, 1200, 1300, 1400),
+		},
+		{
+			name:       "one price far above",
+			products:   products(1000, 1100, 1200, 1300, 99900),
+			wantSKUs:   []string{"E"},
+			wantMedian: 1200,
+		},
+		{
+			name:       "prices far on both sides",
+			products:   products(5, 1000, 1050, 1100, 1150, 1200, 50000),
+			wantSKUs:   []string{"A", "G"},
+			wantMedian: 1100,
+		},
+		{
+			name:       "median rounds half up",
+			products:   products(1000, 1001, 1002, 1003, 1004, 99999),
+			wantSKUs:   []string{"F"},
+			wantMedian: 1003,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := priceOutliers("cameras", tt.products)
+			if len(got) != len(tt.wantSKUs) {
+				t.Fatalf("priceOutliers = %+v, want SKUs %v", got, tt.wantSKUs)
+			}
+			for i, outlier := range got {
+				if outlier.SKU != tt.wantSKUs[i] {
+					t.Errorf("outlier %d = %s, want %s", i, outlier.SKU, tt.wantSKUs[i])
+				}
+				if want := money.New(tt.wantMedian, "EUR"); outlier.Median != want {
+					t.Errorf("outlier %s median = %+v, want %+v", outlier.SKU, outlier.Median, want)
+				}
+				if outlier.Category != "cameras" || outlier.Currency != "EUR" {
+					t.Errorf("outlier %s = %+v, want category cameras in EUR", outlier.SKU, outlier)
+				}
+			}
+		})
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	sorted := []float64{10, 20, 30, 40}
+	tests := []struct {
+		q    float64
+		want float64
+	}{
+		{0, 10},
+		{0.25, 17.5},
+		{0.5, 25},
+		{0.75, 32.5},
+		{1, 40},
+	}
+	for _, tt := range tests {
+		if got := quantile(sorted, tt.q); got != tt.want {
+			t.Errorf("quantile(%v) = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// coPurchaseQueue receives every order_created event from orders_exchange.
+const coPurchaseQueue = "catalog_co_purchases_queue"
+
+// amqpReconnectDelay is how long the consumer waits before reconnecting.
+const amqpReconnectDelay = 5 * time.Second
+
+// Related products are scored by how often they were bought together with the
+// product, then by how similar they are.
+const (
+	coPurchaseWeight    = 3
+	sameCategoryWeight  = 2
+	sameBrandWeight     = 1
+	relatedDefaultLimit = 8
+	relatedMaxLimit     = 24
+)
+
+// CoPurchase counts the orders that contained both SKU and RelatedSKU. Every
+// pair is stored in both directions.
+type CoPurchase struct {
+	SKU        string `bson:"sku"`
+	RelatedSKU string `bson:"relatedSku"`
+	Count      int64  `bson:"count"`
+}
+
+// RelatedProduct is a recommendation with the number of orders it shared
+// with the product it was recommended for.
+type RelatedProduct struct {
+	Product
+	CoPurchaseCount int64 `json:"coPurchaseCount"`
+}
+
+// orderEvent is the part of an order_created event the co-purchase index needs.
+type orderEvent struct {
+	ID    string `json:"id" bson:"-"`
+	Items []struct {
+		SKU string `json:"sku" bson:"sku"`
+	} `json:"items" bson:"items"`
+}
+
+// orderSKUs returns the distinct SKUs of an order in a stable order.
+func orderSKUs(order orderEvent) []string {
+	seen := make(map[string]bool, len(order.Items))
+	skus := make([]string, 0, len(order.Items))
+	for _, item := range order.Items {
+		if item.SKU != "" && !seen[item.SKU] {
+			seen[item.SKU] = true
+			skus = append(skus, item.SKU)
+		}
+	}
+	sort.Strings(skus)
+	return skus
+}
+
+// coPurchaseModels increments the count of every pair of SKUs by n.
+func coPurchaseModels(pairs map[[2]string]int64) []mongo.WriteModel {
+	models := make([]mongo.WriteModel, 0, len(pairs))
+	for pair, n := range pairs {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"sku": pair[0], "relatedSku": pair[1]}).
+			SetUpdate(bson.M{"$inc": bson.M{"count": n}}).
+			SetUpsert(true))
+	}
+	return models
+}
+
+// addOrderPairs adds every ordered pair of an order's SKUs to pairs.
+func addOrderPairs(pairs map[[2]string]int64, skus []string) {
+	for _, a := range skus {
+		for _, b := range skus {
+			if a != b {
+				pairs[[2]string{a, b}]++
+			}
+		}
+	}
+}
+
+// recordCoPurchases adds one order to the index. Orders are remembered by ID,
+// so a redelivered event is only counted once.
+func (env *Env) recordCoPurchases(ctx context.Context, order orderEvent) error {
+	skus := orderSKUs(order)
+	if len(skus) < 2 {
+		return nil
+	}
+	if order.ID != "" {
+		_, err := env.coPurchaseOrders.InsertOne(ctx, bson.M{"_id": order.ID})
+		if mongo.IsDuplicateKeyError(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	pairs := make(map[[2]string]int64)
+	addOrderPairs(pairs, skus)
+	_, err := env.coPurchases.BulkWrite(ctx, coPurchaseModels(pairs), options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// runCoPurchaseConsumer keeps the co-purchase index up to date from
+// order_created events, reconnecting to RabbitMQ whenever the connection drops.
+func (env *Env) runCoPurchaseConsumer(ctx context.Context, amqpURL string) {
+	for {
+		if err := env.consumeOrders(ctx, amqpURL); err != nil {
+			log.Printf("Co-purchase consumer stopped: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(amqpReconnectDelay):
+		}
+	}
+}
+
+func (env *Env) consumeOrders(ctx context.Context, amqpURL string) error {
+	conn, err := amqp.Dial(amqpURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	// Same declaration as the checkout-service, which publishes the events.
+	if err := ch.ExchangeDeclare("orders_exchange", "fanout", true, false, false, false, nil); err != nil {
+		return err
+	}
+	q, err := ch.QueueDeclare(coPurchaseQueue, true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	if err := ch.QueueBind(q.Name, "", "orders_exchange", false, nil); err != nil {
+		return err
+	}
+	// Acknowledge only after the index is updated, so nothing is lost on a crash.
+	msgs, err := ch.Consume(q.Name, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	log.Println("Co-purchase consumer waiting for orders.")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case d, ok := <-msgs:
+			if !ok {
+				return errors.New("delivery channel closed")
+			}
+			var order orderEvent
+			if err := json.Unmarshal(d.Body, &order); err != nil {
+				log.Printf("Discarding undecodable order event: %v", err)
+				d.Nack(false, false)
+				continue
+			}
+			writeCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			err := env.recordCoPurchases(writeCtx, order)
+			cancel()
+			if err != nil {
+				log.Printf("Failed to index order %s, requeueing: %v", order.ID, err)
+				d.Nack(false, true)
+				continue
+			}
+			d.Ack(false)
+		}
+	}
+}
+
+// rebuildCoPurchasesHandler recomputes the whole co-purchase index from the
+// orders collection, e.g. after the consumer was down or the scoring changed.
+// Orders placed while the rebuild runs may have to wait for the next one.
+func (env *Env) rebuildCoPurchasesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	cursor, err := env.orders.Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"items.sku": 1}))
+	if err != nil {
+		http.Error(w, "Failed to read orders", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	pairs := make(map[[2]string]int64)
+	var orderIDs []interface{}
+	for cursor.Next(ctx) {
+		var order orderEvent
+		if err := cursor.Decode(&order); err != nil {
+			log.Printf("Skipping undecodable order: %v", err)
+			continue
+		}
+		addOrderPairs(pairs, orderSKUs(order))
+		if id, ok := cursor.Current.Lookup("_id").ObjectIDOK(); ok {
+			orderIDs = append(orderIDs, bson.M{"_id": id.Hex()})
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		http.Error(w, "Failed to read orders", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := env.coPurchases.DeleteMany(ctx, bson.M{}); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := env.coPurchaseOrders.DeleteMany(ctx, bson.M{}); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(pairs) > 0 {
+		if _, err := env.coPurchases.BulkWrite(ctx, coPurchaseModels(pairs), options.BulkWrite().SetOrdered(false)); err != nil {
+			log.Printf("Error rebuilding co-purchases: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(orderIDs) > 0 {
+		if _, err := env.coPurchaseOrders.InsertMany(ctx, orderIDs, options.InsertMany().SetOrdered(false)); err != nil {
+			log.Printf("Error recording indexed orders: %v", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"orders": len(orderIDs), "pairs": len(pairs)})
+}
+
+// productSubresourceHandler serves GET /api/products/{id}/{resource}. A single
+// wildcard route is needed because /api/products/{id}/related or /history
+// would otherwise conflict with /api/products/sku/{sku} in the ServeMux.
+func (env *Env) productSubresourceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.PathValue("resource") {
+	case "related":
+		env.getRelatedProductsHandler(w, r)
+	case "history":
+		// The audit trail names who changed what, so it needs a login.
+		jwtMiddleware(http.HandlerFunc(env.getProductHistoryHandler)).ServeHTTP(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// getRelatedProductsHandler recommends products for a product page: those
+// most often bought together with it, then the most similar ones from the
+// same category or brand.
+func (env *Env) getRelatedProductsHandler(w http.ResponseWriter, r *http.Request) {
+	objID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID format", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var product Product
+	filter := viewableProductFilter()
+	filter["_id"] = objID
+	if err := env.collection.FindOne(ctx, filter).Decode(&product); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Product not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error finding product: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	env.writeRecommendations(ctx, w, r, []Product{product})
+}
+
+// getFrequentlyBoughtTogetherHandler recommends products for a cart, given as
+// ?skus=A,B,C. Products already in the cart are never recommended.
+func (env *Env) getFrequentlyBoughtTogetherHandler(w http.ResponseWriter, r *http.Request) {
+	skus := strings.Split(r.URL.Query().Get("skus"), ",")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := viewableProductFilter()
+	filter["sku"] = bson.M{"$in": skus}
+	cursor, err := env.collection.Find(ctx, filter)
+	if err != nil {
+		http.Error(w, "Failed to fetch products", http.StatusInternalServerError)
+		return
+	}
+	var products []Product
+	if err := cursor.All(ctx, &products); err != nil {
+		http.Error(w, "Failed to decode products", http.StatusInternalServerError)
+		return
+	}
+	env.writeRecommendations(ctx, w, r, products)
+}
+
+// writeRecommendations scores candidates for the given source products and
+// writes the best ones, priced in the requested currency.
+func (env *Env) writeRecommendations(ctx context.Context, w http.ResponseWriter, r *http.Request, sources []Product) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit < 1 {
+		limit = relatedDefaultLimit
+	}
+	if limit > relatedMaxLimit {
+		limit = relatedMaxLimit
+	}
+
+	related, err := env.relatedProducts(ctx, sources, limit)
+	if err != nil {
+		log.Printf("Error computing related products: %v", err)
+		http.Error(w, "Failed to fetch related products", http.StatusInternalServerError)
+		return
+	}
+	currency := r.URL.Query().Get("currency")
+	now := time.Now()
+	for i := range related {
+		if err := env.priceProduct(&related[i].Product, currency, now); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(related)
+}
+
+// relatedProducts combines co-purchase counts with category and brand
+// similarity. Only products listed publicly are recommended.
+func (env *Env) relatedProducts(ctx context.Context, sources []Product, limit int) ([]RelatedProduct, error) {
+	related := make([]RelatedProduct, 0, limit)
+	if len(sources) == 0 {
+		return related, nil
+	}
+
+	exclude := make(bson.A, 0, len(sources))
+	sourceSKUs := make([]string, 0, len(sources))
+	var categories, brands []string
+	var categoryIDs bson.A
+	for _, p := range sources {
+		exclude = append(exclude, p.SKU)
+		sourceSKUs = append(sourceSKUs, p.SKU)
+		if p.CategoryID != nil {
+			categoryIDs = append(categoryIDs, *p.CategoryID)
+		} else if p.Category != "" {
+			categories = append(categories, p.Category)
+		}
+		if p.Brand != "" {
+			brands = append(brands, p.Brand)
+		}
+	}
+
+	// --- 1. Bought together ---
+	counts := make(map[string]int64)
+	cursor, err := env.coPurchases.Find(ctx,
+		bson.M{"sku": bson.M{"$in": sourceSKUs}, "relatedSku": bson.M{"$nin": exclude}},
+		options.Find().SetSort(bson.D{{Key: "count", Value: -1}}).SetLimit(int64(limit*4)))
+	if err != nil {
+		return nil, err
+	}
+	var pairs []CoPurchase
+	if err := cursor.All(ctx, &pairs); err != nil {
+		return nil, err
+	}
+	coSKUs := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		if _, ok := counts[pair.RelatedSKU]; !ok {
+			coSKUs = append(coSKUs, pair.RelatedSKU)
+		}
+		counts[pair.RelatedSKU] += pair.Count
+	}
+
+	// --- 2. Candidates: bought together, or same category or brand ---
+	similar := bson.A{bson.M{"sku": bson.M{"$in": coSKUs}}}
+	if len(categoryIDs) > 0 {
+		similar = append(similar, bson.M{"categoryId": bson.M{"$in": categoryIDs}})
+	}
+	if len(categories) > 0 {
+		similar = append(similar, bson.M{"category": bson.M{"$in": categories}})
+	}
+	if len(brands) > 0 {
+		similar = append(similar, bson.M{"brand": bson.M{"$in": brands}})
+	}
+	filter := publicProductFilter()
+	filter["sku"] = bson.M{"$nin": exclude}
+	filter["$or"] = similar
+	opts := options.Find().SetSort(bson.D{{Key: "averageRating", Value: -1}}).SetLimit(int64(limit*4 + len(coSKUs)))
+	cursor, err = env.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []Product
+	if err := cursor.All(ctx, &candidates); err != nil {
+		return nil, err
+	}
+
+	// --- 3. Score and rank ---
+	scores := make(map[string]int64, len(candidates))
+	for _, c := range candidates {
+		score := counts[c.SKU] * coPurchaseWeight
+		for _, p := range sources {
+			if c.CategoryID != nil && p.CategoryID != nil && *c.CategoryID == *p.CategoryID ||
+				c.Category != "" && c.Category == p.Category {
+				score += sameCategoryWeight
+			}
+			if c.Brand != "" && c.Brand == p.Brand {
+				score += sameBrandWeight
+			}
+		}
+		scores[c.SKU] = score
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return scores[candidates[i].SKU] > scores[candidates[j].SKU]
+	})
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	for _, c := range candidates {
+		related = append(related, RelatedProduct{Product: c, CoPurchaseCount: counts[c.SKU]})
+	}
+	return related, nil
+}
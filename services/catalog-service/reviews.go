@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Review moderation states. Only approved reviews are public and counted.
+const (
+	ReviewStatusPending  = "pending"
+	ReviewStatusApproved = "approved"
+	ReviewStatusRejected = "rejected"
+)
+
+// Review is a customer's rating of a product they bought. Reviews belong to
+// the product by ProductID, which survives a change of SKU; SKU is the one
+// the product had when the review was written.
+type Review struct {
+	ID               primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	ProductID        primitive.ObjectID `json:"productId" bson:"productId"`
+	SKU              string             `json:"sku" bson:"sku"`
+	UserEmail        string             `json:"userEmail" bson:"userEmail"`
+	Rating           int                `json:"rating" bson:"rating"`
+	Title            string             `json:"title" bson:"title"`
+	Body             string             `json:"body" bson:"body"`
+	VerifiedPurchase bool               `json:"verifiedPurchase" bson:"verifiedPurchase"`
+	Status           string             `json:"status" bson:"status"`
+	HelpfulVotes     int64              `json:"helpfulVotes" bson:"helpfulVotes"`
+	UnhelpfulVotes   int64              `json:"unhelpfulVotes" bson:"unhelpfulVotes"`
+	CreatedAt        time.Time          `json:"createdAt" bson:"createdAt"`
+	ModeratedBy      string             `json:"moderatedBy,omitempty" bson:"moderatedBy,omitempty"`
+	ModeratedAt      *time.Time         `json:"moderatedAt,omitempty" bson:"moderatedAt,omitempty"`
+}
+
+// ReviewVote is one user's helpfulness vote on a review.
+type ReviewVote struct {
+	ReviewID  primitive.ObjectID `bson:"reviewId"`
+	UserEmail string             `bson:"userEmail"`
+	Helpful   bool               `bson:"helpful"`
+}
+
+type PaginatedReviewsResponse struct {
+	Reviews      []Review `json:"reviews"`
+	TotalPages   int64    `json:"totalPages"`
+	CurrentPage  int64    `json:"currentPage"`
+	TotalReviews int64    `json:"totalReviews"`
+}
+
+// getProductReviewsHandler lists the approved reviews of a product, most
+// helpful first unless sort=newest.
+func (env *Env) getProductReviewsHandler(w http.ResponseWriter, r *http.Request) {
+	page, _ := strconv.ParseInt(r.URL.Query().Get("page"), 10, 64)
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+	if limit < 1 {
+		limit = 10
+	}
+	sort := bson.D{{Key: "helpfulVotes", Value: -1}, {Key: "createdAt", Value: -1}}
+	if r.URL.Query().Get("sort") == "newest" {
+		sort = bson.D{{Key: "createdAt", Value: -1}}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var product Product
+	productFilter := viewableProductFilter()
+	productFilter["sku"] = r.PathValue("sku")
+	err := env.collection.FindOne(ctx, productFilter, options.FindOne().SetProjection(bson.M{"_id": 1})).Decode(&product)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Product not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error finding product: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	filter := bson.M{"productId": product.ID, "status": ReviewStatusApproved}
+	total, err := env.reviews.CountDocuments(ctx, filter)
+	if err != nil {
+		http.Error(w, "Failed to count reviews", http.StatusInternalServerError)
+		return
+	}
+	opts := options.Find().SetSort(sort).SetSkip((page - 1) * limit).SetLimit(limit)
+	cursor, err := env.reviews.Find(ctx, filter, opts)
+	if err != nil {
+		http.Error(w, "Failed to fetch reviews", http.StatusInternalServerError)
+		return
+	}
+	reviews := make([]Review, 0)
+	if err := cursor.All(ctx, &reviews); err != nil {
+		http.Error(w, "Failed to decode reviews", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PaginatedReviewsResponse{
+		Reviews:      reviews,
+		CurrentPage:  page,
+		TotalPages:   int64(math.Ceil(float64(total) / float64(limit))),
+		TotalReviews: total,
+	})
+}
+
+// createReviewHandler adds a review for moderation. Only customers with an
+// order containing the product may review it, once per product.
+func (env *Env) createReviewHandler(w http.ResponseWriter, r *http.Request) {
+	var review Review
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	review.Title = strings.TrimSpace(review.Title)
+	review.Body = strings.TrimSpace(review.Body)
+	if review.Rating < 1 || review.Rating > 5 {
+		http.Error(w, "Rating must be between 1 and 5", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var product Product
+	filter := viewableProductFilter()
+	filter["sku"] = r.PathValue("sku")
+	if err := env.collection.FindOne(ctx, filter).Decode(&product); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Product not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error finding product: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	purchased, err := env.hasPurchased(r.Header.Get("Authorization"), product.SKU)
+	if err != nil {
+		log.Printf("Error checking purchases for review: %v", err)
+		http.Error(w, "Could not verify purchase, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	if !purchased {
+		http.Error(w, "Only customers who bought this product can review it", http.StatusForbidden)
+		return
+	}
+
+	review.ID = primitive.NilObjectID
+	review.ProductID = product.ID
+	review.SKU = product.SKU
+	review.UserEmail = userEmail(r)
+	review.VerifiedPurchase = true
+	review.Status = ReviewStatusPending
+	review.HelpfulVotes, review.UnhelpfulVotes = 0, 0
+	review.CreatedAt = time.Now()
+	review.ModeratedBy, review.ModeratedAt = "", nil
+
+	insertResult, err := env.reviews.InsertOne(ctx, review)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			http.Error(w, "You have already reviewed this product", http.StatusConflict)
+			return
+		}
+		log.Printf("Error creating review: %v", err)
+		http.Error(w, "Failed to create review", http.StatusInternalServerError)
+		return
+	}
+	review.ID = insertResult.InsertedID.(primitive.ObjectID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(review)
+}
+
+// hasPurchased asks the checkout-service whether the caller has an order
+// containing the SKU, forwarding the caller's token.
+func (env *Env) hasPurchased(authToken, sku string) (bool, error) {
+	ordersServiceURL := os.Getenv("ORDERS_SERVICE_URL")
+	if ordersServiceURL == "" {
+		ordersServiceURL = "http://localhost:8084/api/orders"
+	}
+
+	req, err := http.NewRequest("GET", ordersServiceURL, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create orders request: %w", err)
+	}
+	req.Header.Set("Authorization", authToken)
+	resp, err := env.httpClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to call checkout service: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("checkout-service returned non-200 status: %d", resp.StatusCode)
+	}
+
+	var orders []struct {
+		Items []struct {
+			SKU string `json:"sku"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&orders); err != nil {
+		return false, fmt.Errorf("failed to decode orders: %w", err)
+	}
+	for _, order := range orders {
+		for _, item := range order.Items {
+			if item.SKU == sku {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// voteReviewHandler records whether the caller found a review helpful.
+// Voting again replaces the caller's earlier vote.
+func (env *Env) voteReviewHandler(w http.ResponseWriter, r *http.Request) {
+	reviewID, err := primitive.ObjectIDFromHex(r.PathValue("reviewId"))
+	if err != nil {
+		http.Error(w, "Invalid review ID format", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Helpful *bool `json:"helpful"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Helpful == nil {
+		http.Error(w, "Body must be {\"helpful\": true|false}", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var review Review
+	err = env.reviews.FindOne(ctx, bson.M{"_id": reviewID, "status": ReviewStatusApproved}).Decode(&review)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Review not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error finding review: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	voter := userEmail(r)
+	if review.UserEmail == voter {
+		http.Error(w, "You cannot vote on your own review", http.StatusForbidden)
+		return
+	}
+
+	_, err = env.reviewVotes.ReplaceOne(ctx,
+		bson.M{"reviewId": reviewID, "userEmail": voter},
+		ReviewVote{ReviewID: reviewID, UserEmail: voter, Helpful: *body.Helpful},
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		log.Printf("Error saving review vote: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Recount rather than increment, so repeated or changed votes stay correct.
+	helpful, err := env.reviewVotes.CountDocuments(ctx, bson.M{"reviewId": reviewID, "helpful": true})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	unhelpful, err := env.reviewVotes.CountDocuments(ctx, bson.M{"reviewId": reviewID, "helpful": false})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	err = env.reviews.FindOneAndUpdate(ctx,
+		bson.M{"_id": reviewID},
+		bson.M{"$set": bson.M{"helpfulVotes": helpful, "unhelpfulVotes": unhelpful}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&review)
+	if err != nil {
+		log.Printf("Error updating review votes: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(review)
+}
+
+// getReviewsForModerationHandler lists reviews by moderation status,
+// pending by default, oldest first.
+func (env *Env) getReviewsForModerationHandler(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = ReviewStatusPending
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}).SetLimit(100)
+	cursor, err := env.reviews.Find(ctx, bson.M{"status": status}, opts)
+	if err != nil {
+		http.Error(w, "Failed to fetch reviews", http.StatusInternalServerError)
+		return
+	}
+	reviews := make([]Review, 0)
+	if err := cursor.All(ctx, &reviews); err != nil {
+		http.Error(w, "Failed to decode reviews", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reviews)
+}
+
+// moderateReviewHandler approves or rejects a review and refreshes the
+// product's rating summary.
+func (env *Env) moderateReviewHandler(w http.ResponseWriter, r *http.Request) {
+	reviewID, err := primitive.ObjectIDFromHex(r.PathValue("reviewId"))
+	if err != nil {
+		http.Error(w, "Invalid review ID format", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if body.Status != ReviewStatusApproved && body.Status != ReviewStatusRejected {
+		http.Error(w, "Status must be approved or rejected", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	var review Review
+	err = env.reviews.FindOneAndUpdate(ctx,
+		bson.M{"_id": reviewID},
+		bson.M{"$set": bson.M{"status": body.Status, "moderatedBy": userEmail(r), "moderatedAt": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&review)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Review not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error moderating review: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	if err := env.updateRatingSummary(ctx, review.ProductID); err != nil {
+		log.Printf("Error updating rating of product %s: %v", review.ProductID.Hex(), err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(review)
+}
+
+// updateRatingSummary recomputes averageRating and reviewCount of a product
+// from its approved reviews. The summary isn't editable content, so the
+// product's version is left alone and concurrent edits don't conflict with it.
+func (env *Env) updateRatingSummary(ctx context.Context, productID primitive.ObjectID) error {
+	cursor, err := env.reviews.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"productId": productID, "status": ReviewStatusApproved}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":     nil,
+			"average": bson.M{"$avg": "$rating"},
+			"count":   bson.M{"$sum": 1},
+		}}},
+	})
+	if err != nil {
+		return err
+	}
+	var results []struct {
+		Average float64 `bson:"average"`
+		Count   int64   `bson:"count"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return err
+	}
+	var average float64
+	var count int64
+	if len(results) > 0 {
+		average = math.Round(results[0].Average*100) / 100
+		count = results[0].Count
+	}
+	// The product's current SKU, not the review's, names its cache entries.
+	var product Product
+	err = env.collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": productID},
+		bson.M{"$set": bson.M{"averageRating": average, "reviewCount": count}},
+		options.FindOneAndUpdate().SetProjection(bson.M{"sku": 1}),
+	).Decode(&product)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	env.cache.invalidateProducts(ctx, product.SKU)
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// fallbackProductSlug is used for names without a single letter or digit.
+const fallbackProductSlug = "product"
+
+var (
+	// errSlugTaken is returned when a requested slug belongs to another product.
+	errSlugTaken = errors.New("slug is already in use")
+	// errInvalidSlug is returned for a requested slug without letters or digits.
+	errInvalidSlug = errors.New("invalid slug")
+)
+
+// uniqueProductSlug returns base if no other product uses it, now or as a
+// former slug, and otherwise the first free "base-2", "base-3", ... Slugs in
+// reserved are treated as taken too, for batches that aren't written yet.
+func uniqueProductSlug(ctx context.Context, collection *mongo.Collection, base string, id primitive.ObjectID, reserved map[string]bool) (string, error) {
+	if base == "" {
+		base = fallbackProductSlug
+	}
+	pattern := "^" + regexp.QuoteMeta(base) + `(-\d+)?$`
+	cursor, err := collection.Find(ctx, bson.M{
+		"_id": bson.M{"$ne": id},
+		"$or": bson.A{
+			bson.M{"slug": bson.M{"$regex": pattern}},
+			bson.M{"previousSlugs": bson.M{"$regex": pattern}},
+		},
+	}, options.Find().SetProjection(bson.M{"slug": 1, "previousSlugs": 1}))
+	if err != nil {
+		return "", err
+	}
+	var products []Product
+	if err := cursor.All(ctx, &products); err != nil {
+		return "", err
+	}
+	taken := make(map[string]bool, len(products))
+	for _, p := range products {
+		taken[p.Slug] = true
+		for _, slug := range p.PreviousSlugs {
+			taken[slug] = true
+		}
+	}
+
+	for n := 1; ; n++ {
+		candidate := base
+		if n > 1 {
+			candidate = base + "-" + strconv.Itoa(n)
+		}
+		if !taken[candidate] && !reserved[candidate] {
+			return candidate, nil
+		}
+	}
+}
+
+// productSlugTaken reports whether another product uses slug, now or as a
+// former slug.
+func productSlugTaken(ctx context.Context, collection *mongo.Collection, slug string, id primitive.ObjectID) (bool, error) {
+	count, err := collection.CountDocuments(ctx, bson.M{
+		"_id": bson.M{"$ne": id},
+		"$or": bson.A{bson.M{"slug": slug}, bson.M{"previousSlugs": slug}},
+	}, options.Count().SetLimit(1))
+	return count > 0, err
+}
+
+// resolveProductSlug settles the slug of a product about to be written;
+// current is nil on create. A slug sent by the client is used as given. Without
+// one the slug follows the name: it stays put while the name does and is
+// regenerated when the name changes. A replaced slug is kept as a former slug,
+// so old links redirect.
+func (env *Env) resolveProductSlug(ctx context.Context, p *Product, current *Product) error {
+	id := p.ID
+	p.PreviousSlugs = nil
+	if current != nil {
+		id = current.ID
+		p.PreviousSlugs = slices.Clone(current.PreviousSlugs)
+	}
+
+	switch {
+	case current != nil && current.Slug != "" && (p.Slug == "" || p.Slug == current.Slug) && p.Name == current.Name:
+		p.Slug = current.Slug
+		return nil
+	case p.Slug != "" && (current == nil || p.Slug != current.Slug):
+		requested := slugify(p.Slug)
+		if requested == "" {
+			return errInvalidSlug
+		}
+		taken, err := productSlugTaken(ctx, env.collection, requested, id)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return errSlugTaken
+		}
+		p.Slug = requested
+	default:
+		slug, err := uniqueProductSlug(ctx, env.collection, slugify(p.Name), id, nil)
+		if err != nil {
+			return err
+		}
+		p.Slug = slug
+	}
+
+	if current != nil && current.Slug != "" && current.Slug != p.Slug && !slices.Contains(p.PreviousSlugs, current.Slug) {
+		p.PreviousSlugs = append(p.PreviousSlugs, current.Slug)
+	}
+	// A product may take back one of its own former slugs.
+	p.PreviousSlugs = slices.DeleteFunc(p.PreviousSlugs, func(s string) bool { return s == p.Slug })
+	return nil
+}
+
+// writeSlugError answers a failed resolveProductSlug.
+func writeSlugError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errInvalidSlug):
+		http.Error(w, "Slug must contain letters or digits", http.StatusBadRequest)
+	case errors.Is(err, errSlugTaken):
+		http.Error(w, "Product with this slug already exists", http.StatusConflict)
+	default:
+		log.Printf("Error resolving product slug: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// getProductBySlugHandler finds a single product by its slug. A former slug
+// redirects permanently to the product's current one.
+func (env *Env) getProductBySlugHandler(w http.ResponseWriter, r *http.Request) {
+	slug := r.PathValue("slug")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	bySlug := viewableProductFilter()
+	bySlug["slug"] = slug
+	var product Product
+	err := env.collection.FindOne(ctx, bySlug).Decode(&product)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		byPreviousSlug := viewableProductFilter()
+		byPreviousSlug["previousSlugs"] = slug
+		err = env.collection.FindOne(ctx, byPreviousSlug).Decode(&product)
+		if err == nil {
+			location := "/api/products/slug/" + url.PathEscape(product.Slug)
+			if r.URL.RawQuery != "" {
+				location += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, location, http.StatusMovedPermanently)
+			return
+		}
+	}
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Product with that slug not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error finding product by slug %s: %v", slug, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	env.writeProductDetail(ctx, w, r, product)
+}
+
+// migrateProductSlugs gives every product without a slug one derived from its
+// name, oldest product first, so the oldest keeps the plain slug.
+func migrateProductSlugs(ctx context.Context, collection *mongo.Collection) (int64, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetProjection(bson.M{"name": 1})
+	cursor, err := collection.Find(ctx, bson.M{"slug": bson.M{"$in": bson.A{nil, ""}}}, opts)
+	if err != nil {
+		return 0, err
+	}
+	var products []Product
+	if err := cursor.All(ctx, &products); err != nil {
+		return 0, err
+	}
+
+	var migrated int64
+	reserved := make(map[string]bool, len(products))
+	for _, p := range products {
+		slug, err := uniqueProductSlug(ctx, collection, slugify(p.Name), p.ID, reserved)
+		if err != nil {
+			return migrated, err
+		}
+		reserved[slug] = true
+		if _, err := collection.UpdateByID(ctx, p.ID, bson.M{"$set": bson.M{"slug": slug}}); err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	return migrated, nil
+}
+
+// isSlugConflict tells a duplicate slug apart from a duplicate SKU.
+func isSlugConflict(err error) bool {
+	return mongo.IsDuplicateKeyError(err) && strings.Contains(err.Error(), "slug")
+}
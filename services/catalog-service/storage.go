@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// MediaStorage is where uploaded product images end up. Handlers only deal with
+// object keys; the backend decides where the bytes live and which URL serves them.
+type MediaStorage interface {
+	// Put stores the content under key and returns the public URL for it.
+	Put(ctx context.Context, key string, content io.Reader, size int64, contentType string) (string, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// newMediaStorageFromEnv picks the storage backend based on MEDIA_STORAGE.
+// "local" (the default) is meant for development, "s3" for production.
+func newMediaStorageFromEnv() (MediaStorage, error) {
+	switch os.Getenv("MEDIA_STORAGE") {
+	case "", "local":
+		dir := os.Getenv("MEDIA_DIR")
+		if dir == "" {
+			dir = "./media"
+		}
+		baseURL := os.Getenv("MEDIA_BASE_URL")
+		if baseURL == "" {
+			baseURL = "/media"
+		}
+		return newLocalStorage(dir, baseURL)
+	case "s3":
+		return newS3StorageFromEnv()
+	default:
+		return nil, fmt.Errorf("unknown MEDIA_STORAGE %q", os.Getenv("MEDIA_STORAGE"))
+	}
+}
+
+// localStorage writes media files to a directory on disk. The catalog-service
+// serves that directory itself under baseURL.
+type localStorage struct {
+	dir     string
+	baseURL string
+}
+
+func newLocalStorage(dir, baseURL string) (*localStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create media directory: %w", err)
+	}
+	return &localStorage{dir: dir, baseURL: strings.TrimSuffix(baseURL, "/")}, nil
+}
+
+// fileSystem serves the stored files. Directories are reported as missing so
+// their contents are never listed.
+func (s *localStorage) fileSystem() http.FileSystem {
+	return noDirectories{http.Dir(s.dir)}
+}
+
+type noDirectories struct {
+	http.FileSystem
+}
+
+func (fs noDirectories) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		f.Close()
+		return nil, os.ErrNotExist
+	}
+	return f, nil
+}
+
+func (s *localStorage) Put(ctx context.Context, key string, content io.Reader, size int64, contentType string) (string, error) {
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", fmt.Errorf("failed to create media directory: %w", err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to create media file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, content); err != nil {
+		return "", fmt.Errorf("failed to write media file: %w", err)
+	}
+	return s.baseURL + "/" + key, nil
+}
+
+func (s *localStorage) Delete(ctx context.Context, key string) error {
+	err := os.Remove(filepath.Join(s.dir, filepath.FromSlash(key)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// s3Storage stores media in any S3-compatible bucket (AWS S3, MinIO, ...).
+type s3Storage struct {
+	client  *minio.Client
+	bucket  string
+	baseURL string
+}
+
+func newS3StorageFromEnv() (*s3Storage, error) {
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "s3.amazonaws.com"
+	}
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return nil, fmt.Errorf("S3_BUCKET environment variable is not set")
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(os.Getenv("S3_ACCESS_KEY_ID"), os.Getenv("S3_SECRET_ACCESS_KEY"), ""),
+		Secure: os.Getenv("S3_INSECURE") != "true",
+		Region: os.Getenv("S3_REGION"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+
+	// Objects are usually served through a CDN in front of the bucket. Without one,
+	// fall back to the bucket's own URL.
+	baseURL := os.Getenv("MEDIA_BASE_URL")
+	if baseURL == "" {
+		baseURL = client.EndpointURL().String() + "/" + bucket
+	}
+	log.Printf("Media storage using S3 bucket %s", bucket)
+	return &s3Storage{client: client, bucket: bucket, baseURL: strings.TrimSuffix(baseURL, "/")}, nil
+}
+
+func (s *s3Storage) Put(ctx context.Context, key string, content io.Reader, size int64, contentType string) (string, error) {
+	_, err := s.client.PutObject(ctx, s.bucket, key, content, size, minio.PutObjectOptions{
+		ContentType:  contentType,
+		CacheControl: "public, max-age=31536000, immutable",
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	return s.baseURL + "/" + key, nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
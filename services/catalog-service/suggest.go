@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// suggestBudget is the time a suggestion lookup may spend. Typo matching is
+// cut short when it runs out; the prefix matches found by then are returned.
+const suggestBudget = 30 * time.Millisecond
+
+// suggestRefreshInterval is how often the index is rebuilt from MongoDB, in
+// case an event was missed while the consumer was disconnected.
+const suggestRefreshInterval = 10 * time.Minute
+
+const (
+	suggestDefaultLimit = 5
+	suggestMaxLimit     = 10
+)
+
+// Kinds of suggestions.
+const (
+	suggestKindProduct  = "product"
+	suggestKindBrand    = "brand"
+	suggestKindCategory = "category"
+)
+
+// Suggestion is one autocomplete entry. Count is the number of public products
+// of a brand or category.
+type Suggestion struct {
+	Text  string `json:"text"`
+	SKU   string `json:"sku,omitempty"`
+	Slug  string `json:"slug,omitempty"`
+	Count int    `json:"count,omitempty"`
+}
+
+// SuggestResponse groups the suggestions for a query by kind.
+type SuggestResponse struct {
+	Query      string       `json:"query"`
+	Products   []Suggestion `json:"products"`
+	Brands     []Suggestion `json:"brands"`
+	Categories []Suggestion `json:"categories"`
+}
+
+// suggestProduct is the part of a product the index needs, read from
+// MongoDB or from the product in an event.
+type suggestProduct struct {
+	ID       primitive.ObjectID `json:"id" bson:"_id"`
+	Name     string             `json:"name" bson:"name"`
+	SKU      string             `json:"sku" bson:"sku"`
+	Slug     string             `json:"slug" bson:"slug"`
+	Brand    string             `json:"brand" bson:"brand"`
+	Category string             `json:"category" bson:"category"`
+	Status   string             `json:"status" bson:"status"`
+	Version  int64              `json:"version" bson:"version"`
+	// A product scheduled for later is picked up by the next refresh after
+	// it is published.
+	PublishAt   *time.Time `json:"publishAt" bson:"publishAt"`
+	UnpublishAt *time.Time `json:"unpublishAt" bson:"unpublishAt"`
+}
+
+// suggestEvent is the part of a ProductEvent the index needs.
+type suggestEvent struct {
+	Type    string         `json:"type"`
+	Product suggestProduct `json:"product"`
+}
+
+// suggestEntry is a searchable name together with its normalized words.
+type suggestEntry struct {
+	kind  string
+	text  string
+	sku   string
+	slug  string
+	count int
+	words []string
+}
+
+// suggestSnapshot is an immutable prefix index over all entries: the sorted
+// distinct words, and for every word the entries containing it.
+type suggestSnapshot struct {
+	entries  []suggestEntry
+	words    []string
+	postings map[string][]int
+}
+
+// suggestionIndex keeps the public products in memory and serves lookups from
+// a snapshot that is rebuilt and swapped on every change, so lookups never wait.
+type suggestionIndex struct {
+	mu       sync.Mutex
+	products map[primitive.ObjectID]suggestProduct
+	// versions remembers the newest version seen per product, so an event
+	// that arrives late can't undo a newer one.
+	versions   map[primitive.ObjectID]int64
+	current    atomic.Pointer[suggestSnapshot]
+	collection *mongo.Collection
+}
+
+func newSuggestionIndex(collection *mongo.Collection) *suggestionIndex {
+	idx := &suggestionIndex{collection: collection}
+	idx.current.Store(buildSuggestSnapshot(nil))
+	return idx
+}
+
+// load rebuilds the index from every public product.
+func (idx *suggestionIndex) load(ctx context.Context) error {
+	opts := options.Find().SetProjection(bson.M{"name": 1, "sku": 1, "slug": 1, "brand": 1, "category": 1, "status": 1, "version": 1, "publishAt": 1, "unpublishAt": 1})
+	cursor, err := idx.collection.Find(ctx, publicProductFilter(), opts)
+	if err != nil {
+		return err
+	}
+	var products []suggestProduct
+	if err := cursor.All(ctx, &products); err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.products = make(map[primitive.ObjectID]suggestProduct, len(products))
+	idx.versions = make(map[primitive.ObjectID]int64, len(products))
+	for _, p := range products {
+		idx.products[p.ID] = p
+		idx.versions[p.ID] = p.Version
+	}
+	idx.current.Store(buildSuggestSnapshot(idx.products))
+	return nil
+}
+
+// apply updates the index with a product event.
+func (idx *suggestionIndex) apply(event suggestEvent) {
+	p := event.Product
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.versions[p.ID] > p.Version {
+		return
+	}
+	idx.versions[p.ID] = p.Version
+	// The same condition as publicProductFilter.
+	if event.Type != EventProductDeleted && p.Status == ProductStatusActive && isPublished(p.PublishAt, p.UnpublishAt, time.Now()) {
+		idx.products[p.ID] = p
+	} else if _, ok := idx.products[p.ID]; ok {
+		delete(idx.products, p.ID)
+	} else {
+		return
+	}
+	idx.current.Store(buildSuggestSnapshot(idx.products))
+}
+
+// refreshLoop reloads the index periodically until ctx is cancelled.
+func (idx *suggestionIndex) refreshLoop(ctx context.Context) {
+	ticker := time.NewTicker(suggestRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			loadCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			if err := idx.load(loadCtx); err != nil {
+				log.Printf("Failed to refresh the suggestion index: %v", err)
+			}
+			cancel()
+		}
+	}
+}
+
+func buildSuggestSnapshot(products map[primitive.ObjectID]suggestProduct) *suggestSnapshot {
+	s := &suggestSnapshot{postings: make(map[string][]int)}
+	brands := make(map[string]int)
+	categories := make(map[string]int)
+	for _, p := range products {
+		s.add(suggestEntry{kind: suggestKindProduct, text: p.Name, sku: p.SKU, slug: p.Slug})
+		if p.Brand != "" {
+			brands[p.Brand]++
+		}
+		if p.Category != "" {
+			categories[p.Category]++
+		}
+	}
+	for brand, count := range brands {
+		s.add(suggestEntry{kind: suggestKindBrand, text: brand, count: count})
+	}
+	for category, count := range categories {
+		s.add(suggestEntry{kind: suggestKindCategory, text: category, count: count})
+	}
+	for word := range s.postings {
+		s.words = append(s.words, word)
+	}
+	sort.Strings(s.words)
+	return s
+}
+
+func (s *suggestSnapshot) add(entry suggestEntry) {
+	entry.words = suggestWords(entry.text)
+	if len(entry.words) == 0 {
+		return
+	}
+	i := len(s.entries)
+	s.entries = append(s.entries, entry)
+	for _, word := range entry.words {
+		if postings := s.postings[word]; len(postings) == 0 || postings[len(postings)-1] != i {
+			s.postings[word] = append(postings, i)
+		}
+	}
+}
+
+// suggestWords lowercases text and splits it into words of letters and digits.
+func suggestWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// maxTypos is how many edits a query word of n letters may be away from a
+// match. Short words must be typed correctly, or everything would match.
+func maxTypos(n int) int {
+	switch {
+	case n < 3:
+		return 0
+	case n < 6:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// search returns the entries matching every word of the query. Each query word
+// must be a prefix of a word of the entry; when prefixes alone find too few
+// entries to fill every kind, words within a few typos match too. Scores are
+// the number of typos, lower is better.
+func (s *suggestSnapshot) search(query string, limit int, deadline time.Time) map[int]int {
+	terms := suggestWords(query)
+	if len(terms) == 0 {
+		return nil
+	}
+	matches := s.match(terms, false, deadline)
+	if len(matches) < 3*limit {
+		matches = s.match(terms, true, deadline)
+	}
+	return matches
+}
+
+func (s *suggestSnapshot) match(terms []string, typos bool, deadline time.Time) map[int]int {
+	var result map[int]int
+	for _, term := range terms {
+		scores := make(map[int]int)
+		// Prefix matches are a contiguous run of the sorted words.
+		for i := sort.SearchStrings(s.words, term); i < len(s.words) && strings.HasPrefix(s.words[i], term); i++ {
+			for _, entry := range s.postings[s.words[i]] {
+				scores[entry] = 0
+			}
+		}
+		if max := maxTypos(len([]rune(term))); typos && max > 0 {
+			for i, word := range s.words {
+				if i%256 == 0 && time.Now().After(deadline) {
+					break
+				}
+				d := prefixDistance(term, word, max)
+				if d == 0 || d > max {
+					continue
+				}
+				for _, entry := range s.postings[word] {
+					if best, ok := scores[entry]; !ok || d < best {
+						scores[entry] = d
+					}
+				}
+			}
+		}
+
+		if result == nil {
+			result = scores
+			continue
+		}
+		for entry, score := range result {
+			if termScore, ok := scores[entry]; ok {
+				result[entry] = score + termScore
+			} else {
+				delete(result, entry)
+			}
+		}
+	}
+	return result
+}
+
+// prefixDistance is the smallest edit distance between term and a prefix of
+// word, so partly typed words match too ("nikn" is one edit from "nikon").
+// Anything above max is reported as max+1.
+func prefixDistance(term, word string, max int) int {
+	a, b := []rune(term), []rune(word)
+	best := max + 1
+	for n := len(a) - max; n <= len(a)+max; n++ {
+		if n < 1 || n > len(b) {
+			continue
+		}
+		if d := editDistance(a, b[:n]); d < best {
+			best = d
+		}
+	}
+	return best
+}
+
+// editDistance counts insertions, deletions, substitutions and swaps of
+// adjacent letters (optimal string alignment distance).
+func editDistance(a, b []rune) int {
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+// suggest ranks the matches of a query and returns the best of each kind:
+// fewest typos first, then the most products for brands and categories, then
+// the shortest name.
+func (idx *suggestionIndex) suggest(query string, limit int) SuggestResponse {
+	deadline := time.Now().Add(suggestBudget)
+	s := idx.current.Load()
+	matches := s.search(query, limit, deadline)
+
+	ranked := make([]int, 0, len(matches))
+	for entry := range matches {
+		ranked = append(ranked, entry)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := s.entries[ranked[i]], s.entries[ranked[j]]
+		if matches[ranked[i]] != matches[ranked[j]] {
+			return matches[ranked[i]] < matches[ranked[j]]
+		}
+		if a.count != b.count {
+			return a.count > b.count
+		}
+		if len(a.text) != len(b.text) {
+			return len(a.text) < len(b.text)
+		}
+		return a.text < b.text
+	})
+
+	response := SuggestResponse{Query: query, Products: []Suggestion{}, Brands: []Suggestion{}, Categories: []Suggestion{}}
+	for _, i := range ranked {
+		entry := s.entries[i]
+		suggestion := Suggestion{Text: entry.text, SKU: entry.sku, Slug: entry.slug, Count: entry.count}
+		switch {
+		case entry.kind == suggestKindProduct && len(response.Products) < limit:
+			response.Products = append(response.Products, suggestion)
+		case entry.kind == suggestKindBrand && len(response.Brands) < limit:
+			response.Brands = append(response.Brands, suggestion)
+		case entry.kind == suggestKindCategory && len(response.Categories) < limit:
+			response.Categories = append(response.Categories, suggestion)
+		}
+	}
+	return response
+}
+
+// getSuggestionsHandler returns autocomplete suggestions for the search box
+// (GET /api/products/suggest?q=nik&limit=5). It is served from memory and
+// never queries MongoDB.
+func (env *Env) getSuggestionsHandler(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit < 1 {
+		limit = suggestDefaultLimit
+	}
+	if limit > suggestMaxLimit {
+		limit = suggestMaxLimit
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(env.suggestions.suggest(query, limit))
+}
+
+// runSuggestConsumer keeps the suggestion index current from product events,
+// reconnecting whenever the connection drops.
+func (env *Env) runSuggestConsumer(ctx context.Context, amqpURL string) {
+	for {
+		if err := env.consumeProductEvents(ctx, amqpURL); err != nil {
+			log.Printf("Suggestion consumer stopped: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(amqpReconnectDelay):
+		}
+	}
+}
+
+func (env *Env) consumeProductEvents(ctx context.Context, amqpURL string) error {
+	conn, err := amqp.Dial(amqpURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	if err := ch.ExchangeDeclare(catalogExchange, "topic", true, false, false, false, nil); err != nil {
+		return err
+	}
+	// Every replica keeps its own index, so each gets its own queue, which
+	// goes away with the connection.
+	q, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return err
+	}
+	if err := ch.QueueBind(q.Name, "product.*", catalogExchange, false, nil); err != nil {
+		return err
+	}
+	msgs, err := ch.Consume(q.Name, "", true, true, false, false, nil)
+	if err != nil {
+		return err
+	}
+	// Events published while we were disconnected are gone; reload once the
+	// queue is bound so none are missed from here on.
+	loadCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	err = env.suggestions.load(loadCtx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	log.Println("Suggestion index waiting for product events.")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case d, ok := <-msgs:
+			if !ok {
+				return errors.New("delivery channel closed")
+			}
+			var event suggestEvent
+			if err := json.Unmarshal(d.Body, &event); err != nil {
+				log.Printf("Discarding undecodable product event: %v", err)
+				continue
+			}
+			env.suggestions.apply(event)
+		}
+	}
+}
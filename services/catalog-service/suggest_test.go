@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "nikon", 5},
+		{"nikon", "nikon", 0},
+		{"nikon", "nikom", 1},
+		{"nikon", "nkon", 1},
+		{"nkon", "nikon", 1},
+		{"nikon", "inkon", 1},
+		{"canon", "cnaon", 1},
+		{"ca", "abc", 3},
+		{"kitten", "sitting", 3},
+		{"größe", "grösse", 2},
+	}
+	for _, tt := range tests {
+		if got := editDistance([]rune(tt.a), []rune(tt.b)); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixDistance(t *testing.T) {
+	tests := []struct {
+		term, word string
+		max        int
+		want       int
+	}{
+		{"nik", "nikon", 2, 0},
+		{"nikn", "nikon", 2, 1},
+		{"nkio", "nikon", 2, 1},
+		{"nikon", "nikon", 0, 0},
+		{"sony", "nikon", 1, 2},
+		{"nikonz", "nik", 2, 3},
+		{"camera", "cam", 3, 3},
+	}
+	for _, tt := range tests {
+		if got := prefixDistance(tt.term, tt.word, tt.max); got != tt.want {
+			t.Errorf("prefixDistance(%q, %q, %d) = %d, want %d", tt.term, tt.word, tt.max, got, tt.want)
+		}
+	}
+}
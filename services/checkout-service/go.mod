@@ -22,3 +22,7 @@ require (
 	golang.org/x/sync v0.8.0 // indirect
 	golang.org/x/text v0.17.0 // indirect
 )
+
+require three-tier-cloud-shop/money v0.0.0
+
+replace three-tier-cloud-shop/money => ../money
@@ -1,20 +1,45 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"three-tier-cloud-shop/money"
 )
 
+// cartRequestError is returned when the cart-service rejects the request for
+// the cart, e.g. for an unsupported currency or a cart it can't total. The
+// status and message are passed on to the client.
+type cartRequestError struct {
+	status  int
+	message string
+}
+
+func (e *cartRequestError) Error() string { return e.message }
+
+// outOfStockError is returned when the warehouses can't cover the order.
+type outOfStockError struct {
+	message string
+}
+
+func (e *outOfStockError) Error() string { return e.message }
+
 func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
     w.WriteHeader(http.StatusOK)
     w.Write([]byte("{\"status\":\"ok\"}"))
@@ -27,69 +52,124 @@ func (env *Env) checkoutHandler(w http.ResponseWriter, r *http.Request) {
 	authToken := r.Header.Get("Authorization")
 
 	// --- Step 1: Get Cart Contents from cart-service ---
-	cartItems, err := env.getCartItems(userEmail, authToken)
+	// The order is placed in the storefront's currency (?currency=EUR), or in
+	// the catalog's own currency when none is given. Tax and shipping are
+	// charged for the shopper's region (?region=DE).
+	cart, err := env.getCart(userEmail, authToken, r.URL.Query().Get("currency"), r.URL.Query().Get("region"))
+	var rejected *cartRequestError
+	if errors.As(err, &rejected) {
+		http.Error(w, rejected.Error(), rejected.status)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	cartItems := cart.Items
 	if len(cartItems) == 0 {
 		http.Error(w, "Cart is empty", http.StatusBadRequest)
 		return
 	}
-	// --- Step 2: Process Payment ---
+	// Archived or deleted products may still sit in the cart but cannot be bought.
+	for _, item := range cartItems {
+		if !item.Available {
+			http.Error(w, "Product "+item.SKU+" is no longer available", http.StatusConflict)
+			return
+		}
+	}
+
+	// --- Step 2: Reserve stock in the warehouses ---
+	// The order ID is chosen up front so the reservation can be tied to it.
+	orderID := primitive.NewObjectID()
+	allocation, err := env.allocateStock(orderID, cartItems, authToken)
+	var outOfStock *outOfStockError
+	if errors.As(err, &outOfStock) {
+		http.Error(w, outOfStock.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	// --- Step 3: Process Payment ---
 	paymentSuccess, err := env.processPayment(userEmail)
 	if err != nil || !paymentSuccess {
+	    env.releaseStock(orderID, authToken)
 	    http.Error(w, "Payment failed", http.StatusServiceUnavailable)
 	    return
 	}
 
-	// --- Step 3: Create a permanent Order record in MongoDB ---
+	// --- Step 4: Create a permanent Order record in MongoDB ---
 	collection := env.mongoClient.Database("cloud_shop").Collection("orders")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	newOrder := Order{
-		UserEmail: userEmail,
-		Items:     cartItems,
-		Status:    "Created",
-		CreatedAt: time.Now(),
+		ID:         orderID,
+		UserEmail:  userEmail,
+		Items:      cartItems,
+		Subtotal:   cart.Subtotal,
+		Tax:        cart.EstimatedTax,
+		Shipping:   cart.EstimatedShipping,
+		Total:      cart.Total,
+		Currency:   cart.Currency,
+		Status:     "Created",
+		CreatedAt:  time.Now(),
+		Allocation: allocation.Lines,
+		Bundles:    allocation.Bundles,
 	}
 
-	insertResult, err := collection.InsertOne(ctx, newOrder)
-	if err != nil {
+	if _, err := collection.InsertOne(ctx, newOrder); err != nil {
 		log.Printf("Failed to create order in MongoDB: %v", err)
+		env.releaseStock(orderID, authToken)
 		http.Error(w, "Failed to save order", http.StatusInternalServerError)
 		return
 	}
-	newOrder.ID = insertResult.InsertedID.(primitive.ObjectID)
 
-	// --- Step 4: Publish an 'order_created' event to RabbitMQ ---
+	// --- Step 5: Publish an 'order_created' event to RabbitMQ ---
 	if err := env.publishOrderCreatedEvent(newOrder); err != nil {
 		// Note: In a real system, you'd need a strategy to handle this failure,
 		// as the user has paid but notifications might not go out.
 		log.Printf("CRITICAL: Order %s created but failed to publish event: %v", newOrder.ID.Hex(), err)
 	}
 
-	// --- Step 5: Clear the user's cart ---
+	// --- Step 6: Clear the user's cart ---
 	if err := env.clearCart(authToken); err != nil {
 		// This is also a critical error to log. The user has paid and has an order,
 		// but their cart still has items in it.
 		log.Printf("CRITICAL: Order %s created but failed to clear cart: %v", newOrder.ID.Hex(), err)
 	}
-	// --- Step 6: Respond to the client with the created order ---
+	// --- Step 7: Respond to the client with the created order ---
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated) // 201 Created is more appropriate now
 	json.NewEncoder(w).Encode(newOrder)
 }
 
 // Helper function to call the cart-service
-func (env *Env) getCartItems(userEmail, authToken string) ([]CartItemFromService, error) {
+func (env *Env) getCart(userEmail, authToken, currency, region string) (*CartFromService, error) {
     // Read the cart service URL from an environment variable.
     // This decouples the code from the environment configuration.
     cartServiceURL := os.Getenv("CART_SERVICE_URL")
     if cartServiceURL == "" {
         return nil, fmt.Errorf("CART_SERVICE_URL environment variable is not set")
     }
+    if currency != "" || region != "" {
+        u, err := url.Parse(cartServiceURL)
+        if err != nil {
+            log.Printf("Invalid CART_SERVICE_URL: %v", err)
+            return nil, fmt.Errorf("internal server error")
+        }
+        q := u.Query()
+        if currency != "" {
+            q.Set("currency", currency)
+        }
+        if region != "" {
+            q.Set("region", region)
+        }
+        u.RawQuery = q.Encode()
+        cartServiceURL = u.String()
+    }
 
     req, err := http.NewRequest("GET", cartServiceURL, nil)
     if err != nil {
@@ -106,18 +186,114 @@ func (env *Env) getCartItems(userEmail, authToken string) ([]CartItemFromService
     }
     defer resp.Body.Close()
 
+    if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusConflict {
+        // An unsupported currency or region, or a cart whose items can't be
+        // added up.
+        message, _ := io.ReadAll(resp.Body)
+        return nil, &cartRequestError{status: resp.StatusCode, message: strings.TrimSpace(string(message))}
+    }
     if resp.StatusCode != http.StatusOK {
         log.Printf("Cart service returned non-200 status: %d", resp.StatusCode)
         return nil, fmt.Errorf("failed to retrieve cart data")
     }
 
-    var cartItems []CartItemFromService
-    if err := json.NewDecoder(resp.Body).Decode(&cartItems); err != nil {
+    var cart CartFromService
+    if err := json.NewDecoder(resp.Body).Decode(&cart); err != nil {
         log.Printf("Failed to decode cart response: %v", err)
         return nil, fmt.Errorf("invalid response from cart service")
     }
+    // Amounts in JSON don't carry their currency; it comes with each item
+    // and, for the totals, with the cart.
+    for i := range cart.Items {
+        if cart.Items[i].Price, err = cart.Items[i].Price.In(cart.Items[i].Currency); err != nil {
+            log.Printf("Invalid price in cart response: %v", err)
+            return nil, fmt.Errorf("invalid response from cart service")
+        }
+        cart.Items[i].Currency = cart.Items[i].Price.Currency
+    }
+    for _, amount := range []*money.Money{&cart.Subtotal, &cart.EstimatedTax, &cart.EstimatedShipping, &cart.Total} {
+        if *amount, err = amount.In(cart.Currency); err != nil {
+            log.Printf("Invalid total in cart response: %v", err)
+            return nil, fmt.Errorf("invalid response from cart service")
+        }
+    }
+    cart.Currency = cart.Total.Currency
+
+    return &cart, nil
+}
+
+// allocateStock asks the catalog-service to reserve the order's items in its
+// warehouses and returns where each line ships from.
+func (env *Env) allocateStock(orderID primitive.ObjectID, items []CartItemFromService, authToken string) (*StockAllocation, error) {
+	allocationURL := os.Getenv("INVENTORY_ALLOCATION_URL")
+	if allocationURL == "" {
+		return nil, fmt.Errorf("INVENTORY_ALLOCATION_URL environment variable is not set")
+	}
+
+	type allocationItem struct {
+		SKU      string `json:"sku"`
+		Quantity int    `json:"quantity"`
+	}
+	request := struct {
+		OrderID string           `json:"orderId"`
+		Items   []allocationItem `json:"items"`
+	}{OrderID: orderID.Hex()}
+	for _, item := range items {
+		request.Items = append(request.Items, allocationItem{SKU: item.SKU, Quantity: item.Quantity})
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", allocationURL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to create allocation request: %v", err)
+		return nil, fmt.Errorf("internal server error")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Add("Authorization", authToken)
+	resp, err := env.httpClient.Do(req)
+	if err != nil {
+		log.Printf("Failed to call inventory allocation: %v", err)
+		return nil, fmt.Errorf("inventory is unavailable")
+	}
+	defer resp.Body.Close()
 
-    return cartItems, nil
+	if resp.StatusCode == http.StatusConflict {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, &outOfStockError{message: strings.TrimSpace(string(message))}
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		log.Printf("Inventory allocation returned status %d", resp.StatusCode)
+		return nil, fmt.Errorf("failed to reserve stock")
+	}
+	var allocation StockAllocation
+	if err := json.NewDecoder(resp.Body).Decode(&allocation); err != nil {
+		log.Printf("Failed to decode allocation: %v", err)
+		return nil, fmt.Errorf("invalid response from inventory")
+	}
+	return &allocation, nil
+}
+
+// releaseStock gives back the stock reserved for an order that was not placed.
+func (env *Env) releaseStock(orderID primitive.ObjectID, authToken string) {
+	allocationURL := os.Getenv("INVENTORY_ALLOCATION_URL")
+	req, err := http.NewRequest("DELETE", strings.TrimSuffix(allocationURL, "/")+"/"+orderID.Hex(), nil)
+	if err != nil {
+		log.Printf("CRITICAL: failed to release stock of order %s: %v", orderID.Hex(), err)
+		return
+	}
+	req.Header.Add("Authorization", authToken)
+	resp, err := env.httpClient.Do(req)
+	if err != nil {
+		log.Printf("CRITICAL: failed to release stock of order %s: %v", orderID.Hex(), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		log.Printf("CRITICAL: releasing stock of order %s returned status %d", orderID.Hex(), resp.StatusCode)
+	}
 }
 
 // Helper function to publish the message to RabbitMQ
@@ -151,6 +327,66 @@ func (env *Env) publishOrderCreatedEvent(order Order) error {
 
 // --- HELPER FUNCTIONS ---
 
+// orderTotal adds up every line exactly. All items must share one currency.
+// Orders get their totals from the cart-service; this only fills in orders
+// created before totals were stored.
+func orderTotal(items []CartItemFromService) (money.Money, error) {
+	var total money.Money
+	for _, item := range items {
+		var err error
+		total, err = total.Add(item.Price.Mul(item.Quantity))
+		if err != nil {
+			return money.Money{}, fmt.Errorf("cart mixes currencies: %w", err)
+		}
+	}
+	return total, nil
+}
+
+// migrateLegacyOrderPrices converts item prices stored as floating-point numbers
+// into Money documents and fills in the total of orders created before it existed.
+func migrateLegacyOrderPrices(ctx context.Context, collection *mongo.Collection) (int64, error) {
+	result, err := collection.UpdateMany(ctx,
+		bson.M{"items.price": bson.M{"$type": "number"}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{"items": bson.M{"$map": bson.M{
+			"input": "$items",
+			"as":    "item",
+			"in": bson.M{"$mergeObjects": bson.A{"$$item", bson.M{
+				"price": bson.M{
+					"amount":   bson.M{"$toLong": bson.M{"$round": bson.A{bson.M{"$multiply": bson.A{"$$item.price", 100}}, 0}}},
+					"currency": money.DefaultCurrency,
+				},
+				"currency": money.DefaultCurrency,
+			}}},
+		}}}}}},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	// Orders without a total get one computed from their (now exact) items.
+	cursor, err := collection.Find(ctx, bson.M{"total": bson.M{"$exists": false}})
+	if err != nil {
+		return result.ModifiedCount, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var order Order
+		if err := cursor.Decode(&order); err != nil {
+			return result.ModifiedCount, err
+		}
+		total, err := orderTotal(order.Items)
+		if err != nil {
+			log.Printf("Skipping total for order %s: %v", order.ID.Hex(), err)
+			continue
+		}
+		_, err = collection.UpdateByID(ctx, order.ID, bson.M{"$set": bson.M{"total": total, "currency": total.Currency}})
+		if err != nil {
+			return result.ModifiedCount, err
+		}
+	}
+	return result.ModifiedCount, cursor.Err()
+}
+
 // processPayment is a mock function for now.
 func (env *Env) processPayment(userEmail string) (bool, error) {
 	log.Printf("Processing payment for user %s...", userEmail)
@@ -42,6 +42,14 @@ func main() {
 	}
 	log.Println("Checkout service connected to MongoDB!")
 
+	migrated, err := migrateLegacyOrderPrices(context.Background(), mongoClient.Database("cloud_shop").Collection("orders"))
+	if err != nil {
+		log.Fatalf("Failed to migrate order prices: %v", err)
+	}
+	if migrated > 0 {
+		log.Printf("Converted legacy prices in %d orders.", migrated)
+	}
+
 	// --- Dependency 2: RabbitMQ Connection ---
 	amqpURL := os.Getenv("AMQP_URL")
 	if amqpURL == "" {
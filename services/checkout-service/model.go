@@ -7,6 +7,8 @@ import (
 	amqp "github.com/rabbitmq/amqp091-go"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+
+	"three-tier-cloud-shop/money"
 )
 
 // Env holds all external dependencies required by the handlers.
@@ -23,7 +25,22 @@ type CartItemFromService struct {
 	Quantity  int     `json:"quantity"`
 	Name      string  `json:"name"`
 	SKU       string  `json:"sku"`
-	Price     float64 `json:"price"`
+	Price     money.Money `json:"price"`
+	Currency  string  `json:"currency"`
+	Available bool    `json:"available,omitempty" bson:"-"`
+}
+
+// CartFromService is the cart-service's cart: the items with the totals it
+// computed for them.
+type CartFromService struct {
+	Items             []CartItemFromService `json:"items"`
+	ItemCount         int                   `json:"itemCount"`
+	Subtotal          money.Money           `json:"subtotal"`
+	EstimatedTax      money.Money           `json:"estimatedTax"`
+	EstimatedShipping money.Money           `json:"estimatedShipping"`
+	Total             money.Money           `json:"total"`
+	Currency          string                `json:"currency"`
+	Region            string                `json:"region"`
 }
 
 // Order defines the structure for an order document that will be stored in MongoDB
@@ -32,8 +49,49 @@ type Order struct {
 	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
 	UserEmail string             `json:"userEmail" bson:"userEmail"`
 	Items     []CartItemFromService         `json:"items" bson:"items"`
+	// Subtotal, Tax and Shipping are the cart-service's totals when the order
+	// was placed; they are zero on orders from before tax and shipping.
+	Subtotal  money.Money        `json:"subtotal" bson:"subtotal"`
+	Tax       money.Money        `json:"tax" bson:"tax"`
+	Shipping  money.Money        `json:"shipping" bson:"shipping"`
+	// Total is what the customer pays, in the currency of the items.
+	Total     money.Money        `json:"total" bson:"total"`
+	Currency  string             `json:"currency" bson:"currency"`
 	Status    string             `json:"status" bson:"status"`
 	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+	// Allocation is the warehouse each line ships from, as reserved by the
+	// catalog-service. Orders placed before warehouses existed have none.
+	Allocation []AllocationLine `json:"allocation,omitempty" bson:"allocation,omitempty"`
+	// Bundles lists the components each bundle line ships as; the allocation
+	// is made for those components.
+	Bundles []BundleExpansion `json:"bundles,omitempty" bson:"bundles,omitempty"`
+}
+
+// AllocationLine is the part of an order line shipped from one warehouse.
+type AllocationLine struct {
+	SKU       string `json:"sku" bson:"sku"`
+	Warehouse string `json:"warehouse" bson:"warehouse"`
+	Quantity  int64  `json:"quantity" bson:"quantity"`
+	Tracked   bool   `json:"tracked" bson:"tracked"`
+}
+
+// BundleExpansion is what a bundle order line is fulfilled as: its
+// components, multiplied by the number of bundles ordered.
+type BundleExpansion struct {
+	SKU        string            `json:"sku" bson:"sku"`
+	Quantity   int64             `json:"quantity" bson:"quantity"`
+	Components []BundleComponent `json:"components" bson:"components"`
+}
+
+type BundleComponent struct {
+	SKU      string `json:"sku" bson:"sku"`
+	Quantity int64  `json:"quantity" bson:"quantity"`
+}
+
+// StockAllocation is the catalog-service's answer to an allocation request.
+type StockAllocation struct {
+	Lines   []AllocationLine  `json:"lines"`
+	Bundles []BundleExpansion `json:"bundles"`
 }
 
 // contextKey is a custom type used for keys in context.WithValue to avoid collisions.
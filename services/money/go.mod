@@ -0,0 +1,5 @@
+module three-tier-cloud-shop/money
+
+go 1.23.3
+
+require go.mongodb.org/mongo-driver v1.17.4
@@ -0,0 +1,253 @@
+// Package money holds the Money type shared by the services that handle
+// prices, carts and orders, so every one of them rounds and formats amounts
+// the same way.
+package money
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// DefaultCurrency is used for amounts that don't state their currency,
+// including every price stored before Money existed.
+const DefaultCurrency = "USD"
+
+// jsonExponent is the number of decimal places amounts decoded from JSON are
+// counted in until In gives them their currency: the most any currency has.
+const jsonExponent = 3
+
+// currencyExponents lists currencies whose minor unit isn't 1/100.
+var currencyExponents = map[string]int{
+	"JPY": 0,
+	"KRW": 0,
+	"BHD": 3,
+	"KWD": 3,
+}
+
+// Money is an exact amount in the minor unit of an ISO 4217 currency
+// (cents for USD). Never use float64 for prices or totals.
+//
+// In JSON a Money is a decimal string such as "2499.99"; numbers are still
+// accepted on input so older clients keep working. JSON amounts don't carry
+// their currency, so a decoded Money has none until In gives it the one of
+// its document. In MongoDB it is stored as {amount, currency}; legacy float
+// prices are converted when read.
+type Money struct {
+	Amount   int64  `bson:"amount"`
+	Currency string `bson:"currency"`
+}
+
+// New builds a Money from an amount already in minor units.
+func New(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: NormalizeCurrency(currency)}
+}
+
+// Parse parses a decimal string like "2499.99" without going through float64.
+// Amounts with more decimal places than the currency has are rejected.
+func Parse(s, currency string) (Money, error) {
+	currency = NormalizeCurrency(currency)
+	amount, err := parseMinor(s, Exponent(currency))
+	if err != nil {
+		return Money{}, fmt.Errorf("%w for %s", err, currency)
+	}
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+// parseMinor parses a decimal string into an amount of minor units of exp
+// decimal places.
+func parseMinor(s string, exp int) (int64, error) {
+	s = strings.TrimSpace(s)
+	negative := strings.HasPrefix(s, "-")
+	digits := strings.TrimPrefix(s, "-")
+	whole, frac, hasFrac := strings.Cut(digits, ".")
+	if whole == "" && (!hasFrac || frac == "") {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	if len(frac) > exp {
+		return 0, fmt.Errorf("amount %q has more than %d decimal places", s, exp)
+	}
+	amount, err := strconv.ParseUint(whole+frac+strings.Repeat("0", exp-len(frac)), 10, 63)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	if negative {
+		return -int64(amount), nil
+	}
+	return int64(amount), nil
+}
+
+// fromFloat converts a legacy float amount, rounding to the nearest minor unit.
+func fromFloat(f float64, currency string) Money {
+	currency = NormalizeCurrency(currency)
+	scale := math.Pow10(Exponent(currency))
+	return Money{Amount: int64(math.Round(f * scale)), Currency: currency}
+}
+
+// String formats the amount as a plain decimal, e.g. "2499.99".
+func (m Money) String() string {
+	exp := m.exponent()
+	amount := m.Amount
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	if exp == 0 {
+		return sign + strconv.FormatInt(amount, 10)
+	}
+	scale := int64(math.Pow10(exp))
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/scale, exp, amount%scale)
+}
+
+// In gives an amount decoded from JSON the currency of its document, keeping
+// its decimal value: "12.50" becomes 12.50 EUR. It fails if the amount has
+// more decimal places than currency allows, and for an amount that already
+// has another currency: changing that takes an exchange rate.
+func (m Money) In(currency string) (Money, error) {
+	currency = NormalizeCurrency(currency)
+	switch m.Currency {
+	case currency:
+		return m, nil
+	case "":
+	default:
+		return Money{}, fmt.Errorf("amount is in %s, not %s", m.Currency, currency)
+	}
+	exp := Exponent(currency)
+	if exp >= jsonExponent {
+		return Money{Amount: m.Amount * pow10(exp-jsonExponent), Currency: currency}, nil
+	}
+	scale := pow10(jsonExponent - exp)
+	if m.Amount%scale != 0 {
+		decimal := strings.TrimRight(strings.TrimRight(m.String(), "0"), ".")
+		return Money{}, fmt.Errorf("amount %q has more than %d decimal places for %s", decimal, exp, currency)
+	}
+	return Money{Amount: m.Amount / scale, Currency: currency}, nil
+}
+
+// IsPositive reports whether the amount is greater than zero.
+func (m Money) IsPositive() bool { return m.Amount > 0 }
+
+// IsZero reports whether the amount is zero.
+func (m Money) IsZero() bool { return m.Amount == 0 }
+
+// Mul multiplies the amount by a quantity.
+func (m Money) Mul(quantity int) Money {
+	return Money{Amount: m.Amount * int64(quantity), Currency: m.Currency}
+}
+
+// Add sums two amounts of the same currency. A zero value without a currency
+// can be added to anything, which makes it a convenient starting total.
+func (m Money) Add(other Money) (Money, error) {
+	switch {
+	case m.Currency == "" && m.Amount == 0:
+		return other, nil
+	case other.Currency == "" && other.Amount == 0:
+		return m, nil
+	case m.Currency != other.Currency:
+		return Money{}, fmt.Errorf("cannot add %s to %s", other.Currency, m.Currency)
+	}
+	return Money{Amount: m.Amount + other.Amount, Currency: m.Currency}, nil
+}
+
+// Cmp compares two amounts of the same currency: -1, 0 or +1.
+func (m Money) Cmp(other Money) int {
+	switch {
+	case m.Amount < other.Amount:
+		return -1
+	case m.Amount > other.Amount:
+		return 1
+	}
+	return 0
+}
+
+// MarshalJSON writes the amount as a decimal string.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+// UnmarshalJSON accepts a decimal string or, for backward compatibility, a
+// number. The currency comes from the surrounding document, so the amount is
+// left without one for In.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var n json.Number
+		if err := json.Unmarshal(data, &n); err != nil {
+			return fmt.Errorf("amount must be a decimal string or number")
+		}
+		s = n.String()
+	}
+	amount, err := parseMinor(s, jsonExponent)
+	if err != nil {
+		return err
+	}
+	*m = Money{Amount: amount}
+	return nil
+}
+
+// UnmarshalBSONValue reads the {amount, currency} document and, for documents
+// written before the migration, a plain number.
+func (m *Money) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	raw := bson.RawValue{Type: t, Value: data}
+	switch t {
+	case bsontype.Double:
+		*m = fromFloat(raw.Double(), DefaultCurrency)
+		return nil
+	case bsontype.Int32, bsontype.Int64:
+		*m = New(raw.AsInt64()*pow10(Exponent(DefaultCurrency)), DefaultCurrency)
+		return nil
+	case bsontype.EmbeddedDocument:
+		var stored struct {
+			Amount   int64  `bson:"amount"`
+			Currency string `bson:"currency"`
+		}
+		if err := raw.Unmarshal(&stored); err != nil {
+			return err
+		}
+		*m = New(stored.Amount, stored.Currency)
+		return nil
+	case bsontype.Null:
+		*m = Money{}
+		return nil
+	}
+	return fmt.Errorf("cannot decode %s into Money", t)
+}
+
+// exponent is the number of decimal places of the amount; one decoded from
+// JSON without a currency is counted in jsonExponent places.
+func (m Money) exponent() int {
+	if m.Currency == "" {
+		return jsonExponent
+	}
+	return Exponent(m.Currency)
+}
+
+// NormalizeCurrency upper-cases an ISO 4217 code, defaulting to DefaultCurrency.
+func NormalizeCurrency(currency string) string {
+	if currency == "" {
+		return DefaultCurrency
+	}
+	return strings.ToUpper(currency)
+}
+
+// Exponent returns the number of decimal places of currency's minor unit.
+func Exponent(currency string) int {
+	if exp, ok := currencyExponents[NormalizeCurrency(currency)]; ok {
+		return exp
+	}
+	return 2
+}
+
+func pow10(exp int) int64 {
+	n := int64(1)
+	for i := 0; i < exp; i++ {
+		n *= 10
+	}
+	return n
+}
@@ -0,0 +1,154 @@
+package money
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in       string
+		currency string
+		want     Money
+		wantErr  bool
+	}{
+		{in: "2499.99", currency: "USD", want: Money{Amount: 249999, Currency: "USD"}},
+		{in: "0.1", currency: "usd", want: Money{Amount: 10, Currency: "USD"}},
+		{in: " 12 ", currency: "", want: Money{Amount: 1200, Currency: "USD"}},
+		{in: ".5", currency: "EUR", want: Money{Amount: 50, Currency: "EUR"}},
+		{in: "-3.25", currency: "EUR", want: Money{Amount: -325, Currency: "EUR"}},
+		{in: "1500", currency: "JPY", want: Money{Amount: 1500, Currency: "JPY"}},
+		{in: "1.234", currency: "KWD", want: Money{Amount: 1234, Currency: "KWD"}},
+		{in: "1.5", currency: "JPY", wantErr: true},
+		{in: "0.001", currency: "USD", wantErr: true},
+		{in: "", currency: "USD", wantErr: true},
+		{in: ".", currency: "USD", wantErr: true},
+		{in: "1,50", currency: "EUR", wantErr: true},
+		{in: "abc", currency: "USD", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in, tt.currency)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Parse(%q, %q) = %+v, want error", tt.in, tt.currency, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("Parse(%q, %q) = %+v, %v; want %+v", tt.in, tt.currency, got, err, tt.want)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		in   Money
+		want string
+	}{
+		{Money{Amount: 249999, Currency: "USD"}, "2499.99"},
+		{Money{Amount: 5, Currency: "EUR"}, "0.05"},
+		{Money{Amount: -325, Currency: "EUR"}, "-3.25"},
+		{Money{Amount: 1500, Currency: "JPY"}, "1500"},
+		{Money{Amount: 1234, Currency: "BHD"}, "1.234"},
+		{Money{Amount: 12500}, "12.500"},
+	}
+	for _, tt := range tests {
+		if got := tt.in.String(); got != tt.want {
+			t.Errorf("%+v.String() = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestIn(t *testing.T) {
+	tests := []struct {
+		json     string
+		currency string
+		want     Money
+		wantErr  bool
+	}{
+		{json: `"12.50"`, currency: "EUR", want: Money{Amount: 1250, Currency: "EUR"}},
+		{json: `12.5`, currency: "usd", want: Money{Amount: 1250, Currency: "USD"}},
+		{json: `"1500"`, currency: "JPY", want: Money{Amount: 1500, Currency: "JPY"}},
+		{json: `"1.234"`, currency: "KWD", want: Money{Amount: 1234, Currency: "KWD"}},
+		{json: `"0"`, currency: "", want: Money{Amount: 0, Currency: "USD"}},
+		{json: `"1.5"`, currency: "JPY", wantErr: true},
+		{json: `"9.999"`, currency: "USD", wantErr: true},
+	}
+	for _, tt := range tests {
+		var m Money
+		if err := json.Unmarshal([]byte(tt.json), &m); err != nil {
+			t.Fatalf("unmarshal %s: %v", tt.json, err)
+		}
+		got, err := m.In(tt.currency)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s.In(%q) = %+v, want error", tt.json, tt.currency, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s.In(%q) = %+v, %v; want %+v", tt.json, tt.currency, got, err, tt.want)
+		}
+	}
+}
+
+func TestInKeepsCurrency(t *testing.T) {
+	eur := New(1250, "EUR")
+	if got, err := eur.In("eur"); err != nil || got != eur {
+		t.Errorf("In(eur) = %+v, %v; want %+v", got, err, eur)
+	}
+	if _, err := eur.In("USD"); err == nil {
+		t.Error("In(USD) of a EUR amount succeeded, want error")
+	}
+}
+
+func TestUnmarshalJSONRejects(t *testing.T) {
+	for _, in := range []string{`"12.3456"`, `"twelve"`, `true`, `{}`} {
+		var m Money
+		if err := json.Unmarshal([]byte(in), &m); err == nil {
+			t.Errorf("unmarshal %s = %+v, want error", in, m)
+		}
+	}
+}
+
+func TestAdd(t *testing.T) {
+	tests := []struct {
+		a, b    Money
+		want    Money
+		wantErr bool
+	}{
+		{a: Money{}, b: New(500, "EUR"), want: New(500, "EUR")},
+		{a: New(500, "EUR"), b: Money{}, want: New(500, "EUR")},
+		{a: New(500, "EUR"), b: New(250, "EUR"), want: New(750, "EUR")},
+		{a: New(500, "EUR"), b: New(250, "USD"), wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := tt.a.Add(tt.b)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%+v.Add(%+v) = %+v, want error", tt.a, tt.b, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%+v.Add(%+v) = %+v, %v; want %+v", tt.a, tt.b, got, err, tt.want)
+		}
+	}
+}
+
+func TestFromFloat(t *testing.T) {
+	tests := []struct {
+		f        float64
+		currency string
+		want     Money
+	}{
+		{0.1 + 0.2, "USD", Money{Amount: 30, Currency: "USD"}},
+		{19.995, "USD", Money{Amount: 2000, Currency: "USD"}},
+		{1499.6, "JPY", Money{Amount: 1500, Currency: "JPY"}},
+	}
+	for _, tt := range tests {
+		if got := fromFloat(tt.f, tt.currency); got != tt.want {
+			t.Errorf("fromFloat(%v, %q) = %+v, want %+v", tt.f, tt.currency, got, tt.want)
+		}
+	}
+}
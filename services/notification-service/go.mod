@@ -5,3 +5,9 @@ go 1.24
 toolchain go1.24.4
 
 require github.com/rabbitmq/amqp091-go v1.10.0
+
+require three-tier-cloud-shop/money v0.0.0
+
+require go.mongodb.org/mongo-driver v1.17.4 // indirect
+
+replace three-tier-cloud-shop/money => ../money
@@ -7,13 +7,16 @@ import (
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
+
+	"three-tier-cloud-shop/money"
 )
 
 type OrderItem struct {
 	ProductID string  `json:"productId"`
 	SKU       string  `json:"sku"`
 	Name      string  `json:"name"`
-	Price     float64 `json:"price"`
+	Price     money.Money `json:"price"`
+	Currency  string  `json:"currency"`
 	Quantity  int     `json:"quantity"`
 }
 
@@ -21,6 +24,8 @@ type OrderMessage struct {
 	ID        string      `json:"id"`
 	UserEmail string      `json:"userEmail"`
 	Items     []OrderItem `json:"items"`
+	Total     money.Money `json:"total"`
+	Currency  string      `json:"currency"`
 	Status    string      `json:"status"`
 	CreatedAt time.Time   `json:"createdAt"`
 }
@@ -98,12 +103,16 @@ func main() {
 		for d := range msgs {
 			var order OrderMessage
 			err := json.Unmarshal(d.Body, &order)
+			var total money.Money
+			if err == nil {
+				total, err = order.Total.In(order.Currency)
+			}
 			if err != nil {
 				log.Printf("Error decoding JSON: %s", err)
 			} else {
 				// This is where you would put your email sending logic.
 				// For now, we just print a log message.
-				log.Printf("-> Received order for user '%s'. Simulating sending confirmation email.", order.UserEmail)
+				log.Printf("-> Received order for user '%s' (total %s %s). Simulating sending confirmation email.", order.UserEmail, total, total.Currency)
 			}
 		}
 	}()